@@ -0,0 +1,98 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+* Copyright 2015 The Prometheus Authors
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// statusHandler serves /api/v1/status, which returns the result of the last
+// measurement of each server on the metrics path as JSON, for tools that do
+// not speak the Prometheus exposition format.
+type statusHandler struct {
+	Collector Collector
+}
+
+// apiServerStatus is an entry of the response of /api/v1/status. The JSON
+// field names are part of the API and must not be changed.
+type apiServerStatus struct {
+	Server              string     `json:"server"`
+	LastMeasurement     *time.Time `json:"last_measurement"`
+	LastSuccess         *time.Time `json:"last_success"`
+	Up                  bool       `json:"up"`
+	OffsetSeconds       float64    `json:"offset_seconds"`
+	Stratum             float64    `json:"stratum"`
+	RTTSeconds          float64    `json:"rtt_seconds"`
+	RootDistanceSeconds float64    `json:"root_distance_seconds"`
+	ReferenceID         string     `json:"reference_id"`
+	Error               string     `json:"error"`
+}
+
+// ServeHTTP implements the http.Handler interface.
+func (h statusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	servers := []apiServerStatus{}
+	for _, s := range h.Collector.serverStatuses() {
+		servers = append(servers, newAPIServerStatus(s))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	err := enc.Encode(struct {
+		Servers []apiServerStatus `json:"servers"`
+	}{servers})
+	if err != nil {
+		slog.Error("cannot write status response", "err", err)
+	}
+}
+
+// newAPIServerStatus converts a serverStatus for the API. The measured values
+// are only set if the last measurement was successful, and the timestamps are
+// null if there was no measurement (or no successful measurement) yet.
+func newAPIServerStatus(s addressedServerStatus) apiServerStatus {
+	result := apiServerStatus{Server: s.Address, Error: s.Error}
+	if !s.Time.IsZero() {
+		t := s.Time.UTC()
+		result.LastMeasurement = &t
+	}
+	if !s.LastSuccess.IsZero() {
+		t := s.LastSuccess.UTC()
+		result.LastSuccess = &t
+	}
+	if result.LastMeasurement != nil && s.Error == "" {
+		result.Up = true
+		result.OffsetSeconds = s.Offset
+		result.Stratum = s.Stratum
+		result.RTTSeconds = s.RTT
+		result.RootDistanceSeconds = s.RootDistance
+		result.ReferenceID = s.ReferenceID
+	}
+	return result
+}
@@ -0,0 +1,123 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+* Copyright 2015 The Prometheus Authors
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"crypto/aes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+//This file implements symmetric-key authentication for NTP queries
+//(RFC 5905, section 7.3 and RFC 8573): A message authentication code (MAC),
+//consisting of the key ID and a digest, is appended to the request, and the
+//server appends a MAC computed with the same key to its response.
+
+var errUnauthenticatedResponse = errors.New("response is not authenticated (wrong key?)")
+
+// symmetricKey is a symmetric key for NTP authentication.
+type symmetricKey struct {
+	ID     uint32
+	Type   string //key into symmetricKeyTypes
+	Secret []byte
+}
+
+// symmetricKeyType describes a digest algorithm for symmetric keys.
+type symmetricKeyType struct {
+	DigestSize int
+	Digest     func(secret, packet []byte) ([]byte, error)
+}
+
+// symmetricKeyTypes contains the supported digest algorithms.
+var symmetricKeyTypes = map[string]symmetricKeyType{
+	"md5": {md5.Size, func(secret, packet []byte) ([]byte, error) {
+		sum := md5.Sum(append(append([]byte(nil), secret...), packet...))
+		return sum[:], nil
+	}},
+	"sha1": {sha1.Size, func(secret, packet []byte) ([]byte, error) {
+		sum := sha1.Sum(append(append([]byte(nil), secret...), packet...))
+		return sum[:], nil
+	}},
+	"aes-128-cmac": {aes.BlockSize, func(secret, packet []byte) ([]byte, error) {
+		block, err := aes.NewCipher(secret)
+		if err != nil {
+			return nil, err
+		}
+		return cmac(block, packet), nil
+	}},
+}
+
+// parseSymmetricKey parses the key configuration of a server. Like in the
+// ntp.keys file of ntpd, the secret is given as ASCII string if it is at most
+// 20 characters long, and in hexadecimal otherwise.
+func parseSymmetricKey(id uint32, keyType, secret string) (*symmetricKey, error) {
+	if _, exists := symmetricKeyTypes[keyType]; !exists {
+		return nil, fmt.Errorf("unsupported key type %q; must be \"md5\", \"sha1\" or \"aes-128-cmac\"", keyType)
+	}
+	if id == 0 {
+		return nil, errors.New("key ID must not be 0")
+	}
+	key := &symmetricKey{ID: id, Type: keyType, Secret: []byte(secret)}
+	if len(secret) > 20 {
+		var err error
+		key.Secret, err = hex.DecodeString(secret)
+		if err != nil {
+			return nil, fmt.Errorf("key longer than 20 characters must be in hexadecimal: %s", err)
+		}
+	}
+	if keyType == "aes-128-cmac" && len(key.Secret) != 16 {
+		return nil, errors.New("key for aes-128-cmac must be 16 bytes long (32 hexadecimal digits)")
+	}
+	return key, nil
+}
+
+// appendMAC appends the MAC to the given request packet.
+func (k *symmetricKey) appendMAC(packet []byte) ([]byte, error) {
+	digest, err := symmetricKeyTypes[k.Type].Digest(k.Secret, packet)
+	if err != nil {
+		return nil, err
+	}
+	var keyID [4]byte
+	binary.BigEndian.PutUint32(keyID[:], k.ID)
+	return append(append(packet, keyID[:]...), digest...), nil
+}
+
+// verifyMAC checks the MAC at the end of the given response packet.
+func (k *symmetricKey) verifyMAC(packet []byte) error {
+	keyType := symmetricKeyTypes[k.Type]
+	macOffset := len(packet) - 4 - keyType.DigestSize
+	if macOffset < ntpPacketSize || binary.BigEndian.Uint32(packet[macOffset:]) != k.ID {
+		return errUnauthenticatedResponse
+	}
+	expected, err := keyType.Digest(k.Secret, packet[:macOffset])
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(expected, packet[macOffset+4:]) {
+		return errUnauthenticatedResponse
+	}
+	return nil
+}
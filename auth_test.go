@@ -0,0 +1,118 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+* Copyright 2015 The Prometheus Authors
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func TestSymmetricKeyMAC(t *testing.T) {
+	//a client request in mode 3, version 4
+	packet := make([]byte, ntpPacketSize)
+	packet[0] = 0x23
+
+	testCases := []struct {
+		Type   string
+		Secret string
+		//expected digest after the key ID (empty to only check the round trip)
+		Digest string
+	}{
+		//digests computed independently as MD5/SHA1(secret || packet)
+		{"md5", "secret", "e090dd0f2a35e38783a54445cb1e6933"},
+		{"sha1", "secret", "ddf086dcbfd187aefb251326ca916acfcdc50225"},
+		{"aes-128-cmac", "2b7e151628aed2a6abf7158809cf4f3c", ""},
+	}
+	for _, tc := range testCases {
+		key, err := parseSymmetricKey(42, tc.Type, tc.Secret)
+		if err != nil {
+			t.Fatalf("%s: %s", tc.Type, err)
+		}
+		signed, err := key.appendMAC(append([]byte(nil), packet...))
+		if err != nil {
+			t.Fatalf("%s: %s", tc.Type, err)
+		}
+		digestSize := symmetricKeyTypes[tc.Type].DigestSize
+		if len(signed) != ntpPacketSize+4+digestSize {
+			t.Fatalf("%s: expected %d bytes, got %d", tc.Type, ntpPacketSize+4+digestSize, len(signed))
+		}
+		if !bytes.Equal(signed[ntpPacketSize:ntpPacketSize+4], []byte{0, 0, 0, 42}) {
+			t.Errorf("%s: expected key ID 42, got %x", tc.Type, signed[ntpPacketSize:ntpPacketSize+4])
+		}
+		if tc.Digest != "" && hex.EncodeToString(signed[ntpPacketSize+4:]) != tc.Digest {
+			t.Errorf("%s: expected digest %s, got %x", tc.Type, tc.Digest, signed[ntpPacketSize+4:])
+		}
+
+		//round trip
+		err = key.verifyMAC(signed)
+		if err != nil {
+			t.Errorf("%s: expected valid MAC, got %s", tc.Type, err)
+		}
+
+		//wrong key ID
+		otherKey := *key
+		otherKey.ID = 43
+		err = otherKey.verifyMAC(signed)
+		if err != errUnauthenticatedResponse {
+			t.Errorf("%s: expected error for wrong key ID, got %v", tc.Type, err)
+		}
+
+		//wrong digest
+		tampered := append([]byte(nil), signed...)
+		tampered[len(tampered)-1] ^= 1
+		err = key.verifyMAC(tampered)
+		if err != errUnauthenticatedResponse {
+			t.Errorf("%s: expected error for wrong digest, got %v", tc.Type, err)
+		}
+
+		//truncated response
+		for _, length := range []int{len(signed) - 1, ntpPacketSize + 4, ntpPacketSize, 0} {
+			err = key.verifyMAC(signed[:length])
+			if err != errUnauthenticatedResponse {
+				t.Errorf("%s: expected error for response truncated to %d bytes, got %v", tc.Type, length, err)
+			}
+		}
+	}
+}
+
+// test vector from RFC 4493, section 4 (example 4), since the digest of
+// aes-128-cmac is the CMAC of the packet
+func TestSymmetricKeyAESCMACKnownAnswer(t *testing.T) {
+	key, err := parseSymmetricKey(1, "aes-128-cmac", "2b7e151628aed2a6abf7158809cf4f3c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	message, err := hex.DecodeString("6bc1bee22e409f96e93d7e117393172aae2d8a571e03ac9c9eb76fac45af8e51" +
+		"30c81c46a35ce411e5fbc1191a0a52eff69f2445df4f9b17ad2b417be66c3710")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := key.appendMAC(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "00000001" + "51f0bebf7e3b9d92fc49741779363cfe"
+	actual := hex.EncodeToString(signed[len(message):])
+	if actual != expected {
+		t.Errorf("expected MAC %s, got %s", expected, actual)
+	}
+}
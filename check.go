@@ -0,0 +1,124 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+* Copyright 2015 The Prometheus Authors
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/beevik/ntp"
+)
+
+// The states of a Nagios plugin, which are also its exit codes.
+const (
+	checkOK = iota
+	checkWarning
+	checkCritical
+	checkUnknown
+)
+
+var checkStateNames = []string{"OK", "WARNING", "CRITICAL", "UNKNOWN"}
+
+// checkThresholds contains the thresholds of the check subcommand. Zero
+// values disable the respective threshold.
+type checkThresholds struct {
+	OffsetWarning   time.Duration
+	OffsetCritical  time.Duration
+	StratumWarning  int
+	StratumCritical int
+}
+
+// runCheck queries each server once like a Nagios plugin (e.g. check_ntp_time)
+// does: It prints a one-line status with performance data, and returns the
+// worst state of all servers as exit code. Servers that cannot be queried or
+// that are not synchronized are critical.
+func runCheck(c Collector, t checkThresholds, w io.Writer) int {
+	servers, _, _ := resolveServers(c.servers())
+	if len(servers) == 0 {
+		fmt.Fprintln(w, "NTP UNKNOWN: no NTP server found")
+		return checkUnknown
+	}
+
+	worst := checkOK
+	var messages, perfdata []string
+	for _, s := range servers {
+		resp, err := c.query(s)
+		if err == nil {
+			err = resp.Validate()
+		}
+		if err != nil {
+			worst = checkCritical
+			messages = append(messages, fmt.Sprintf("%s: %s", s.Address, err))
+			continue
+		}
+
+		state := t.evaluate(resp)
+		if state > worst {
+			worst = state
+		}
+		messages = append(messages, fmt.Sprintf("%s: offset %gs, stratum %d", s.Address, resp.ClockOffset.Seconds(), resp.Stratum))
+		perfdata = append(perfdata,
+			fmt.Sprintf("'%s offset'=%gs;%s;%s", s.Address, resp.ClockOffset.Seconds(),
+				formatCheckThreshold(t.OffsetWarning.Seconds()), formatCheckThreshold(t.OffsetCritical.Seconds())),
+			fmt.Sprintf("'%s stratum'=%d;%s;%s", s.Address, resp.Stratum,
+				formatCheckThreshold(float64(t.StratumWarning)), formatCheckThreshold(float64(t.StratumCritical))),
+		)
+	}
+
+	line := fmt.Sprintf("NTP %s: %s", checkStateNames[worst], strings.Join(messages, ", "))
+	if len(perfdata) > 0 {
+		line += "|" + strings.Join(perfdata, " ")
+	}
+	fmt.Fprintln(w, line)
+	return worst
+}
+
+// evaluate returns the state for a valid response.
+func (t checkThresholds) evaluate(resp *ntp.Response) int {
+	offset := resp.ClockOffset
+	if offset < 0 {
+		offset = -offset
+	}
+	stratum := int(resp.Stratum)
+	switch {
+	case t.OffsetCritical > 0 && offset > t.OffsetCritical:
+		return checkCritical
+	case t.StratumCritical > 0 && stratum > t.StratumCritical:
+		return checkCritical
+	case t.OffsetWarning > 0 && offset > t.OffsetWarning:
+		return checkWarning
+	case t.StratumWarning > 0 && stratum > t.StratumWarning:
+		return checkWarning
+	default:
+		return checkOK
+	}
+}
+
+// formatCheckThreshold formats a threshold for the performance data, where
+// disabled thresholds are left empty.
+func formatCheckThreshold(value float64) string {
+	if value == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%g", value)
+}
@@ -0,0 +1,380 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+* Copyright 2015 The Prometheus Authors
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"strings"
+	"time"
+)
+
+//This implements the subset of chronyd's command protocol (the one used by
+//chronyc, see candm.h in the chrony sources) that is needed for monitoring.
+
+const (
+	chronyProtocolVersion = 6
+	chronyPacketRequest   = 1
+	chronyPacketReply     = 2
+
+	chronyRequestHeaderLength = 20
+	chronyReplyHeaderLength   = 28
+
+	chronyRequestNumSources  = 14
+	chronyRequestSourceData  = 15
+	chronyRequestTracking    = 33
+	chronyRequestSourceStats = 34
+
+	chronyReplyNumSources  = 2
+	chronyReplySourceData  = 3
+	chronyReplyTracking    = 5
+	chronyReplySourceStats = 6
+
+	//lengths of the reply data, not including the trailing EOR field
+	chronyNumSourcesLength  = 4
+	chronySourceDataLength  = 48
+	chronyTrackingLength    = 76
+	chronySourceStatsLength = 56
+
+	chronyStatusNoSuchSource = 4
+)
+
+var chronyStatusNames = map[uint16]string{
+	1:                        "failed",
+	2:                        "unauthorized",
+	3:                        "invalid request",
+	chronyStatusNoSuchSource: "no such source",
+	6:                        "not enabled",
+	15:                       "inactive",
+	18:                       "bad packet version",
+	19:                       "bad packet length",
+}
+
+// chronyClient sends requests to the command socket of chronyd. The Address
+// is either the path of its Unix socket (usually
+// /var/run/chrony/chronyd.sock) or the "host:port" of its UDP command port
+// (usually 127.0.0.1:323). Over UDP, chronyd only answers monitoring requests
+// like "tracking" from localhost unless configured otherwise with "cmdallow".
+type chronyClient struct {
+	Address string
+	Timeout time.Duration
+}
+
+// chronyConn is a connection to the command socket of chronyd, over which
+// multiple requests can be sent.
+type chronyConn struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+// Dial opens a connection to chronyd.
+func (c chronyClient) Dial() (*chronyConn, error) {
+	if !strings.HasPrefix(c.Address, "/") {
+		conn, err := net.DialTimeout("udp", c.Address, c.Timeout)
+		if err != nil {
+			return nil, err
+		}
+		return &chronyConn{conn, c.Timeout}, nil
+	}
+
+	conn, err := dialUnixgram(c.Address)
+	if err != nil {
+		return nil, err
+	}
+	return &chronyConn{conn, c.Timeout}, nil
+}
+
+// Close closes the connection.
+func (c *chronyConn) Close() error {
+	return c.conn.Close()
+}
+
+// request sends a command with the given data to chronyd, and returns the
+// data of its reply (without the header) if it has the expected type.
+func (c *chronyConn) request(command uint16, data []byte, replyType uint16, replyLength int) ([]byte, error) {
+	err := c.conn.SetDeadline(time.Now().Add(c.timeout))
+	if err != nil {
+		return nil, err
+	}
+
+	//chronyd refuses requests that are shorter than their reply, to prevent
+	//traffic amplification
+	requestLength := chronyRequestHeaderLength + len(data)
+	if requestLength < chronyReplyHeaderLength+replyLength {
+		requestLength = chronyReplyHeaderLength + replyLength
+	}
+	req := make([]byte, requestLength)
+	_, err = rand.Read(req[8:12])
+	if err != nil {
+		return nil, err
+	}
+	sequence := binary.BigEndian.Uint32(req[8:])
+	req[0] = chronyProtocolVersion
+	req[1] = chronyPacketRequest
+	binary.BigEndian.PutUint16(req[4:], command)
+	copy(req[chronyRequestHeaderLength:], data)
+	_, err = c.conn.Write(req)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 2048)
+	for {
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		reply := buf[:n]
+		if n < chronyReplyHeaderLength || reply[1] != chronyPacketReply || binary.BigEndian.Uint32(reply[16:]) != sequence {
+			continue //not a reply to our request
+		}
+		if reply[0] != chronyProtocolVersion {
+			return nil, fmt.Errorf("chronyd replied with unsupported protocol version %d", reply[0])
+		}
+		if status := binary.BigEndian.Uint16(reply[8:]); status != 0 {
+			return nil, chronyStatusError(status)
+		}
+		if binary.BigEndian.Uint16(reply[4:]) != command || binary.BigEndian.Uint16(reply[6:]) != replyType {
+			return nil, errors.New("chronyd sent a reply of unexpected type")
+		}
+		if n < chronyReplyHeaderLength+replyLength {
+			return nil, fmt.Errorf("chronyd sent a short reply (%d bytes)", n)
+		}
+		return reply[chronyReplyHeaderLength:], nil
+	}
+}
+
+// chronyStatusError is returned when chronyd refuses a request.
+type chronyStatusError uint16
+
+// Error implements the error interface.
+func (e chronyStatusError) Error() string {
+	name, exists := chronyStatusNames[uint16(e)]
+	if !exists {
+		name = fmt.Sprintf("status %d", uint16(e))
+	}
+	return "chronyd refused request: " + name
+}
+
+// chronyTracking contains the result of the "tracking" command, which
+// describes how chronyd currently disciplines the system clock.
+type chronyTracking struct {
+	ReferenceID      uint32
+	ReferenceAddress net.IP
+	Stratum          uint16
+	LeapStatus       uint16
+	ReferenceTime    time.Time
+	//positive if the system clock is behind true time
+	SystemTimeOffset float64
+	LastOffset       float64
+	RMSOffset        float64
+	FrequencyPPM     float64
+	ResidualFreqPPM  float64
+	SkewPPM          float64
+	RootDelay        float64
+	RootDispersion   float64
+	UpdateInterval   float64
+}
+
+// Tracking executes the "tracking" command.
+func (c *chronyConn) Tracking() (chronyTracking, error) {
+	data, err := c.request(chronyRequestTracking, nil, chronyReplyTracking, chronyTrackingLength)
+	if err != nil {
+		return chronyTracking{}, err
+	}
+	return chronyTracking{
+		ReferenceID:      binary.BigEndian.Uint32(data[0:]),
+		ReferenceAddress: chronyIPAddr(data[4:24]),
+		Stratum:          binary.BigEndian.Uint16(data[24:]),
+		LeapStatus:       binary.BigEndian.Uint16(data[26:]),
+		ReferenceTime:    chronyTimespec(data[28:40]),
+		SystemTimeOffset: chronyFloat(data[40:]),
+		LastOffset:       chronyFloat(data[44:]),
+		RMSOffset:        chronyFloat(data[48:]),
+		FrequencyPPM:     chronyFloat(data[52:]),
+		ResidualFreqPPM:  chronyFloat(data[56:]),
+		SkewPPM:          chronyFloat(data[60:]),
+		RootDelay:        chronyFloat(data[64:]),
+		RootDispersion:   chronyFloat(data[68:]),
+		UpdateInterval:   chronyFloat(data[72:]),
+	}, nil
+}
+
+// chronyFloat decodes chrony's 32-bit floating point format: a 7-bit signed
+// exponent followed by a 25-bit signed coefficient.
+func chronyFloat(b []byte) float64 {
+	x := binary.BigEndian.Uint32(b)
+	exp := int(x >> 25)
+	if exp >= 1<<6 {
+		exp -= 1 << 7
+	}
+	coef := int(x % (1 << 25))
+	if coef >= 1<<24 {
+		coef -= 1 << 25
+	}
+	return float64(coef) * math.Pow(2, float64(exp-25))
+}
+
+// chronyTimespec decodes a timestamp (seconds split into two 32-bit halves,
+// followed by nanoseconds).
+func chronyTimespec(b []byte) time.Time {
+	secHigh := binary.BigEndian.Uint32(b[0:])
+	if secHigh == 0x7fffffff { //sent by chronyd builds with 32-bit time_t
+		secHigh = 0
+	}
+	sec := int64(secHigh)<<32 | int64(binary.BigEndian.Uint32(b[4:]))
+	return time.Unix(sec, int64(binary.BigEndian.Uint32(b[8:])))
+}
+
+// chronyIPAddr decodes an IP address (16 bytes of address, followed by the
+// address family). nil is returned if the field does not contain an address.
+func chronyIPAddr(b []byte) net.IP {
+	switch binary.BigEndian.Uint16(b[16:]) {
+	case 1:
+		return net.IP(append([]byte(nil), b[0:4]...))
+	case 2:
+		return net.IP(append([]byte(nil), b[0:16]...))
+	default:
+		return nil
+	}
+}
+
+// chronySourceName returns the name that chronyc shows for a source: its IP
+// address, or the reference ID for reference clocks.
+func chronySourceName(ipAddr []byte, refID uint32) string {
+	if ip := chronyIPAddr(ipAddr); ip != nil {
+		return ip.String()
+	}
+	if binary.BigEndian.Uint16(ipAddr[16:]) == 3 { //address family "ID"
+		refID = binary.BigEndian.Uint32(ipAddr[0:])
+	}
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, refID)
+	for idx, ch := range buf {
+		if ch < 0x20 || ch > 0x7e {
+			return string(buf[:idx])
+		}
+	}
+	return string(buf)
+}
+
+// chronySource contains the results of the "sources" and "sourcestats"
+// commands for one of the time sources of chronyd.
+type chronySource struct {
+	Name         string
+	Mode         string
+	State        string
+	Stratum      uint16
+	Poll         int16
+	Reachability uint16
+	//time since the last sample was received (nil if never)
+	LastRx         *time.Duration
+	Offset         float64
+	OriginalOffset float64
+	OffsetError    float64
+	//from sourcestats (not set if HasStats is false)
+	HasStats             bool
+	NumSamples           uint32
+	NumRuns              uint32
+	Span                 time.Duration
+	StdDev               float64
+	ResidualFreqPPM      float64
+	SkewPPM              float64
+	EstimatedOffset      float64
+	EstimatedOffsetError float64
+}
+
+var chronySourceModes = []string{"server", "peer", "refclock"}
+
+// chronySourceStates are named like in chrony 4.x. Older versions use
+// different names for the same states.
+var chronySourceStates = []string{"sync", "unreach", "falseticker", "jittery", "candidate", "outlier"}
+
+// Sources executes the "sources" and "sourcestats" commands.
+func (c *chronyConn) Sources() ([]chronySource, error) {
+	data, err := c.request(chronyRequestNumSources, nil, chronyReplyNumSources, chronyNumSourcesLength)
+	if err != nil {
+		return nil, err
+	}
+	count := binary.BigEndian.Uint32(data)
+
+	var sources []chronySource
+	for idx := uint32(0); idx < count; idx++ {
+		index := make([]byte, 4)
+		binary.BigEndian.PutUint32(index, idx)
+
+		data, err := c.request(chronyRequestSourceData, index, chronyReplySourceData, chronySourceDataLength)
+		if err == chronyStatusError(chronyStatusNoSuchSource) {
+			break //source was removed since we asked for the count
+		}
+		if err != nil {
+			return nil, err
+		}
+		s := chronySource{
+			Name:           chronySourceName(data[0:20], 0),
+			Mode:           chronyEnumName(chronySourceModes, binary.BigEndian.Uint16(data[26:])),
+			State:          chronyEnumName(chronySourceStates, binary.BigEndian.Uint16(data[24:])),
+			Poll:           int16(binary.BigEndian.Uint16(data[20:])),
+			Stratum:        binary.BigEndian.Uint16(data[22:]),
+			Reachability:   binary.BigEndian.Uint16(data[30:]),
+			OriginalOffset: chronyFloat(data[36:]),
+			Offset:         chronyFloat(data[40:]),
+			OffsetError:    chronyFloat(data[44:]),
+		}
+		if sinceSample := binary.BigEndian.Uint32(data[32:]); sinceSample != math.MaxUint32 {
+			lastRx := time.Duration(sinceSample) * time.Second
+			s.LastRx = &lastRx
+		}
+
+		data, err = c.request(chronyRequestSourceStats, index, chronyReplySourceStats, chronySourceStatsLength)
+		switch {
+		case err == chronyStatusError(chronyStatusNoSuchSource):
+			//source was removed in the meantime; report what we have
+		case err != nil:
+			return nil, err
+		case chronySourceName(data[4:24], binary.BigEndian.Uint32(data[0:])) != s.Name:
+			//list of sources changed in the meantime; report what we have
+		default:
+			s.HasStats = true
+			s.NumSamples = binary.BigEndian.Uint32(data[24:])
+			s.NumRuns = binary.BigEndian.Uint32(data[28:])
+			s.Span = time.Duration(binary.BigEndian.Uint32(data[32:])) * time.Second
+			s.StdDev = chronyFloat(data[36:])
+			s.ResidualFreqPPM = chronyFloat(data[40:])
+			s.SkewPPM = chronyFloat(data[44:])
+			s.EstimatedOffset = chronyFloat(data[48:])
+			s.EstimatedOffsetError = chronyFloat(data[52:])
+		}
+		sources = append(sources, s)
+	}
+	return sources, nil
+}
+
+func chronyEnumName(names []string, value uint16) string {
+	if int(value) < len(names) {
+		return names[value]
+	}
+	return fmt.Sprintf("unknown(%d)", value)
+}
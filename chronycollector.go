@@ -0,0 +1,315 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+* Copyright 2015 The Prometheus Authors
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	chronyUpDesc = prometheus.NewDesc(
+		"ntp_chrony_up",
+		"Whether the last query to chronyd succeeded (1) or not (0).",
+		nil, nil,
+	)
+	chronyTrackingReferenceDesc = prometheus.NewDesc(
+		"ntp_chrony_tracking_reference_info",
+		"Reference ID and address of the source that chronyd is synchronized to (always 1).",
+		[]string{"reference_id", "address"}, nil,
+	)
+	chronyTrackingStratumDesc = prometheus.NewDesc(
+		"ntp_chrony_tracking_stratum",
+		"Stratum of the local clock as reported by chronyd.",
+		nil, nil,
+	)
+	chronyTrackingLeapStatusDesc = prometheus.NewDesc(
+		"ntp_chrony_tracking_leap_status",
+		"Leap status reported by chronyd (0 = normal, 1 = insert second, 2 = delete second, 3 = not synchronised).",
+		nil, nil,
+	)
+	chronyTrackingReferenceTimeDesc = prometheus.NewDesc(
+		"ntp_chrony_tracking_reference_timestamp_seconds",
+		"Time of the last measurement from the reference source (UNIX timestamp).",
+		nil, nil,
+	)
+	chronyTrackingSystemTimeOffsetDesc = prometheus.NewDesc(
+		"ntp_chrony_tracking_system_time_offset_seconds",
+		"Offset of the system clock that chronyd is currently correcting (positive if the system clock is behind).",
+		nil, nil,
+	)
+	chronyTrackingLastOffsetDesc = prometheus.NewDesc(
+		"ntp_chrony_tracking_last_offset_seconds",
+		"Estimated offset of the local clock at the last clock update.",
+		nil, nil,
+	)
+	chronyTrackingRMSOffsetDesc = prometheus.NewDesc(
+		"ntp_chrony_tracking_rms_offset_seconds",
+		"Long-term average of the offset of the local clock.",
+		nil, nil,
+	)
+	chronyTrackingFrequencyDesc = prometheus.NewDesc(
+		"ntp_chrony_tracking_frequency_ppm",
+		"Frequency error of the system clock that chronyd is compensating for, in parts per million.",
+		nil, nil,
+	)
+	chronyTrackingResidualFrequencyDesc = prometheus.NewDesc(
+		"ntp_chrony_tracking_residual_frequency_ppm",
+		"Difference between the frequency measured from the reference source and the frequency currently in use, in parts per million.",
+		nil, nil,
+	)
+	chronyTrackingSkewDesc = prometheus.NewDesc(
+		"ntp_chrony_tracking_skew_ppm",
+		"Estimated error bound of the frequency, in parts per million.",
+		nil, nil,
+	)
+	chronyTrackingRootDelayDesc = prometheus.NewDesc(
+		"ntp_chrony_tracking_root_delay_seconds",
+		"Total network path delay to the stratum-1 computer from which the local clock is synchronized.",
+		nil, nil,
+	)
+	chronyTrackingRootDispersionDesc = prometheus.NewDesc(
+		"ntp_chrony_tracking_root_dispersion_seconds",
+		"Total dispersion accumulated through all computers back to the stratum-1 computer.",
+		nil, nil,
+	)
+	chronyTrackingUpdateIntervalDesc = prometheus.NewDesc(
+		"ntp_chrony_tracking_update_interval_seconds",
+		"Interval between the last two clock updates.",
+		nil, nil,
+	)
+
+	chronySourceInfoDesc = prometheus.NewDesc(
+		"ntp_chrony_source_info",
+		"Mode and selection state of the time source of chronyd (always 1).",
+		[]string{"source", "mode", "state"}, nil,
+	)
+	chronySourceStratumDesc = prometheus.NewDesc(
+		"ntp_chrony_source_stratum",
+		"Stratum of the time source of chronyd.",
+		[]string{"source"}, nil,
+	)
+	chronySourceReachabilityDesc = prometheus.NewDesc(
+		"ntp_chrony_source_reachability",
+		"Reachability register of the time source of chronyd (one bit per poll, the lowest bit is the latest poll).",
+		[]string{"source"}, nil,
+	)
+	chronySourcePollIntervalDesc = prometheus.NewDesc(
+		"ntp_chrony_source_poll_interval_seconds",
+		"Interval at which chronyd polls the time source.",
+		[]string{"source"}, nil,
+	)
+	chronySourceLastRxDesc = prometheus.NewDesc(
+		"ntp_chrony_source_last_rx_age_seconds",
+		"Time since chronyd received the last sample from the time source.",
+		[]string{"source"}, nil,
+	)
+	chronySourceOffsetDesc = prometheus.NewDesc(
+		"ntp_chrony_source_offset_seconds",
+		"Offset of the last sample from the time source, adjusted for clock corrections since then (positive if the local clock is ahead).",
+		[]string{"source"}, nil,
+	)
+	chronySourceMeasuredOffsetDesc = prometheus.NewDesc(
+		"ntp_chrony_source_measured_offset_seconds",
+		"Offset of the last sample from the time source as it was measured.",
+		[]string{"source"}, nil,
+	)
+	chronySourceOffsetErrorDesc = prometheus.NewDesc(
+		"ntp_chrony_source_offset_error_seconds",
+		"Error margin of the offset of the last sample from the time source.",
+		[]string{"source"}, nil,
+	)
+	chronySourceSamplesDesc = prometheus.NewDesc(
+		"ntp_chrony_source_samples",
+		"Number of samples from the time source that chronyd currently retains.",
+		[]string{"source"}, nil,
+	)
+	chronySourceRunsDesc = prometheus.NewDesc(
+		"ntp_chrony_source_sample_runs",
+		"Number of runs of residuals with the same sign in the regression over the retained samples.",
+		[]string{"source"}, nil,
+	)
+	chronySourceSpanDesc = prometheus.NewDesc(
+		"ntp_chrony_source_sample_span_seconds",
+		"Time between the oldest and the newest retained sample from the time source.",
+		[]string{"source"}, nil,
+	)
+	chronySourceStdDevDesc = prometheus.NewDesc(
+		"ntp_chrony_source_std_dev_seconds",
+		"Estimated standard deviation of the samples from the time source (jitter).",
+		[]string{"source"}, nil,
+	)
+	chronySourceResidualFrequencyDesc = prometheus.NewDesc(
+		"ntp_chrony_source_residual_frequency_ppm",
+		"Residual frequency of the time source, in parts per million.",
+		[]string{"source"}, nil,
+	)
+	chronySourceSkewDesc = prometheus.NewDesc(
+		"ntp_chrony_source_skew_ppm",
+		"Estimated error bound of the residual frequency of the time source, in parts per million.",
+		[]string{"source"}, nil,
+	)
+	chronySourceEstimatedOffsetDesc = prometheus.NewDesc(
+		"ntp_chrony_source_estimated_offset_seconds",
+		"Offset of the time source estimated from the regression over the retained samples.",
+		[]string{"source"}, nil,
+	)
+	chronySourceEstimatedOffsetErrorDesc = prometheus.NewDesc(
+		"ntp_chrony_source_estimated_offset_error_seconds",
+		"Error margin of the estimated offset of the time source.",
+		[]string{"source"}, nil,
+	)
+)
+
+// chronyCollector reports how the local chronyd disciplines the system clock
+// and what it knows about its time sources, i.e. the output of "chronyc
+// tracking", "chronyc sources" and "chronyc sourcestats". Unlike the Collector, which measures
+// remote NTP servers, chronyd is queried during each scrape.
+type chronyCollector struct {
+	Client chronyClient
+}
+
+// Describe implements the prometheus.Collector interface.
+func (c chronyCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- chronyUpDesc
+	ch <- chronyTrackingReferenceDesc
+	ch <- chronyTrackingStratumDesc
+	ch <- chronyTrackingLeapStatusDesc
+	ch <- chronyTrackingReferenceTimeDesc
+	ch <- chronyTrackingSystemTimeOffsetDesc
+	ch <- chronyTrackingLastOffsetDesc
+	ch <- chronyTrackingRMSOffsetDesc
+	ch <- chronyTrackingFrequencyDesc
+	ch <- chronyTrackingResidualFrequencyDesc
+	ch <- chronyTrackingSkewDesc
+	ch <- chronyTrackingRootDelayDesc
+	ch <- chronyTrackingRootDispersionDesc
+	ch <- chronyTrackingUpdateIntervalDesc
+	ch <- chronySourceInfoDesc
+	ch <- chronySourceStratumDesc
+	ch <- chronySourceReachabilityDesc
+	ch <- chronySourcePollIntervalDesc
+	ch <- chronySourceLastRxDesc
+	ch <- chronySourceOffsetDesc
+	ch <- chronySourceMeasuredOffsetDesc
+	ch <- chronySourceOffsetErrorDesc
+	ch <- chronySourceSamplesDesc
+	ch <- chronySourceRunsDesc
+	ch <- chronySourceSpanDesc
+	ch <- chronySourceStdDevDesc
+	ch <- chronySourceResidualFrequencyDesc
+	ch <- chronySourceSkewDesc
+	ch <- chronySourceEstimatedOffsetDesc
+	ch <- chronySourceEstimatedOffsetErrorDesc
+}
+
+// Collect implements the prometheus.Collector interface.
+func (c chronyCollector) Collect(ch chan<- prometheus.Metric) {
+	up := 0.0
+	defer func() {
+		ch <- prometheus.MustNewConstMetric(chronyUpDesc, prometheus.GaugeValue, up)
+	}()
+
+	conn, err := c.Client.Dial()
+	if err != nil {
+		slog.Error("couldn't connect to chronyd", "address", c.Client.Address, "err", err)
+		return
+	}
+	defer conn.Close()
+
+	t, err := conn.Tracking()
+	if err != nil {
+		slog.Error("couldn't get tracking data from chronyd", "address", c.Client.Address, "err", err)
+		return
+	}
+	c.collectTracking(ch, t)
+
+	sources, err := conn.Sources()
+	if err != nil {
+		slog.Error("couldn't get sources from chronyd", "address", c.Client.Address, "err", err)
+		return
+	}
+	c.collectSources(ch, sources)
+	up = 1
+}
+
+func (c chronyCollector) collectTracking(ch chan<- prometheus.Metric, t chronyTracking) {
+	address := ""
+	if t.ReferenceAddress != nil {
+		address = t.ReferenceAddress.String()
+	}
+	gauge := func(desc *prometheus.Desc, value float64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, labels...)
+	}
+	gauge(chronyTrackingReferenceDesc, 1, fmt.Sprintf("%08X", t.ReferenceID), address)
+	gauge(chronyTrackingStratumDesc, float64(t.Stratum))
+	gauge(chronyTrackingLeapStatusDesc, float64(t.LeapStatus))
+	gauge(chronyTrackingReferenceTimeDesc, float64(t.ReferenceTime.UnixNano())/1e9)
+	gauge(chronyTrackingSystemTimeOffsetDesc, t.SystemTimeOffset)
+	gauge(chronyTrackingLastOffsetDesc, t.LastOffset)
+	gauge(chronyTrackingRMSOffsetDesc, t.RMSOffset)
+	gauge(chronyTrackingFrequencyDesc, t.FrequencyPPM)
+	gauge(chronyTrackingResidualFrequencyDesc, t.ResidualFreqPPM)
+	gauge(chronyTrackingSkewDesc, t.SkewPPM)
+	gauge(chronyTrackingRootDelayDesc, t.RootDelay)
+	gauge(chronyTrackingRootDispersionDesc, t.RootDispersion)
+	gauge(chronyTrackingUpdateIntervalDesc, t.UpdateInterval)
+}
+
+func (c chronyCollector) collectSources(ch chan<- prometheus.Metric, sources []chronySource) {
+	seen := make(map[string]bool)
+	for _, s := range sources {
+		//reference clocks without a readable reference ID could have the same
+		//name, which would make the whole scrape fail
+		if seen[s.Name] {
+			slog.Debug("skipping duplicate chrony source", "source", s.Name)
+			continue
+		}
+		seen[s.Name] = true
+
+		gauge := func(desc *prometheus.Desc, value float64, labels ...string) {
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, append([]string{s.Name}, labels...)...)
+		}
+		gauge(chronySourceInfoDesc, 1, s.Mode, s.State)
+		gauge(chronySourceStratumDesc, float64(s.Stratum))
+		gauge(chronySourceReachabilityDesc, float64(s.Reachability))
+		gauge(chronySourcePollIntervalDesc, math.Pow(2, float64(s.Poll)))
+		if s.LastRx != nil {
+			gauge(chronySourceLastRxDesc, s.LastRx.Seconds())
+		}
+		gauge(chronySourceOffsetDesc, s.Offset)
+		gauge(chronySourceMeasuredOffsetDesc, s.OriginalOffset)
+		gauge(chronySourceOffsetErrorDesc, s.OffsetError)
+		if s.HasStats {
+			gauge(chronySourceSamplesDesc, float64(s.NumSamples))
+			gauge(chronySourceRunsDesc, float64(s.NumRuns))
+			gauge(chronySourceSpanDesc, s.Span.Seconds())
+			gauge(chronySourceStdDevDesc, s.StdDev)
+			gauge(chronySourceResidualFrequencyDesc, s.ResidualFreqPPM)
+			gauge(chronySourceSkewDesc, s.SkewPPM)
+			gauge(chronySourceEstimatedOffsetDesc, s.EstimatedOffset)
+			gauge(chronySourceEstimatedOffsetErrorDesc, s.EstimatedOffsetError)
+		}
+	}
+}
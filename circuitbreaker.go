@@ -0,0 +1,166 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+* Copyright 2015 The Prometheus Authors
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+var circuitStateNames = []string{"closed", "open", "half_open"}
+
+// circuitBreaker stops querying servers that failed repeatedly. After
+// Threshold consecutive failures, the circuit for that server opens, and no
+// queries are sent to it until Cooldown has passed. Then a single query is
+// allowed (half-open state), and all other queries are refused until its
+// result is recorded: If it succeeds, the circuit closes again,
+// otherwise it stays open for another cooldown period.
+type circuitBreaker struct {
+	Threshold int
+	Cooldown  time.Duration
+
+	mutex      sync.Mutex
+	circuits   map[string]*circuit
+	stateGauge *prometheus.GaugeVec
+}
+
+type circuit struct {
+	State    circuitState
+	Failures int
+	OpenedAt time.Time
+	//true while the single query of the half-open state is running
+	ProbeInFlight bool
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		Threshold: threshold,
+		Cooldown:  cooldown,
+		circuits:  make(map[string]*circuit),
+		stateGauge: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "ntp",
+			Name:      "server_circuit_state",
+			Help:      "State of the circuit breaker for the NTP server (1 for the current state, 0 otherwise).",
+		}, []string{"server", "state"}),
+	}
+}
+
+func (b *circuitBreaker) get(server string) *circuit {
+	c, exists := b.circuits[server]
+	if !exists {
+		c = &circuit{State: circuitClosed}
+		b.circuits[server] = c
+	}
+	return c
+}
+
+// Allow returns whether the given server may be queried right now.
+func (b *circuitBreaker) Allow(server string) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	c := b.get(server)
+	switch c.State {
+	case circuitOpen:
+		if time.Since(c.OpenedAt) < b.Cooldown {
+			return false
+		}
+		slog.Info("circuit is half-open, probing once", "server", server)
+		c.State = circuitHalfOpen
+		c.ProbeInFlight = true
+		b.report(server, c)
+	case circuitHalfOpen:
+		if c.ProbeInFlight {
+			return false
+		}
+		c.ProbeInFlight = true
+	}
+	return true
+}
+
+// Record updates the circuit for the given server with the result of a
+// measurement.
+func (b *circuitBreaker) Record(server string, success bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	c := b.get(server)
+	c.ProbeInFlight = false
+	if success {
+		c.State = circuitClosed
+		c.Failures = 0
+	} else {
+		c.Failures++
+		if c.State == circuitHalfOpen || c.Failures >= b.Threshold {
+			if c.State != circuitOpen {
+				slog.Warn("circuit opened after consecutive failures, not querying the server during the cooldown", "server", server, "failures", c.Failures, "cooldown", b.Cooldown)
+			}
+			c.State = circuitOpen
+			c.OpenedAt = time.Now()
+		}
+	}
+	b.report(server, c)
+}
+
+// State returns the state of the circuit for the given server, and the time
+// until which no queries are sent if the circuit is open.
+func (b *circuitBreaker) State(server string) (string, time.Time) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	c, exists := b.circuits[server]
+	if !exists {
+		return circuitStateNames[circuitClosed], time.Time{}
+	}
+	if c.State == circuitOpen {
+		return circuitStateNames[c.State], c.OpenedAt.Add(b.Cooldown)
+	}
+	return circuitStateNames[c.State], time.Time{}
+}
+
+// Forget removes the circuit and its ntp_server_circuit_state series for the
+// given server, e.g. because it was removed from the configuration.
+func (b *circuitBreaker) Forget(server string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	delete(b.circuits, server)
+	for _, name := range circuitStateNames {
+		b.stateGauge.DeleteLabelValues(server, name)
+	}
+}
+
+func (b *circuitBreaker) report(server string, c *circuit) {
+	for state, name := range circuitStateNames {
+		value := 0.0
+		if circuitState(state) == c.State {
+			value = 1
+		}
+		b.stateGauge.WithLabelValues(server, name).Set(value)
+	}
+}
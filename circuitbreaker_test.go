@@ -0,0 +1,53 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+* Copyright 2015 The Prometheus Authors
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerHalfOpen(t *testing.T) {
+	b := newCircuitBreaker(1, time.Millisecond)
+	b.Record("ntp.example.com", false)
+	if b.Allow("ntp.example.com") {
+		t.Fatal("expected the circuit to be open")
+	}
+	time.Sleep(2 * time.Millisecond)
+
+	//only one query may probe the server in the half-open state
+	if !b.Allow("ntp.example.com") {
+		t.Fatal("expected the first query after the cooldown to be allowed")
+	}
+	if b.Allow("ntp.example.com") {
+		t.Fatal("expected a second concurrent query to be refused")
+	}
+	b.Record("ntp.example.com", true)
+	if !b.Allow("ntp.example.com") {
+		t.Fatal("expected the circuit to be closed after a successful probe")
+	}
+
+	b.Record("ntp.example.com", false)
+	b.Forget("ntp.example.com")
+	if state, _ := b.State("ntp.example.com"); state != "closed" {
+		t.Errorf("expected state closed after Forget, got %s", state)
+	}
+}
@@ -0,0 +1,92 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+* Copyright 2015 The Prometheus Authors
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	clockStepsDesc = prometheus.NewDesc(
+		"ntp_clock_steps_total",
+		"Number of steps of the system clock that were detected since startup.",
+		nil, nil,
+	)
+	clockLastStepDesc = prometheus.NewDesc(
+		"ntp_clock_last_step_seconds",
+		"Size of the last detected step of the system clock (positive if the clock was stepped forward).",
+		nil, nil,
+	)
+)
+
+// clockStepCollector detects steps of the system clock (e.g. from ntpdate,
+// chrony's makestep or a VM being resumed) by comparing how far the wall
+// clock and the monotonic clock have advanced since the previous scrape. The
+// monotonic clock is only slewed, never stepped, so any difference between
+// both beyond Threshold is a step of the wall clock.
+type clockStepCollector struct {
+	Threshold time.Duration
+
+	mutex    sync.Mutex
+	last     time.Time
+	steps    uint64
+	lastStep time.Duration
+}
+
+// Describe implements the prometheus.Collector interface.
+func (c *clockStepCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- clockStepsDesc
+	ch <- clockLastStepDesc
+}
+
+// Collect implements the prometheus.Collector interface.
+func (c *clockStepCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.check(time.Now())
+	ch <- prometheus.MustNewConstMetric(clockStepsDesc, prometheus.CounterValue, float64(c.steps))
+	ch <- prometheus.MustNewConstMetric(clockLastStepDesc, prometheus.GaugeValue, c.lastStep.Seconds())
+}
+
+// check compares `now` with the previous reading. The caller must hold the
+// mutex.
+func (c *clockStepCollector) check(now time.Time) {
+	last := c.last
+	c.last = now
+	if last.IsZero() {
+		return
+	}
+
+	// Round(0) strips the monotonic clock reading, so that Sub() uses the
+	// wall clock
+	step := now.Round(0).Sub(last.Round(0)) - now.Sub(last)
+	if step <= c.Threshold && step >= -c.Threshold {
+		return
+	}
+	c.steps++
+	c.lastStep = step
+	slog.Warn("detected step of the system clock", "step", step)
+}
@@ -21,120 +21,841 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"log/slog"
+	"math"
+	"net"
 	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/beevik/ntp"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/common/log"
 )
 
-var (
-	serverIsUp = prometheus.NewGauge(prometheus.GaugeOpts{
-		Namespace: "ntp",
-		Name:      "server_is_up",
-		Help:      "Ntp server is functionnal or not.",
-	})
-	drift = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Namespace: "ntp",
-		Name:      "drift_seconds",
-		Help:      "Difference between system time and NTP time.",
-	}, []string{"server"})
-	stratum = prometheus.NewGauge(prometheus.GaugeOpts{
-		Namespace: "ntp",
-		Name:      "stratum",
-		Help:      "Stratum of NTP server.",
-	})
-	scrapeDuration = prometheus.NewSummary(prometheus.SummaryOpts{
-		Namespace: "ntp",
-		Name:      "scrape_duration_seconds",
-		Help:      "ntp_exporter: Duration of a scrape job.",
-	})
-)
+//Server contains the measurement settings for a single NTP server.
+type Server struct {
+	Address             string
+	ProtocolVersion     int
+	Timeout             time.Duration //0 means default timeout
+	MeasurementDuration time.Duration
+	HighDriftThreshold  time.Duration //drift above which multiple measurements are taken
+	DriftThreshold      time.Duration //drift above which ntp_drift_exceeds_threshold is 1 (0 means not reported)
+	MaxStratum          int           //stratum above which ntp_stratum_exceeds_maximum is 1 (0 means not reported)
+	MaxRootDistance     time.Duration //root distance above which ntp_root_distance_exceeds_maximum is 1
+	Aggregation         string        //key into aggregationStrategies
+	MeasurementSamples  int           //0 means as many as fit into MeasurementDuration
+	MeasurementInterval time.Duration //delay between measurements
+	NTS                 bool
+	NTSKEServer         string        //"host" or "host:port" (default: Address)
+	Key                 *symmetricKey //nil if symmetric-key authentication is not used
+	Interleaved         bool          //use interleaved mode if the server supports it
+	SourceAddress       net.IP        //nil means that the system picks the source address
+	AddressFamily       string        //key into addressFamilies ("" is the same as "any")
+	Pool                bool          //if true, each address of Address is measured separately
+	SRV                 bool          //if true, each target of the SRV records of Address is measured
+	//added to all metrics of this server (see serverLabelGatherer)
+	Labels map[string]string
+	//queried in this order if the server itself cannot be queried
+	Fallbacks []string
+}
 
 //Collector implements the prometheus.Collector interface.
 type Collector struct {
-	NtpServer              string
-	NtpProtocolVersion     int
-	NtpMeasurementDuration time.Duration
+	Servers            []Server
+	NtpReadBufferBytes int
+	NtpSourcePort      int //0 means an ephemeral port
+	NtpDSCP            int //0 means that packets are not marked
+	NtpDualStack       bool
+	Concurrency        int                 //maximum number of servers measured at the same time
+	NtpReferenceServer string              //must be the address of one of the Servers
+	CircuitBreaker     *circuitBreaker     //nil if disabled
+	KissOfDeath        *kissOfDeathBackoff //nil if disabled
+	Retry              retryPolicy         //for queries that failed transiently
+	Config             *configReloader     //if not nil, overrides Servers
+	Discoverers        []discoverer        //add to Servers
+	//if true, servers that were never reached report NaN values instead of
+	//having no series at all
+	ReportUnreachedServers bool
+	//smoothing factor for ntp_offset_ema_seconds (0 disables the metric)
+	EMAAlpha float64
+	//half-life for ntp_drift_seconds_smoothed (0 disables the metric)
+	EMAHalfLife time.Duration
+	EMAMaxGap   time.Duration
+	//time window for ntp_frequency_offset_ppm (0 disables the metric)
+	FrequencyWindow time.Duration
+	//if not zero, servers are measured in the background at this interval
+	//(see Poll) and Collect only reports the latest results
+	PollInterval time.Duration
+	//if not zero, scrapes within this duration after a measurement report the
+	//results of that measurement instead of measuring again
+	CacheTTL time.Duration
+	//if true, scrapes fail (with HTTP 500) if any server could not be
+	//measured, instead of reporting the metrics of the other servers
+	FailOnError bool
+	//if not zero, measurements are cut short to finish by this time (see
+	//metricsHandler)
+	Deadline time.Time
+	//if not nil, measurements are cut short when this is cancelled (on
+	//shutdown)
+	Context context.Context
+	//if not empty, measurements record an exemplar with this trace ID for
+	//ntp_scrape_duration_seconds (see traceIDFromRequest)
+	TraceID string
+
+	*metrics
+}
+
+func (c Collector) updateEMA(address string, offset float64) {
+	c.emaStates.Lock()
+	defer c.emaStates.Unlock()
+	if c.emaStates.ByServer == nil {
+		c.emaStates.ByServer = make(map[string]emaState)
+	}
+	now := time.Now()
+	state := c.emaStates.ByServer[address].update(offset, c.EMAAlpha, now, c.EMAMaxGap)
+	c.emaStates.ByServer[address] = state
+	c.offsetEMA.WithLabelValues(address).Set(state.Value)
+}
+
+func (c Collector) updateSmoothedDrift(address string, offset float64) {
+	c.smoothedDriftStates.Lock()
+	defer c.smoothedDriftStates.Unlock()
+	if c.smoothedDriftStates.ByServer == nil {
+		c.smoothedDriftStates.ByServer = make(map[string]emaState)
+	}
+	now := time.Now()
+	state := c.smoothedDriftStates.ByServer[address]
+	alpha := state.alphaForHalfLife(now, c.EMAHalfLife)
+	state = state.update(offset, alpha, now, c.EMAMaxGap)
+	c.smoothedDriftStates.ByServer[address] = state
+	c.driftSmoothed.WithLabelValues(address).Set(state.Value)
+}
+
+//minFrequencySamples is the number of measurements that are needed before
+//ntp_frequency_offset_ppm and ntp_allan_deviation are reported.
+const minFrequencySamples = 3
+
+//updateFrequency estimates the frequency error of the local clock from the
+//linear regression of the offsets to the given server over time. If the local
+//clock runs fast, the offset decreases, so the frequency error is the
+//negative slope. The Allan deviation of the offsets shows how stable the
+//frequency is.
+func (c Collector) updateFrequency(address string, offset float64) {
+	c.offsetHistories.Lock()
+	defer c.offsetHistories.Unlock()
+	if c.offsetHistories.ByServer == nil {
+		c.offsetHistories.ByServer = make(map[string][]offsetSample)
+	}
+	now := time.Now()
+	history := append(c.offsetHistories.ByServer[address], offsetSample{Time: now, Offset: offset})
+	for len(history) > 0 && now.Sub(history[0].Time) > c.FrequencyWindow {
+		history = history[1:]
+	}
+	c.offsetHistories.ByServer[address] = history
+	if len(history) >= minFrequencySamples {
+		c.frequencyOffset.WithLabelValues(address).Set(-calculateSlope(history) * 1e6)
+		adev, tau := calculateAllanDeviation(history)
+		c.allanDeviation.WithLabelValues(address).Set(adev)
+		c.allanDeviationTau.WithLabelValues(address).Set(tau)
+	}
+}
+
+func (m *metrics) setReached(address string) {
+	m.reachedServers.Lock()
+	defer m.reachedServers.Unlock()
+	if m.reachedServers.Set == nil {
+		m.reachedServers.Set = make(map[string]bool)
+	}
+	m.reachedServers.Set[address] = true
+}
+
+func (m *metrics) wasReached(address string) bool {
+	m.reachedServers.Lock()
+	defer m.reachedServers.Unlock()
+	return m.reachedServers.Set[address]
+}
+
+//servers returns the list of servers to measure.
+func (c Collector) servers() []Server {
+	servers := c.Servers
+	if c.Config != nil {
+		servers = c.Config.Servers()
+	}
+	if len(c.Discoverers) > 0 {
+		//copy to avoid appending to the shared slice
+		servers = append([]Server(nil), servers...)
+	}
+	for _, d := range c.Discoverers {
+		for _, s := range d.Servers() {
+			if !hasServer(servers, s.Address) {
+				servers = append(servers, s)
+			}
+		}
+	}
+	return servers
 }
 
 //Describe implements the prometheus.Collector interface.
 func (c Collector) Describe(ch chan<- *prometheus.Desc) {
-	serverIsUp.Describe(ch)
-	drift.Describe(ch)
-	stratum.Describe(ch)
-	scrapeDuration.Describe(ch)
+	c.metrics.describe(ch)
+	if c.CircuitBreaker != nil {
+		c.CircuitBreaker.stateGauge.Describe(ch)
+	}
+	if c.FailOnError {
+		ch <- measurementFailedDesc
+	}
 }
 
 //Collect implements the prometheus.Collector interface.
 func (c Collector) Collect(ch chan<- prometheus.Metric) {
-	err := c.measure()
-	//only report data when measurement was successful
-	if err == nil {
-		serverIsUp.Collect(ch)
-		drift.Collect(ch)
-		stratum.Collect(ch)
-		scrapeDuration.Collect(ch)
-	} else {
-		serverIsUp.Collect(ch)
-		log.Errorln(err)
+	if c.PollInterval == 0 {
+		if c.CacheTTL > 0 {
+			c.updateUnlessCached()
+		} else {
+			c.update()
+		}
+	}
+	c.metrics.collect(ch)
+	if c.CircuitBreaker != nil {
+		c.CircuitBreaker.stateGauge.Collect(ch)
+	}
+	if c.FailOnError {
+		//an invalid metric makes promhttp fail the whole scrape
+		for _, err := range c.measurementErrors() {
+			ch <- prometheus.NewInvalidMetric(measurementFailedDesc, err)
+		}
+	}
+}
+
+//Poll measures all servers every c.PollInterval. It does not return.
+func (c Collector) Poll() {
+	ticker := time.NewTicker(c.PollInterval)
+	defer ticker.Stop()
+	for {
+		c.update()
+		<-ticker.C
+	}
+}
+
+//update measures all servers and updates the metrics.
+func (c Collector) update() {
+	servers := c.expandServers(c.servers())
+	c.rememberMeasured(servers)
+	results := c.measureAll(servers)
+	if c.NtpReferenceServer != "" {
+		c.compareWithReference(results)
+	}
+	c.reportBestServer(results)
+	c.reportConsensus(results)
+
+	c.ready.Lock()
+	c.ready.Done = true
+	c.ready.Unlock()
+}
+
+//rememberMeasured records the labels of the given servers for
+//serverLabelGatherer, and removes the metrics of servers that were measured
+//in the previous update, but are not measured anymore (e.g. because they were
+//removed from a -ntp.file-sd file).
+func (c Collector) rememberMeasured(servers []Server) {
+	c.measured.Lock()
+	defer c.measured.Unlock()
+	labels := make(map[string]map[string]string, len(servers))
+	for _, s := range servers {
+		labels[s.Address] = s.Labels
+	}
+	for address := range c.measured.Labels {
+		if _, exists := labels[address]; !exists {
+			c.forgetServer(address)
+		}
+	}
+	c.measured.Labels = labels
+}
+
+//forgetServer is like metrics.forgetServer, but also resets the circuit
+//breaker for the given server.
+func (c Collector) forgetServer(address string) {
+	c.metrics.forgetServer(address)
+	if c.CircuitBreaker != nil {
+		c.CircuitBreaker.Forget(address)
+	}
+}
+
+//updateUnlessCached is like update, but does nothing if the last update was
+//less than c.CacheTTL ago. Concurrent scrapes wait for the same update
+//instead of measuring the servers multiple times.
+func (c Collector) updateUnlessCached() {
+	c.cache.Lock()
+	defer c.cache.Unlock()
+	if !c.cache.LastUpdate.IsZero() && time.Since(c.cache.LastUpdate) < c.CacheTTL {
 		return
 	}
+	c.update()
+	c.cache.LastUpdate = time.Now()
+}
+
+//measureAll measures the given servers, at most c.Concurrency at a time, and
+//returns the results of all successful measurements.
+func (c Collector) measureAll(servers []Server) map[string]measurement {
+	concurrency := c.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var (
+		mutex   sync.Mutex
+		wg      sync.WaitGroup
+		results = make(map[string]measurement, len(servers))
+		slots   = make(chan struct{}, concurrency)
+	)
+	for _, s := range servers {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(s Server) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			result, err := c.measure(s)
+			if err != nil {
+				slog.Error("measurement failed", "server", s.Address, "err", err)
+				c.setStatus(s.Address, serverStatus{Time: time.Now(), Error: err.Error()})
+				return
+			}
+			now := time.Now()
+			c.setStatus(s.Address, serverStatus{
+				Time:         now,
+				LastSuccess:  now,
+				Offset:       result.Offset,
+				Stratum:      result.Stratum,
+				RTT:          result.RTT,
+				RootDistance: result.RootDistance,
+				ReferenceID:  result.ReferenceID,
+			})
+			mutex.Lock()
+			results[s.Address] = result
+			mutex.Unlock()
+		}(s)
+	}
+	wg.Wait()
+	return results
+}
+
+//measurement contains the results of measuring one server that are needed
+//for comparing it with other servers.
+type measurement struct {
+	Offset       float64
+	RootDistance float64
+	Confidence   float64
+	Usable       bool
+	//for the status of the server
+	Stratum     float64
+	RTT         float64
+	ReferenceID string
 }
 
-func (c Collector) measure() error {
-	const highDrift = 0.01
+//observeScrapeDuration records the duration of a measurement that began at
+//`begin`, with an exemplar if the measurement was made for a traced request.
+func (c Collector) observeScrapeDuration(address string, begin time.Time) {
+	now := time.Now()
+	duration := now.Sub(begin).Seconds()
+	c.scrapeDuration.WithLabelValues(address).Observe(duration)
+	if c.TraceID != "" {
+		c.setScrapeExemplar(address, openMetricsExemplar{TraceID: c.TraceID, Value: duration, Time: now})
+	}
+}
 
+//measure measures the given server and updates its metrics.
+func (c Collector) measure(s Server) (result measurement, err error) {
 	begin := time.Now()
-	clockOffset, strat, err := c.getClockOffsetAndStratum()
+	c.setSeriesCreated(s.Address, begin)
+	c.ntsEnabled.WithLabelValues(s.Address).Set(boolToFloat(s.NTS))
+	resp, used, err := c.queryWithFallback(s)
 
 	if err != nil {
-		serverIsUp.Set(0)
-		return fmt.Errorf("couldn't get NTP drift: %s", err)
+		c.reportFailure(s)
+		c.observeScrapeDuration(s.Address, begin)
+		return measurement{}, err
 	}
+	clockOffset := resp.ClockOffset.Seconds()
+	strat := float64(resp.Stratum)
+	usable := isUsable(resp)
+	rootDistance := resp.RootDistance.Seconds()
+	sampleOffsets := []float64{clockOffset}
+	sampleRTTs := []float64{resp.RTT.Seconds()}
+	lastResp := resp
+	var loopDuration time.Duration
 
-	//if clock drift is unusually high (e.g. >10ms): repeat measurements for 30 seconds and submit median value
+	//if clock drift is unusually high (default >10ms): repeat measurements for 30 seconds and submit aggregated value (default median)
+	highDrift := s.HighDriftThreshold.Seconds()
 	if clockOffset > highDrift {
 		var measurementsClockOffset []float64
 		var measurementsStratum []float64
+		var measurementsRTT []float64
 
-		log.Warnf("clock drift is above %.2fs, taking multiple measurements for %.2f seconds", highDrift, c.NtpMeasurementDuration.Seconds())
-		for time.Since(begin) < c.NtpMeasurementDuration {
-			clockOffset, stratum, err := c.getClockOffsetAndStratum()
+		slog.Warn("clock drift is above threshold, taking multiple measurements", "server", s.Address, "drift", clockOffset, "threshold", s.HighDriftThreshold, "duration", s.MeasurementDuration)
+		loopBegin := time.Now()
+		for n := 0; time.Since(begin) < s.MeasurementDuration && (s.MeasurementSamples == 0 || n < s.MeasurementSamples); n++ {
+			if n > 0 && s.MeasurementInterval > 0 {
+				if time.Since(begin)+s.MeasurementInterval >= s.MeasurementDuration || !c.hasTimeLeft(s.MeasurementInterval) {
+					break
+				}
+				if !c.sleep(s.MeasurementInterval) {
+					break
+				}
+			}
+			if !c.hasTimeLeft(0) {
+				slog.Warn("scrape timeout reached", "server", s.Address, "measurements", n)
+				break
+			}
+			resp, err := c.query(used)
 
 			if err != nil {
-				serverIsUp.Set(0)
-				return fmt.Errorf("couldn't get NTP drift: %s", err)
+				if !c.hasTimeLeft(0) {
+					slog.Warn("scrape timeout reached", "server", s.Address, "measurements", n)
+					break
+				}
+				if c.CircuitBreaker != nil {
+					c.CircuitBreaker.Record(used.Address, false)
+				}
+				c.reportFailure(s)
+				c.observeScrapeDuration(s.Address, begin)
+				return measurement{}, err
 			}
 
-			measurementsClockOffset = append(measurementsClockOffset, clockOffset)
-			measurementsStratum = append(measurementsStratum, stratum)
+			measurementsClockOffset = append(measurementsClockOffset, resp.ClockOffset.Seconds())
+			measurementsStratum = append(measurementsStratum, float64(resp.Stratum))
+			measurementsRTT = append(measurementsRTT, resp.RTT.Seconds())
+			usable = isUsable(resp)
+			rootDistance = resp.RootDistance.Seconds()
+			lastResp = resp
 
 		}
+		loopDuration = time.Since(loopBegin)
 
-		clockOffset = calculateMedian(measurementsClockOffset)
-		strat = calculateMedian(measurementsStratum)
+		//if there was no time for any further measurements, just report the
+		//first one
+		if len(measurementsClockOffset) > 0 {
+			clockOffset = aggregationStrategies[s.Aggregation](measurementsClockOffset, measurementsRTT)
+			strat = calculateMedian(measurementsStratum)
+			sampleOffsets = measurementsClockOffset
+			sampleRTTs = measurementsRTT
+		}
+	}
+	confidence := calculateConfidence(sampleOffsets, sampleRTTs)
+	validationErr := lastResp.Validate()
+	if validationErr != nil {
+		slog.Debug("invalid response", "server", s.Address, "err", validationErr)
+	}
+	rtt := calculateMedian(sampleRTTs)
+
+	c.drift.WithLabelValues(s.Address).Set(clockOffset)
+	if s.DriftThreshold > 0 {
+		c.driftExceedsThreshold.WithLabelValues(s.Address).Set(boolToFloat(math.Abs(clockOffset) > s.DriftThreshold.Seconds()))
+	} else {
+		c.driftExceedsThreshold.DeleteLabelValues(s.Address)
+	}
+	c.rtt.WithLabelValues(s.Address).Set(rtt)
+	c.minError.WithLabelValues(s.Address).Set(lastResp.MinError.Seconds())
+	c.rootDelay.WithLabelValues(s.Address).Set(lastResp.RootDelay.Seconds())
+	c.rootDispersion.WithLabelValues(s.Address).Set(lastResp.RootDispersion.Seconds())
+	c.rootDistance.WithLabelValues(s.Address).Set(rootDistance)
+	c.rootDistanceExceedsMaximum.WithLabelValues(s.Address).Set(boolToFloat(rootDistance > s.MaxRootDistance.Seconds()))
+	c.leapIndicator.WithLabelValues(s.Address).Set(float64(lastResp.Leap))
+	c.precision.WithLabelValues(s.Address).Set(lastResp.Precision.Seconds())
+	c.pollInterval.WithLabelValues(s.Address).Set(lastResp.Poll.Seconds())
+	c.referenceTimeAge.WithLabelValues(s.Address).Set(lastResp.Time.Sub(lastResp.ReferenceTime).Seconds())
+	c.responseValid.WithLabelValues(s.Address).Set(boolToFloat(validationErr == nil))
+	c.referenceInfo.Set(s.Address, formatReferenceID(lastResp.Stratum, lastResp.ReferenceID))
+	c.offsetUpperBound.WithLabelValues(s.Address).Set(clockOffset + rootDistance)
+	c.offsetLowerBound.WithLabelValues(s.Address).Set(clockOffset - rootDistance)
+	c.stratum.WithLabelValues(s.Address).Set(strat)
+	if s.MaxStratum > 0 {
+		c.stratumExceedsMaximum.WithLabelValues(s.Address).Set(boolToFloat(strat > float64(s.MaxStratum)))
+	} else {
+		c.stratumExceedsMaximum.DeleteLabelValues(s.Address)
+	}
+	c.serverIsUp.WithLabelValues(s.Address).Set(1)
+	c.serverUsable.WithLabelValues(s.Address).Set(boolToFloat(usable))
+	c.setReached(s.Address)
+	c.lastSuccess.WithLabelValues(s.Address).SetToCurrentTime()
+	c.highDriftLoopDuration.WithLabelValues(s.Address).Set(loopDuration.Seconds())
+	c.measurementConfidence.WithLabelValues(s.Address).Set(confidence)
+	if len(sampleOffsets) > 1 {
+		min, max := calculateMinMax(sampleOffsets)
+		c.offsetJitter.WithLabelValues(s.Address).Set(calculateStdDev(sampleOffsets))
+		c.offsetMin.WithLabelValues(s.Address).Set(min)
+		c.offsetMax.WithLabelValues(s.Address).Set(max)
+	} else {
+		c.offsetJitter.DeleteLabelValues(s.Address)
+		c.offsetMin.DeleteLabelValues(s.Address)
+		c.offsetMax.DeleteLabelValues(s.Address)
+	}
+	if c.EMAAlpha > 0 {
+		c.updateEMA(s.Address, clockOffset)
+	}
+	if c.EMAHalfLife > 0 {
+		c.updateSmoothedDrift(s.Address, clockOffset)
+	}
+	if c.FrequencyWindow > 0 {
+		c.updateFrequency(s.Address, clockOffset)
 	}
+	c.observeScrapeDuration(s.Address, begin)
 
-	drift.WithLabelValues(c.NtpServer).Set(clockOffset)
-	stratum.Set(strat)
-	serverIsUp.Set(1)
-	scrapeDuration.Observe(time.Since(begin).Seconds())
-	return nil
+	if c.NtpDualStack {
+		c.measureDualStack(s)
+	}
+	return measurement{
+		Offset:       clockOffset,
+		RootDistance: rootDistance,
+		Confidence:   confidence,
+		Usable:       usable,
+		Stratum:      strat,
+		RTT:          rtt,
+		ReferenceID:  formatReferenceID(lastResp.Stratum, lastResp.ReferenceID),
+	}, nil
+}
+
+//compareWithReference reports the offsets of all servers relative to the
+//trusted reference server. Since all offsets come from the same scrape, the
+//comparison is not distorted by drift of the local clock between scrapes.
+func (c Collector) compareWithReference(results map[string]measurement) {
+	c.offsetFromReference.Reset()
+	ref, ok := results[c.NtpReferenceServer]
+	if !ok {
+		slog.Error("reference server could not be measured, cannot compare other servers against it", "server", c.NtpReferenceServer)
+		return
+	}
+	for address, result := range results {
+		if address != c.NtpReferenceServer {
+			c.offsetFromReference.WithLabelValues(address, c.NtpReferenceServer).Set(result.Offset - ref.Offset)
+		}
+	}
+}
+
+//reportBestServer selects the best time source among the usable servers,
+//similar to how an NTP client would: The server with the lowest root distance
+//wins. Ties are broken by the higher measurement confidence, and then by
+//address to keep the selection deterministic.
+func (c Collector) reportBestServer(results map[string]measurement) {
+	c.bestServerInfo.Reset()
+	var (
+		bestAddress string
+		best        measurement
+	)
+	for address, result := range results {
+		if !result.Usable {
+			continue
+		}
+		isBetter := bestAddress == "" ||
+			result.RootDistance < best.RootDistance ||
+			(result.RootDistance == best.RootDistance && result.Confidence > best.Confidence) ||
+			(result.RootDistance == best.RootDistance && result.Confidence == best.Confidence && address < bestAddress)
+		if isBetter {
+			bestAddress = address
+			best = result
+		}
+	}
+	if bestAddress != "" {
+		c.bestServerInfo.WithLabelValues(bestAddress).Set(1)
+	}
+}
+
+//reportFailure updates the metrics for a server that could not be measured.
+//Its value metrics are removed instead of reporting stale values, except if
+//ReportUnreachedServers is set and the server was never reached: Then they
+//are reported as NaN, so that dashboards show a series for the server.
+func (c Collector) reportFailure(s Server) {
+	c.serverIsUp.WithLabelValues(s.Address).Set(0)
+	c.serverUsable.WithLabelValues(s.Address).Set(0)
+	c.referenceInfo.Delete(s.Address)
+	c.addressInfo.Delete(s.Address)
+	if c.ReportUnreachedServers && !c.wasReached(s.Address) {
+		c.drift.WithLabelValues(s.Address).Set(math.NaN())
+		c.rtt.WithLabelValues(s.Address).Set(math.NaN())
+		c.minError.WithLabelValues(s.Address).Set(math.NaN())
+		c.rootDelay.WithLabelValues(s.Address).Set(math.NaN())
+		c.rootDispersion.WithLabelValues(s.Address).Set(math.NaN())
+		c.rootDistance.WithLabelValues(s.Address).Set(math.NaN())
+		c.leapIndicator.WithLabelValues(s.Address).Set(math.NaN())
+		c.precision.WithLabelValues(s.Address).Set(math.NaN())
+		c.pollInterval.WithLabelValues(s.Address).Set(math.NaN())
+		c.referenceTimeAge.WithLabelValues(s.Address).Set(math.NaN())
+		c.responseValid.WithLabelValues(s.Address).Set(math.NaN())
+		c.stratum.WithLabelValues(s.Address).Set(math.NaN())
+		c.offsetUpperBound.WithLabelValues(s.Address).Set(math.NaN())
+		c.offsetLowerBound.WithLabelValues(s.Address).Set(math.NaN())
+		c.measurementConfidence.WithLabelValues(s.Address).Set(math.NaN())
+		return
+	}
+	c.drift.DeleteLabelValues(s.Address)
+	c.driftExceedsThreshold.DeleteLabelValues(s.Address)
+	c.rtt.DeleteLabelValues(s.Address)
+	c.minError.DeleteLabelValues(s.Address)
+	c.rootDelay.DeleteLabelValues(s.Address)
+	c.rootDispersion.DeleteLabelValues(s.Address)
+	c.rootDistance.DeleteLabelValues(s.Address)
+	c.rootDistanceExceedsMaximum.DeleteLabelValues(s.Address)
+	c.leapIndicator.DeleteLabelValues(s.Address)
+	c.precision.DeleteLabelValues(s.Address)
+	c.pollInterval.DeleteLabelValues(s.Address)
+	c.referenceTimeAge.DeleteLabelValues(s.Address)
+	c.responseValid.DeleteLabelValues(s.Address)
+	c.stratum.DeleteLabelValues(s.Address)
+	c.stratumExceedsMaximum.DeleteLabelValues(s.Address)
+	c.offsetUpperBound.DeleteLabelValues(s.Address)
+	c.offsetLowerBound.DeleteLabelValues(s.Address)
+	c.highDriftLoopDuration.DeleteLabelValues(s.Address)
+	c.ipDivergence.DeleteLabelValues(s.Address)
+	c.familyDrift.DeleteLabelValues(s.Address, "ipv4")
+	c.familyDrift.DeleteLabelValues(s.Address, "ipv6")
+	c.measurementConfidence.DeleteLabelValues(s.Address)
+	c.offsetJitter.DeleteLabelValues(s.Address)
+	c.offsetMin.DeleteLabelValues(s.Address)
+	c.offsetMax.DeleteLabelValues(s.Address)
+}
+
+//measureDualStack queries the server once over IPv4 and once over IPv6 and
+//records both clock offsets and how much they diverge. A significant divergence
+//points to a problem on the network path of one of the address families.
+func (c Collector) measureDualStack(s Server) {
+	var offsets [2]float64
+	ok := true
+	for idx, af := range []string{"ipv4", "ipv6"} {
+		network := addressFamilies[af][0]
+		resp, err := c.queryOver(s, network)
+		if err != nil {
+			slog.Warn("dual-stack measurement failed", "server", s.Address, "network", network, "err", err)
+			c.familyDrift.DeleteLabelValues(s.Address, af)
+			ok = false
+			continue
+		}
+		offsets[idx] = resp.ClockOffset.Seconds()
+		c.familyDrift.WithLabelValues(s.Address, af).Set(offsets[idx])
+	}
+	if ok {
+		c.ipDivergence.WithLabelValues(s.Address).Set(offsets[0] - offsets[1])
+	} else {
+		c.ipDivergence.DeleteLabelValues(s.Address)
+	}
+}
+
+//hasTimeLeft returns whether something that takes the given duration can be
+//done before c.Deadline.
+func (c Collector) hasTimeLeft(d time.Duration) bool {
+	if c.Context != nil && c.Context.Err() != nil {
+		return false
+	}
+	return c.Deadline.IsZero() || time.Now().Add(d).Before(c.Deadline)
+}
+
+//sleep waits for the given duration. It returns false if it was interrupted
+//because c.Context was cancelled.
+func (c Collector) sleep(d time.Duration) bool {
+	if c.Context == nil {
+		time.Sleep(d)
+		return true
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-c.Context.Done():
+		return false
+	}
+}
+
+//queryWithFallback queries the given server. If that fails, its fallback
+//servers are queried in order. The server that answered is returned.
+func (c Collector) queryWithFallback(s Server) (resp *ntp.Response, used Server, err error) {
+	used = s
+	resp, err = c.queryUnlessBlocked(s)
+	for _, address := range s.Fallbacks {
+		if err == nil {
+			break
+		}
+		slog.Warn("trying fallback server", "server", s.Address, "fallback", address, "err", err)
+		used = s
+		used.Address = address
+		used.Fallbacks = nil
+		resp, err = c.queryUnlessBlocked(used)
+	}
+	if len(s.Fallbacks) > 0 {
+		if err == nil {
+			c.fallbackActive.WithLabelValues(s.Address).Set(boolToFloat(used.Address != s.Address))
+			c.serverUsed.Set(s.Address, used.Address)
+		} else {
+			c.fallbackActive.DeleteLabelValues(s.Address)
+			c.serverUsed.Delete(s.Address)
+		}
+	}
+	return resp, used, err
+}
+
+//queryUnlessBlocked is like query, but does not query servers that are
+//blocked by the kiss-of-death backoff or the circuit breaker.
+func (c Collector) queryUnlessBlocked(s Server) (*ntp.Response, error) {
+	if c.KissOfDeath != nil {
+		if ok, code := c.KissOfDeath.Allow(s.Address); !ok {
+			c.kissCode.Set(s.Address, code)
+			return nil, fmt.Errorf("%s sent kiss-of-death code %s recently, skipping measurement", s.Address, code)
+		}
+	}
+	if c.CircuitBreaker != nil {
+		if !c.CircuitBreaker.Allow(s.Address) {
+			return nil, fmt.Errorf("circuit for %s is open, skipping measurement", s.Address)
+		}
+		resp, err := c.query(s)
+		c.CircuitBreaker.Record(s.Address, err == nil)
+		return resp, err
+	}
+	return c.query(s)
+}
+
+func (c Collector) query(s Server) (*ntp.Response, error) {
+	return c.queryOver(s, "")
+}
+
+//queryOver is like query, but over the given network ("udp4" or "udp6"; an
+//empty string selects the network from the settings of the server).
+func (c Collector) queryOver(s Server, network string) (*ntp.Response, error) {
+	return c.queryWithResult(s, network, &queryResult{})
 }
 
-func (c Collector) getClockOffsetAndStratum() (clockOffset float64, strat float64, err error) {
-	options := ntp.QueryOptions{Version: c.NtpProtocolVersion}
-	resp, err := ntp.QueryWithOptions(c.NtpServer, options)
+//recordQueryError updates the metrics for a query that failed with the given
+//error (as returned by queryServer).
+func (c Collector) recordQueryError(address string, err error) {
+	c.queries.WithLabelValues(address, classifyQueryError(err)).Inc()
+	if isSuspectedDrop(err) {
+		c.droppedResponses.WithLabelValues(address).Inc()
+	}
+}
+
+//queryWithResult is like queryOver, but also fills `result` with details
+//about the response (see /debug/ntp).
+func (c Collector) queryWithResult(s Server, network string, result *queryResult) (*ntp.Response, error) {
+	options := queryOptions{
+		Network:         network,
+		Version:         s.ProtocolVersion,
+		Timeout:         s.Timeout,
+		ReadBufferBytes: c.NtpReadBufferBytes,
+		SourcePort:      c.NtpSourcePort,
+		DSCP:            c.NtpDSCP,
+		Key:             s.Key,
+		Interleaved:     s.Interleaved,
+		SourceAddress:   s.SourceAddress,
+		AddressFamily:   s.AddressFamily,
+	}
+	options.Result = result
+	if c.Context != nil {
+		if c.Context.Err() != nil {
+			return nil, fmt.Errorf("couldn't get NTP drift from %s: exporter is shutting down", s.Address)
+		}
+		options.Context = c.Context
+	}
+	if !c.Deadline.IsZero() {
+		if options.Timeout == 0 {
+			options.Timeout = ntpDefaultTimeout
+		}
+		remaining := time.Until(c.Deadline)
+		if remaining <= 0 {
+			return nil, fmt.Errorf("couldn't get NTP drift from %s: scrape timeout exceeded", s.Address)
+		}
+		if remaining < options.Timeout {
+			options.Timeout = remaining
+		}
+	}
+	if s.NTS {
+		keServer := s.NTSKEServer
+		if keServer == "" {
+			//the NTS-KE server listens on its own port
+			keServer, _ = splitServerAddress(s.Address)
+		}
+		timeout := options.Timeout
+		if timeout == 0 {
+			timeout = ntpDefaultTimeout
+		}
+		session, cookie, err := takeNTSCookie(s.Address, keServer, timeout)
+		if err != nil {
+			c.queries.WithLabelValues(s.Address, "network_error").Inc()
+			return nil, fmt.Errorf("couldn't get NTP drift from %s: %s", s.Address, err)
+		}
+		options.NTS = &ntsRequest{Session: session, Cookie: cookie}
+	}
+	resp, err := queryServer(s.Address, options)
+	for retry := 1; retry <= c.Retry.Attempts && err != nil && isTransientQueryError(err); retry++ {
+		delay := c.Retry.Delay(retry)
+		if !c.hasTimeLeft(delay) {
+			break
+		}
+		c.recordQueryError(s.Address, err)
+		c.queryRetries.WithLabelValues(s.Address).Inc()
+		slog.Debug("retrying NTP query", "server", s.Address, "retry", retry, "delay", delay, "err", err)
+		if !c.sleep(delay) {
+			break
+		}
+		if remaining := time.Until(c.Deadline); !c.Deadline.IsZero() && remaining < options.Timeout {
+			options.Timeout = remaining
+		}
+		resp, err = queryServer(s.Address, options)
+	}
+	if result.ReplayedResponses > 0 {
+		c.replayedResponses.WithLabelValues(s.Address).Add(float64(result.ReplayedResponses))
+	}
+	if s.NTS {
+		if _, ok := err.(ntsVerificationError); ok {
+			//start over with a new key exchange
+			forgetNTSSession(s.Address)
+		} else if err == nil {
+			addNTSCookies(s.Address, options.NTS.NewCookies)
+		}
+		c.ntsCookieCount.WithLabelValues(s.Address).Set(float64(ntsCookieCount(s.Address)))
+	}
 	if err != nil {
-		serverIsUp.Set(0)
-		return 0, 0, fmt.Errorf("couldn't get NTP drift: %s", err)
+		c.recordQueryError(s.Address, err)
+		return nil, fmt.Errorf("couldn't get NTP drift from %s: %s", s.Address, err)
+	}
+	c.protocolVersion.WithLabelValues(s.Address).Set(float64(result.Version))
+	c.interleaved.WithLabelValues(s.Address).Set(boolToFloat(result.Interleaved))
+	c.addressInfo.Set(s.Address, result.Address)
+	//a stratum 0 response is a kiss-of-death packet that does not contain a
+	//usable time
+	kissCode := ""
+	if resp.Stratum == 0 {
+		kissCode = strings.TrimSpace(resp.KissCode)
+		result.KissCode = kissCode
+		c.kissCode.Set(s.Address, kissCode)
+	} else {
+		c.kissCode.Delete(s.Address)
+	}
+	if c.KissOfDeath != nil {
+		c.KissOfDeath.Record(s.Address, kissCode)
+	}
+	if resp.Stratum == 0 {
+		c.queries.WithLabelValues(s.Address, "kiss_of_death").Inc()
+		return nil, fmt.Errorf("couldn't get NTP drift from %s: %s", s.Address, kissOfDeathError{kissCode})
+	}
+	c.queries.WithLabelValues(s.Address, "success").Inc()
+	c.queryRTT.WithLabelValues(s.Address).Observe(resp.RTT.Seconds())
+	c.queryAbsOffset.WithLabelValues(s.Address).Observe(math.Abs(resp.ClockOffset.Seconds()))
+	return resp, nil
+}
+
+//isUsable reports whether a response comes from a server that can actually
+//be used as a time source: it must be synchronized to an upstream (leap
+//indicator other than "not in sync") and report a valid stratum (1-15;
+//stratum 0 is a kiss-of-death and 16 means unsynchronized).
+func isUsable(resp *ntp.Response) bool {
+	return resp.Leap != ntp.LeapNotInSync && resp.Stratum >= 1 && resp.Stratum <= 15
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
 	}
-	clockOffset = resp.ClockOffset.Seconds()
-	strat = float64(resp.Stratum)
-	return clockOffset, strat, nil
+	return 0
 }
 
 func calculateMedian(slice []float64) (median float64) {
@@ -0,0 +1,332 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+* Copyright 2015 The Prometheus Authors
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	yaml "gopkg.in/yaml.v2"
+)
+
+var (
+	configLastReloadTimestamp = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "ntp_exporter",
+		Name:      "config_last_reload_timestamp_seconds",
+		Help:      "Unix timestamp of the last successful configuration load.",
+	})
+	configLastReloadSuccessful = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "ntp_exporter",
+		Name:      "config_last_reload_successful",
+		Help:      "Whether the last configuration reload attempt was successful.",
+	})
+)
+
+// Config contains the contents of the file given with -config.file.
+type Config struct {
+	Servers []ServerConfig          `yaml:"servers"`
+	Modules map[string]ServerConfig `yaml:"modules"`
+}
+
+// ServerConfig contains the settings for one NTP server or probe module in the
+// config file. Fields that are not set fall back to the respective
+// command-line flag.
+type ServerConfig struct {
+	Address             string            `yaml:"address"`
+	ProtocolVersion     int               `yaml:"protocol_version"`
+	Timeout             time.Duration     `yaml:"timeout"`
+	MeasurementDuration time.Duration     `yaml:"measurement_duration"`
+	HighDriftThreshold  time.Duration     `yaml:"high_drift_threshold"`
+	DriftThreshold      time.Duration     `yaml:"drift_threshold"`
+	MaxStratum          int               `yaml:"max_stratum"`
+	MaxRootDistance     time.Duration     `yaml:"max_root_distance"`
+	Aggregation         string            `yaml:"aggregation"`
+	MeasurementSamples  int               `yaml:"measurement_samples"`
+	MeasurementInterval time.Duration     `yaml:"measurement_interval"`
+	NTS                 *bool             `yaml:"nts"`
+	NTSKEServer         string            `yaml:"nts_ke_server"`
+	KeyID               uint32            `yaml:"key_id"`
+	KeyType             string            `yaml:"key_type"`
+	Key                 string            `yaml:"key"`
+	Interleaved         *bool             `yaml:"interleaved"`
+	SourceAddress       string            `yaml:"source_address"`
+	AddressFamily       string            `yaml:"address_family"`
+	Pool                bool              `yaml:"pool"`
+	SRV                 bool              `yaml:"srv"`
+	Fallbacks           []string          `yaml:"fallbacks"`
+	Labels              map[string]string `yaml:"labels"`
+}
+
+// loadConfig reads the config file at the given path and returns the servers
+// and probe modules listed in it. Settings missing from the file are taken
+// from `defaults`. The file must not list any of the `static` servers (from
+// -ntp.server) again.
+func loadConfig(path string, defaults Server, static []Server) ([]Server, map[string]Server, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var cfg Config
+	err = yaml.UnmarshalStrict(buf, &cfg)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot parse %s: %s", path, err)
+	}
+
+	servers := make([]Server, 0, len(cfg.Servers))
+	seen := make(map[string]int, len(cfg.Servers))
+	for idx, sc := range cfg.Servers {
+		if sc.Address == "" {
+			return nil, nil, fmt.Errorf("%s: servers[%d] has no address", path, idx)
+		}
+		if hasServer(static, sc.Address) {
+			return nil, nil, fmt.Errorf("%s: servers[%d] is already given with -ntp.server: %s", path, idx, sc.Address)
+		}
+		if prevIdx, exists := seen[sc.Address]; exists {
+			return nil, nil, fmt.Errorf("%s: servers[%d] has the same address as servers[%d]: %s", path, idx, prevIdx, sc.Address)
+		}
+		seen[sc.Address] = idx
+		s := defaults
+		s.Address = sc.Address
+		s, err = applyServerConfig(path, s.Address, s, sc)
+		if err != nil {
+			return nil, nil, err
+		}
+		servers = append(servers, s)
+	}
+
+	modules := make(map[string]Server, len(cfg.Modules))
+	for name, sc := range cfg.Modules {
+		//the target of a module is given in the probe request
+		if sc.Address != "" || sc.Pool || sc.SRV || len(sc.Fallbacks) > 0 || len(sc.Labels) > 0 {
+			return nil, nil, fmt.Errorf("%s: module %s cannot have an address, pool, srv, fallbacks or labels", path, name)
+		}
+		s, err := applyServerConfig(path, "module "+name, defaults, sc)
+		if err != nil {
+			return nil, nil, err
+		}
+		modules[name] = s
+	}
+	return servers, modules, nil
+}
+
+// applyServerConfig overrides the settings of the given server with those
+// from a server entry or module in the config file. The name identifies the
+// entry in error messages.
+func applyServerConfig(path, name string, s Server, sc ServerConfig) (Server, error) {
+	if sc.ProtocolVersion != 0 {
+		s.ProtocolVersion = sc.ProtocolVersion
+	}
+	if err := checkProtocolVersion(s.ProtocolVersion); err != nil {
+		return s, fmt.Errorf("%s: %s: %s", path, name, err)
+	}
+	if sc.Timeout < 0 {
+		return s, fmt.Errorf("%s: timeout for %s must not be negative", path, name)
+	}
+	if sc.Timeout != 0 {
+		s.Timeout = sc.Timeout
+	}
+	if sc.MeasurementDuration < 0 {
+		return s, fmt.Errorf("%s: measurement_duration for %s must not be negative", path, name)
+	}
+	if sc.MeasurementDuration != 0 {
+		s.MeasurementDuration = sc.MeasurementDuration
+	}
+	if sc.HighDriftThreshold < 0 {
+		return s, fmt.Errorf("%s: high_drift_threshold for %s must not be negative", path, name)
+	}
+	if sc.HighDriftThreshold != 0 {
+		s.HighDriftThreshold = sc.HighDriftThreshold
+	}
+	if sc.DriftThreshold < 0 {
+		return s, fmt.Errorf("%s: drift_threshold for %s must not be negative", path, name)
+	}
+	if sc.DriftThreshold != 0 {
+		s.DriftThreshold = sc.DriftThreshold
+	}
+	if sc.MaxStratum < 0 || sc.MaxStratum > 15 {
+		return s, fmt.Errorf("%s: max_stratum for %s must be between 0 and 15 (0 = default)", path, name)
+	}
+	if sc.MaxStratum != 0 {
+		s.MaxStratum = sc.MaxStratum
+	}
+	if sc.MaxRootDistance < 0 {
+		return s, fmt.Errorf("%s: max_root_distance for %s must not be negative", path, name)
+	}
+	if sc.MaxRootDistance != 0 {
+		s.MaxRootDistance = sc.MaxRootDistance
+	}
+	if sc.Aggregation != "" {
+		if _, exists := aggregationStrategies[sc.Aggregation]; !exists {
+			return s, fmt.Errorf("%s: invalid aggregation %q for %s", path, sc.Aggregation, name)
+		}
+		s.Aggregation = sc.Aggregation
+	}
+	if sc.MeasurementSamples < 0 {
+		return s, fmt.Errorf("%s: measurement_samples for %s must not be negative", path, name)
+	}
+	if sc.MeasurementSamples != 0 {
+		s.MeasurementSamples = sc.MeasurementSamples
+	}
+	if sc.MeasurementInterval < 0 {
+		return s, fmt.Errorf("%s: measurement_interval for %s must not be negative", path, name)
+	}
+	if sc.MeasurementInterval != 0 {
+		s.MeasurementInterval = sc.MeasurementInterval
+	}
+	if sc.NTS != nil {
+		s.NTS = *sc.NTS
+	}
+	if sc.NTSKEServer != "" {
+		s.NTS = true
+		s.NTSKEServer = sc.NTSKEServer
+	}
+	if sc.KeyID != 0 || sc.Key != "" {
+		var err error
+		s.Key, err = parseSymmetricKey(sc.KeyID, sc.KeyType, sc.Key)
+		if err != nil {
+			return s, fmt.Errorf("%s: invalid key for %s: %s", path, name, err)
+		}
+		if s.NTS {
+			return s, fmt.Errorf("%s: %s cannot use both NTS and a symmetric key", path, name)
+		}
+	}
+	s.Pool = sc.Pool
+	s.SRV = sc.SRV
+	if s.Pool && s.SRV {
+		return s, fmt.Errorf("%s: %s cannot be both a pool and an SRV domain", path, name)
+	}
+	for _, fallback := range sc.Fallbacks {
+		if fallback == "" || fallback == s.Address {
+			return s, fmt.Errorf("%s: invalid fallback %q for %s", path, fallback, name)
+		}
+	}
+	if len(sc.Fallbacks) > 0 && (s.Pool || s.SRV) {
+		return s, fmt.Errorf("%s: %s cannot have fallbacks since it is a pool or SRV domain", path, name)
+	}
+	s.Fallbacks = sc.Fallbacks
+	if err := validateLabels(sc.Labels); err != nil {
+		return s, fmt.Errorf("%s: invalid labels for %s: %s", path, name, err)
+	}
+	s.Labels = sc.Labels
+	if sc.Interleaved != nil {
+		s.Interleaved = *sc.Interleaved
+	}
+	if s.Interleaved && s.NTS {
+		return s, fmt.Errorf("%s: %s cannot use interleaved mode with NTS", path, name)
+	}
+	if sc.SourceAddress != "" {
+		s.SourceAddress = net.ParseIP(sc.SourceAddress)
+		if s.SourceAddress == nil {
+			return s, fmt.Errorf("%s: invalid source_address %q for %s", path, sc.SourceAddress, name)
+		}
+	}
+	if sc.AddressFamily != "" {
+		if _, exists := addressFamilies[sc.AddressFamily]; !exists {
+			return s, fmt.Errorf("%s: invalid address_family %q for %s", path, sc.AddressFamily, name)
+		}
+		s.AddressFamily = sc.AddressFamily
+	}
+	if s.ProtocolVersion == 5 && (s.NTS || s.Key != nil) {
+		return s, fmt.Errorf("%s: %s cannot use NTS or a symmetric key with protocol version 5", path, name)
+	}
+	return s, nil
+}
+
+// configReloader holds the list of servers from the config file, which can be
+// replaced at runtime by Reload(). It is shared between all copies of the
+// Collector.
+type configReloader struct {
+	Path            string
+	Defaults        Server   //see loadConfig
+	StaticServers   []Server //from -ntp.server
+	ReferenceServer string   //reloads fail if this server is not configured anymore
+
+	mutex   sync.RWMutex
+	servers []Server
+	modules map[string]Server
+}
+
+// Servers returns the servers given with -ntp.server, followed by those from
+// the most recently loaded config file.
+func (r *configReloader) Servers() []Server {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.servers
+}
+
+// Module returns the probe module with the given name from the most recently
+// loaded config file.
+func (r *configReloader) Module(name string) (Server, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	s, exists := r.modules[name]
+	return s, exists
+}
+
+// Reload re-reads the config file. If it is invalid, the previous server list
+// is kept.
+func (r *configReloader) Reload() error {
+	servers, modules, err := loadConfig(r.Path, r.Defaults, r.StaticServers)
+	if err == nil {
+		servers = append(append([]Server(nil), r.StaticServers...), servers...)
+		if r.ReferenceServer != "" && !hasServer(servers, r.ReferenceServer) {
+			err = fmt.Errorf("%s: reference server %s is not configured anymore", r.Path, r.ReferenceServer)
+		}
+	}
+	if err != nil {
+		configLastReloadSuccessful.Set(0)
+		return err
+	}
+
+	r.mutex.Lock()
+	r.servers = servers
+	r.modules = modules
+	r.mutex.Unlock()
+	configLastReloadSuccessful.Set(1)
+	configLastReloadTimestamp.SetToCurrentTime()
+	return nil
+}
+
+// reloadConfig reloads the config file and removes the metrics of servers
+// that are not configured anymore.
+func (c Collector) reloadConfig() error {
+	if c.Config == nil {
+		return fmt.Errorf("cannot reload: no -config.file given")
+	}
+	before := c.servers()
+	err := c.Config.Reload()
+	if err != nil {
+		return err
+	}
+	after := c.servers()
+	for _, s := range before {
+		if !hasServer(after, s.Address) {
+			c.forgetServer(s.Address)
+		}
+	}
+	slog.Info("reloaded config file", "path", c.Config.Path, "servers", len(after))
+	return nil
+}
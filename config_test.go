@@ -0,0 +1,64 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+* Copyright 2015 The Prometheus Authors
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadConfigErrors(t *testing.T) {
+	testCases := []struct {
+		Content  string
+		Expected string
+	}{
+		{
+			Content:  "servers:\n  - address: ntp1.example.com\n    max_stratum: 16\n",
+			Expected: "max_stratum for ntp1.example.com must be between 0 and 15 (0 = default)",
+		},
+		{
+			Content:  "servers:\n  - address: ntp1.example.com\n  - address: ntp2.example.com\n  - address: ntp1.example.com\n",
+			Expected: "servers[2] has the same address as servers[0]: ntp1.example.com",
+		},
+		{
+			Content:  "servers:\n  - address: ntp2.example.com\n  - address: ntp.static.example.com\n",
+			Expected: "servers[1] is already given with -ntp.server: ntp.static.example.com",
+		},
+	}
+	static := []Server{{Address: "ntp.static.example.com", ProtocolVersion: 4}}
+	for _, tc := range testCases {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		err := os.WriteFile(path, []byte(tc.Content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = loadConfig(path, Server{ProtocolVersion: 4}, static)
+		if err == nil {
+			t.Errorf("expected error %q, got none", tc.Expected)
+			continue
+		}
+		expected := path + ": " + tc.Expected
+		if err.Error() != expected {
+			t.Errorf("expected error %q, got %q", expected, err.Error())
+		}
+	}
+}
@@ -0,0 +1,124 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+* Copyright 2015 The Prometheus Authors
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"log/slog"
+	"math"
+	"sort"
+)
+
+// findConsensus finds the servers whose measurements agree with each other,
+// using the intersection algorithm of NTP (RFC 5905, section 11.2.1): Each
+// usable server contributes the interval of offset plus/minus root distance,
+// which contains the true offset if the server is correct. The largest
+// intersection of the intervals of a majority of servers is determined, and
+// servers whose intervals do not overlap it are falsetickers. The consensus
+// offset is the median offset of the remaining servers (the truechimers). If
+// no majority agrees, ok is false.
+func findConsensus(results map[string]measurement) (offset float64, truechimers map[string]bool, ok bool) {
+	type endpoint struct {
+		Value float64
+		Type  int //-1 for lower end, +1 for upper end
+	}
+	var endpoints []endpoint
+	n := 0
+	for _, result := range results {
+		if !result.Usable {
+			continue
+		}
+		n++
+		endpoints = append(endpoints,
+			endpoint{result.Offset - result.RootDistance, -1},
+			endpoint{result.Offset + result.RootDistance, +1},
+		)
+	}
+	if n == 0 {
+		return 0, nil, false
+	}
+	sort.Slice(endpoints, func(i, j int) bool {
+		if endpoints[i].Value != endpoints[j].Value {
+			return endpoints[i].Value < endpoints[j].Value
+		}
+		//lower ends first, so that touching intervals count as overlapping
+		return endpoints[i].Type < endpoints[j].Type
+	})
+
+	//allow as few falsetickers as possible, but less than half of the servers
+	for falsetickers := 0; 2*falsetickers < n; falsetickers++ {
+		required := n - falsetickers
+		low, high := math.Inf(+1), math.Inf(-1)
+		count := 0
+		for _, e := range endpoints {
+			count -= e.Type
+			if count >= required {
+				low = e.Value
+				break
+			}
+		}
+		count = 0
+		for idx := len(endpoints) - 1; idx >= 0; idx-- {
+			count += endpoints[idx].Type
+			if count >= required {
+				high = endpoints[idx].Value
+				break
+			}
+		}
+		if low > high {
+			continue
+		}
+
+		truechimers = make(map[string]bool)
+		var offsets []float64
+		for address, result := range results {
+			if !result.Usable {
+				continue
+			}
+			agrees := result.Offset-result.RootDistance <= high && result.Offset+result.RootDistance >= low
+			truechimers[address] = agrees
+			if agrees {
+				offsets = append(offsets, result.Offset)
+			}
+		}
+		return calculateMedian(offsets), truechimers, true
+	}
+	return 0, nil, false
+}
+
+// reportConsensus reports the consensus offset across all servers, and which
+// servers agree with it (see findConsensus). A single server always agrees
+// with itself, so nothing is reported unless multiple servers were measured.
+func (c Collector) reportConsensus(results map[string]measurement) {
+	c.consensusOffset.Reset()
+	c.consensusAgrees.Reset()
+	if len(results) < 2 {
+		return
+	}
+	offset, truechimers, ok := findConsensus(results)
+	if !ok {
+		slog.Warn("no majority of NTP servers agrees on the time, cannot compute consensus offset")
+		return
+	}
+	c.consensusOffset.WithLabelValues().Set(offset)
+	for address, agrees := range truechimers {
+		c.consensusAgrees.WithLabelValues(address).Set(boolToFloat(agrees))
+	}
+}
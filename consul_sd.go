@@ -0,0 +1,136 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+* Copyright 2015 The Prometheus Authors
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var consulSDErrors = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "ntp_exporter",
+	Name:      "consul_sd_errors_total",
+	Help:      "Number of failed requests to the Consul catalog (see -consul.service).",
+})
+
+// consulSD discovers NTP servers from the instances of a service in the
+// Consul catalog. The catalog is queried during each measurement, so the set
+// of measured servers follows the registrations in Consul.
+type consulSD struct {
+	Address  string //"host:port" or URL of the Consul agent
+	Service  string
+	Tag      string //if not empty, only instances with this tag are used
+	Token    string //ACL token (optional)
+	Timeout  time.Duration
+	Defaults Server //settings for all discovered servers
+
+	mutex   sync.Mutex
+	servers []Server
+}
+
+// consulCatalogService is an entry in the response of
+// GET /v1/catalog/service/:service.
+type consulCatalogService struct {
+	Node           string `json:"Node"`
+	Address        string `json:"Address"`
+	ServiceAddress string `json:"ServiceAddress"`
+	ServicePort    int    `json:"ServicePort"`
+}
+
+// Servers returns the servers registered in Consul. If the catalog cannot be
+// queried, the servers from the last successful query are returned instead.
+func (d *consulSD) Servers() []Server {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	servers, err := d.query()
+	if err != nil {
+		slog.Error("couldn't get service instances from Consul", "service", d.Service, "err", err)
+		consulSDErrors.Inc()
+		return d.servers
+	}
+	d.servers = servers
+	return servers
+}
+
+func (d *consulSD) query() ([]Server, error) {
+	base := d.Address
+	if !strings.Contains(base, "://") {
+		base = "http://" + base
+	}
+	query := url.Values{}
+	if d.Tag != "" {
+		query.Set("tag", d.Tag)
+	}
+	u := strings.TrimSuffix(base, "/") + "/v1/catalog/service/" + url.PathEscape(d.Service)
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if d.Token != "" {
+		req.Header.Set("X-Consul-Token", d.Token)
+	}
+	client := http.Client{Timeout: d.Timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s returned %s", u, resp.Status)
+	}
+	var entries []consulCatalogService
+	err = json.NewDecoder(resp.Body).Decode(&entries)
+	if err != nil {
+		return nil, err
+	}
+
+	var servers []Server
+	for _, e := range entries {
+		//like Prometheus, prefer the service address over the node address
+		address := e.ServiceAddress
+		if address == "" {
+			address = e.Address
+		}
+		if address == "" {
+			slog.Warn("ignoring service instance without address", "service", d.Service, "node", e.Node)
+			continue
+		}
+		address = joinServerAddress(address, e.ServicePort)
+		if hasServer(servers, address) {
+			continue
+		}
+		s := d.Defaults
+		s.Address = address
+		servers = append(servers, s)
+	}
+	return servers, nil
+}
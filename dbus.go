@@ -0,0 +1,499 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+* Copyright 2015 The Prometheus Authors
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//This implements the small subset of the D-Bus wire protocol that is needed to
+//read the properties of system services, to avoid pulling in a full D-Bus
+//library for that.
+
+const defaultSystemBusAddress = "unix:path=/var/run/dbus/system_bus_socket"
+
+const (
+	dbusMethodCall   = 1
+	dbusMethodReturn = 2
+	dbusError        = 3
+
+	dbusFieldPath        = 1
+	dbusFieldInterface   = 2
+	dbusFieldMember      = 3
+	dbusFieldErrorName   = 4
+	dbusFieldReplySerial = 5
+	dbusFieldDestination = 6
+	dbusFieldSignature   = 8
+)
+
+// dbusConn is a connection to the D-Bus system bus.
+type dbusConn struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	timeout time.Duration
+	serial  uint32
+}
+
+// dialSystemBus connects and authenticates to the system bus.
+func dialSystemBus(timeout time.Duration) (*dbusConn, error) {
+	address := os.Getenv("DBUS_SYSTEM_BUS_ADDRESS")
+	if address == "" {
+		address = defaultSystemBusAddress
+	}
+	path, err := parseDBusAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialTimeout("unix", path, timeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &dbusConn{conn: conn, reader: bufio.NewReader(conn), timeout: timeout}
+	err = c.authenticate()
+	if err == nil {
+		_, err = c.call("org.freedesktop.DBus", "/org/freedesktop/DBus", "org.freedesktop.DBus", "Hello", "")
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// parseDBusAddress returns the socket path of the first usable entry in a
+// D-Bus server address like "unix:path=/run/dbus/system_bus_socket".
+func parseDBusAddress(address string) (string, error) {
+	for _, entry := range strings.Split(address, ";") {
+		if !strings.HasPrefix(entry, "unix:") {
+			continue
+		}
+		for _, kv := range strings.Split(strings.TrimPrefix(entry, "unix:"), ",") {
+			switch {
+			case strings.HasPrefix(kv, "path="):
+				return strings.TrimPrefix(kv, "path="), nil
+			case strings.HasPrefix(kv, "abstract="):
+				return "@" + strings.TrimPrefix(kv, "abstract="), nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no supported transport in D-Bus address %q", address)
+}
+
+func (c *dbusConn) authenticate() error {
+	err := c.conn.SetDeadline(time.Now().Add(c.timeout))
+	if err != nil {
+		return err
+	}
+	uid := hex.EncodeToString([]byte(strconv.Itoa(os.Getuid())))
+	_, err = c.conn.Write([]byte("\x00AUTH EXTERNAL " + uid + "\r\n"))
+	if err != nil {
+		return err
+	}
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "OK ") {
+		return fmt.Errorf("D-Bus authentication failed: %s", strings.TrimSpace(line))
+	}
+	_, err = c.conn.Write([]byte("BEGIN\r\n"))
+	return err
+}
+
+// Close closes the connection.
+func (c *dbusConn) Close() error {
+	return c.conn.Close()
+}
+
+// GetAllProperties returns the properties of the given interface of the
+// given object.
+func (c *dbusConn) GetAllProperties(destination, path, iface string) (map[string]interface{}, error) {
+	body, err := c.call(destination, path, "org.freedesktop.DBus.Properties", "GetAll", "s", iface)
+	if err != nil {
+		return nil, err
+	}
+	dict, ok := body[0].(map[interface{}]interface{})
+	if len(body) != 1 || !ok {
+		return nil, errors.New("unexpected reply to GetAll")
+	}
+	result := make(map[string]interface{}, len(dict))
+	for key, value := range dict {
+		if name, ok := key.(string); ok {
+			result[name] = value
+		}
+	}
+	return result, nil
+}
+
+// call calls a method and returns the body of its reply. Only string
+// arguments are supported.
+func (c *dbusConn) call(destination, path, iface, member, signature string, args ...string) ([]interface{}, error) {
+	err := c.conn.SetDeadline(time.Now().Add(c.timeout))
+	if err != nil {
+		return nil, err
+	}
+
+	var body dbusEncoder
+	for _, arg := range args {
+		body.putString(arg)
+	}
+
+	c.serial++
+	var msg dbusEncoder
+	msg.buf = append(msg.buf, 'l', dbusMethodCall, 0, 1)
+	msg.putUint32(uint32(len(body.buf)))
+	msg.putUint32(c.serial)
+	msg.putHeaderFields([]dbusHeaderField{
+		{dbusFieldPath, "o", path},
+		{dbusFieldInterface, "s", iface},
+		{dbusFieldMember, "s", member},
+		{dbusFieldDestination, "s", destination},
+		{dbusFieldSignature, "g", signature},
+	})
+	msg.align(8)
+	msg.buf = append(msg.buf, body.buf...)
+	_, err = c.conn.Write(msg.buf)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		msgType, fields, body, err := c.readMessage()
+		if err != nil {
+			return nil, err
+		}
+		if serial, ok := fields[dbusFieldReplySerial].(uint32); !ok || serial != c.serial {
+			continue //signal or reply to something else
+		}
+		switch msgType {
+		case dbusMethodReturn:
+			return body, nil
+		case dbusError:
+			name, _ := fields[dbusFieldErrorName].(string)
+			if len(body) > 0 {
+				if text, ok := body[0].(string); ok {
+					return nil, fmt.Errorf("%s: %s", name, text)
+				}
+			}
+			return nil, errors.New(name)
+		}
+	}
+}
+
+// readMessage reads the next message from the bus.
+func (c *dbusConn) readMessage() (msgType byte, fields map[byte]interface{}, body []interface{}, err error) {
+	//the fixed part of the header is followed by the length of the header field
+	//array, which tells us the full header length
+	msg := make([]byte, 16)
+	_, err = io.ReadFull(c.reader, msg)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	d := dbusDecoder{buf: msg, order: binary.LittleEndian}
+	if msg[0] == 'B' {
+		d.order = binary.BigEndian
+	}
+	bodyLength := int(d.order.Uint32(msg[4:]))
+	headerLength := 16 + int(d.order.Uint32(msg[12:]))
+	if headerLength%8 != 0 {
+		headerLength += 8 - headerLength%8
+	}
+	if headerLength+bodyLength > 1<<27 {
+		return 0, nil, nil, errors.New("D-Bus message too large")
+	}
+	d.buf = make([]byte, headerLength+bodyLength)
+	copy(d.buf, msg)
+	_, err = io.ReadFull(c.reader, d.buf[16:])
+	if err != nil {
+		return 0, nil, nil, err
+	}
+
+	d.pos = 12
+	value, _ := d.decode("a(yv)")
+	fields = make(map[byte]interface{})
+	if array, ok := value.([]interface{}); ok {
+		for _, item := range array {
+			if field, ok := item.([]interface{}); ok && len(field) == 2 {
+				if code, ok := field[0].(byte); ok {
+					fields[code] = field[1]
+				}
+			}
+		}
+	}
+	d.pos = headerLength
+	signature, _ := fields[dbusFieldSignature].(string)
+	for signature != "" && d.err == nil {
+		var value interface{}
+		value, signature = d.decode(signature)
+		body = append(body, value)
+	}
+	return msg[1], fields, body, d.err
+}
+
+type dbusHeaderField struct {
+	Code      byte
+	Signature string
+	Value     string
+}
+
+// dbusEncoder marshals the few types that we need to send.
+type dbusEncoder struct {
+	buf []byte
+}
+
+func (e *dbusEncoder) align(n int) {
+	for len(e.buf)%n != 0 {
+		e.buf = append(e.buf, 0)
+	}
+}
+
+func (e *dbusEncoder) putUint32(value uint32) {
+	e.align(4)
+	e.buf = append(e.buf, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(e.buf[len(e.buf)-4:], value)
+}
+
+func (e *dbusEncoder) putString(value string) {
+	e.putUint32(uint32(len(value)))
+	e.buf = append(e.buf, value...)
+	e.buf = append(e.buf, 0)
+}
+
+func (e *dbusEncoder) putSignature(value string) {
+	e.buf = append(e.buf, byte(len(value)))
+	e.buf = append(e.buf, value...)
+	e.buf = append(e.buf, 0)
+}
+
+func (e *dbusEncoder) putHeaderFields(fields []dbusHeaderField) {
+	e.putUint32(0) //placeholder for array length
+	lengthPos := len(e.buf) - 4
+	e.align(8)
+	start := len(e.buf)
+	for _, field := range fields {
+		if field.Value == "" && field.Signature == "g" {
+			continue //no body
+		}
+		e.align(8)
+		e.buf = append(e.buf, field.Code)
+		e.putSignature(field.Signature)
+		if field.Signature == "g" {
+			e.putSignature(field.Value)
+		} else {
+			e.putString(field.Value)
+		}
+	}
+	binary.LittleEndian.PutUint32(e.buf[lengthPos:], uint32(len(e.buf)-start))
+}
+
+// dbusDecoder unmarshals any D-Bus value into basic Go types: Arrays of bytes
+// become []byte, dictionaries become map[interface{}]interface{}, other arrays
+// and structs become []interface{}. Variants are replaced by their content.
+// After an error, all further reads return zero values.
+type dbusDecoder struct {
+	buf   []byte
+	pos   int
+	order binary.ByteOrder
+	err   error
+}
+
+func (d *dbusDecoder) align(n int) {
+	if d.pos%n != 0 {
+		d.pos += n - d.pos%n
+	}
+}
+
+func (d *dbusDecoder) read(n int) []byte {
+	if d.err != nil {
+		return make([]byte, n)
+	}
+	if n < 0 || d.pos+n > len(d.buf) {
+		d.err = errors.New("truncated D-Bus message")
+		return make([]byte, n)
+	}
+	d.pos += n
+	return d.buf[d.pos-n : d.pos]
+}
+
+func (d *dbusDecoder) readString(lengthBytes int) string {
+	var length int
+	if lengthBytes == 1 {
+		length = int(d.read(1)[0])
+	} else {
+		d.align(4)
+		length = int(d.order.Uint32(d.read(4)))
+	}
+	value := string(d.read(length))
+	d.read(1) //NUL terminator
+	return value
+}
+
+// decode reads a value of the first complete type in the signature, and
+// returns it together with the rest of the signature.
+func (d *dbusDecoder) decode(signature string) (interface{}, string) {
+	if d.err != nil || signature == "" {
+		if d.err == nil {
+			d.err = errors.New("invalid D-Bus signature")
+		}
+		return nil, ""
+	}
+	switch signature[0] {
+	case 'y':
+		return d.read(1)[0], signature[1:]
+	case 'b':
+		d.align(4)
+		return d.order.Uint32(d.read(4)) != 0, signature[1:]
+	case 'n':
+		d.align(2)
+		return int16(d.order.Uint16(d.read(2))), signature[1:]
+	case 'q':
+		d.align(2)
+		return d.order.Uint16(d.read(2)), signature[1:]
+	case 'i':
+		d.align(4)
+		return int32(d.order.Uint32(d.read(4))), signature[1:]
+	case 'u', 'h':
+		d.align(4)
+		return d.order.Uint32(d.read(4)), signature[1:]
+	case 'x':
+		d.align(8)
+		return int64(d.order.Uint64(d.read(8))), signature[1:]
+	case 't':
+		d.align(8)
+		return d.order.Uint64(d.read(8)), signature[1:]
+	case 'd':
+		d.align(8)
+		return math.Float64frombits(d.order.Uint64(d.read(8))), signature[1:]
+	case 's', 'o':
+		return d.readString(4), signature[1:]
+	case 'g':
+		return d.readString(1), signature[1:]
+	case 'v':
+		inner := d.readString(1)
+		value, rest := d.decode(inner)
+		if rest != "" && d.err == nil {
+			d.err = errors.New("invalid D-Bus variant signature")
+		}
+		return value, signature[1:]
+	case '(', '{':
+		closing := byte(')')
+		if signature[0] == '{' {
+			closing = '}'
+		}
+		d.align(8)
+		var fields []interface{}
+		rest := signature[1:]
+		for d.err == nil && rest != "" && rest[0] != closing {
+			var value interface{}
+			value, rest = d.decode(rest)
+			fields = append(fields, value)
+		}
+		if rest == "" {
+			d.err = errors.New("invalid D-Bus signature")
+			return nil, ""
+		}
+		return fields, rest[1:]
+	case 'a':
+		d.align(4)
+		length := int(d.order.Uint32(d.read(4)))
+		elemSignature := signature[1:]
+		if elemSignature == "" {
+			d.err = errors.New("invalid D-Bus signature")
+			return nil, ""
+		}
+		d.align(dbusAlignment(elemSignature[0]))
+		end := d.pos + length
+		if end > len(d.buf) {
+			d.err = errors.New("truncated D-Bus message")
+		}
+
+		var rest string
+		switch elemSignature[0] {
+		case 'y':
+			return d.read(length), elemSignature[1:]
+		case '{':
+			dict := make(map[interface{}]interface{})
+			rest = d.skipType(elemSignature)
+			for d.err == nil && d.pos < end {
+				value, _ := d.decode(elemSignature)
+				if entry, ok := value.([]interface{}); ok && len(entry) == 2 {
+					dict[entry[0]] = entry[1]
+				}
+			}
+			return dict, rest
+		default:
+			var array []interface{}
+			rest = d.skipType(elemSignature)
+			for d.err == nil && d.pos < end {
+				value, _ := d.decode(elemSignature)
+				array = append(array, value)
+			}
+			return array, rest
+		}
+	default:
+		d.err = fmt.Errorf("unsupported D-Bus type %q", signature[0])
+		return nil, ""
+	}
+}
+
+// skipType returns the signature after its first complete type.
+func (d *dbusDecoder) skipType(signature string) string {
+	depth := 0
+	for idx := 0; idx < len(signature); idx++ {
+		switch signature[idx] {
+		case 'a':
+			continue
+		case '(', '{':
+			depth++
+		case ')', '}':
+			depth--
+		}
+		if depth == 0 {
+			return signature[idx+1:]
+		}
+	}
+	d.err = errors.New("invalid D-Bus signature")
+	return ""
+}
+
+func dbusAlignment(typeCode byte) int {
+	switch typeCode {
+	case 'y', 'g', 'v':
+		return 1
+	case 'n', 'q':
+		return 2
+	case 'x', 't', 'd', '(', '{':
+		return 8
+	default:
+		return 4
+	}
+}
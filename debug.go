@@ -0,0 +1,181 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+* Copyright 2015 The Prometheus Authors
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// debugHandler serves the /debug/ntp endpoint, which queries the server given
+// in the "target" query parameter and returns all details of the responses as
+// JSON, to find out why a certain offset was reported. It accepts the same
+// query parameters as /probe. With "samples", the server is queried multiple
+// times (waiting for the measurement interval in between), and the offsets are
+// aggregated like in case of high drift.
+type debugHandler struct {
+	Collector     Collector
+	Server        Server //see probeHandler
+	Buckets       HistogramBuckets
+	TimeoutOffset time.Duration
+}
+
+const (
+	//maxDebugSamples limits how often /debug/ntp queries the target in a
+	//single request, so that the endpoint cannot be used to flood a server
+	maxDebugSamples = 20
+	//defaultDebugTimeout limits the duration of a /debug/ntp request if the
+	//caller did not send a scrape timeout (same as Prometheus' default)
+	defaultDebugTimeout = 10 * time.Second
+)
+
+// debugResult is the output of /debug/ntp.
+type debugResult struct {
+	Target        string       `json:"target"`
+	Queries       []debugQuery `json:"queries"`
+	Aggregation   string       `json:"aggregation,omitempty"`
+	OffsetSeconds *float64     `json:"offset_seconds,omitempty"`
+}
+
+// debugQuery describes a single query within debugResult.
+type debugQuery struct {
+	Error                 string  `json:"error,omitempty"`
+	KissCode              string  `json:"kiss_code,omitempty"`
+	Address               string  `json:"address,omitempty"`
+	ProtocolVersion       int     `json:"protocol_version,omitempty"`
+	Interleaved           bool    `json:"interleaved"`
+	ClientTransmitTime    string  `json:"client_transmit_time,omitempty"` //t1
+	ServerReceiveTime     string  `json:"server_receive_time,omitempty"`  //t2
+	ServerTransmitTime    string  `json:"server_transmit_time,omitempty"` //t3
+	ClientReceiveTime     string  `json:"client_receive_time,omitempty"`  //t4
+	OffsetSeconds         float64 `json:"offset_seconds"`
+	RTTSeconds            float64 `json:"rtt_seconds"`
+	MinErrorSeconds       float64 `json:"min_error_seconds"`
+	Stratum               uint8   `json:"stratum"`
+	Leap                  uint8   `json:"leap"`
+	ReferenceID           string  `json:"reference_id,omitempty"`
+	ReferenceTime         string  `json:"reference_time,omitempty"`
+	RootDelaySeconds      float64 `json:"root_delay_seconds"`
+	RootDispersionSeconds float64 `json:"root_dispersion_seconds"`
+	RootDistanceSeconds   float64 `json:"root_distance_seconds"`
+	PrecisionSeconds      float64 `json:"precision_seconds"`
+	PollSeconds           float64 `json:"poll_seconds"`
+}
+
+// ServeHTTP implements the http.Handler interface.
+func (h debugHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s, err := probeTarget(r.URL.Query(), h.Server, h.Collector.Config)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	//do not interfere with the kiss-of-death backoff of the metrics path
+	c := h.Collector
+	c.KissOfDeath = nil
+	c.Deadline = scrapeDeadline(r, h.TimeoutOffset)
+	if c.Deadline.IsZero() {
+		c.Deadline = time.Now().Add(defaultDebugTimeout)
+	}
+	c.metrics = newMetrics(h.Buckets)
+
+	//stop querying when the client goes away (or on shutdown)
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	if c.Context != nil {
+		stop := context.AfterFunc(c.Context, cancel)
+		defer stop()
+	}
+	c.Context = ctx
+
+	samples := s.MeasurementSamples
+	if samples < 1 {
+		samples = 1
+	}
+	if samples > maxDebugSamples {
+		samples = maxDebugSamples
+	}
+	result := debugResult{Target: s.Address, Queries: make([]debugQuery, 0, samples)}
+	var offsets, rtts []float64
+	for n := 0; n < samples && ctx.Err() == nil; n++ {
+		if n > 0 && s.MeasurementInterval > 0 {
+			if !c.hasTimeLeft(s.MeasurementInterval) || !c.sleep(s.MeasurementInterval) {
+				break
+			}
+		}
+		var qr queryResult
+		resp, err := c.queryWithResult(s, "", &qr)
+		q := debugQuery{
+			KissCode:        qr.KissCode,
+			Address:         qr.Address,
+			ProtocolVersion: qr.Version,
+			Interleaved:     qr.Interleaved,
+		}
+		if err != nil {
+			q.Error = err.Error()
+			result.Queries = append(result.Queries, q)
+			continue
+		}
+		q.ClientTransmitTime = formatDebugTime(qr.Timestamps[0])
+		q.ServerReceiveTime = formatDebugTime(qr.Timestamps[1])
+		q.ServerTransmitTime = formatDebugTime(qr.Timestamps[2])
+		q.ClientReceiveTime = formatDebugTime(qr.Timestamps[3])
+		q.OffsetSeconds = resp.ClockOffset.Seconds()
+		q.RTTSeconds = resp.RTT.Seconds()
+		q.MinErrorSeconds = resp.MinError.Seconds()
+		q.Stratum = resp.Stratum
+		q.Leap = uint8(resp.Leap)
+		q.ReferenceID = formatReferenceID(resp.Stratum, resp.ReferenceID)
+		q.ReferenceTime = formatDebugTime(resp.ReferenceTime)
+		q.RootDelaySeconds = resp.RootDelay.Seconds()
+		q.RootDispersionSeconds = resp.RootDispersion.Seconds()
+		q.RootDistanceSeconds = resp.RootDistance.Seconds()
+		q.PrecisionSeconds = resp.Precision.Seconds()
+		q.PollSeconds = resp.Poll.Seconds()
+		result.Queries = append(result.Queries, q)
+		offsets = append(offsets, q.OffsetSeconds)
+		rtts = append(rtts, q.RTTSeconds)
+	}
+	if len(offsets) > 1 {
+		offset := aggregationStrategies[s.Aggregation](offsets, rtts)
+		result.Aggregation = s.Aggregation
+		result.OffsetSeconds = &offset
+	} else if len(offsets) == 1 {
+		result.OffsetSeconds = &offsets[0]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	err = enc.Encode(result)
+	if err != nil {
+		slog.Error("cannot write /debug/ntp response", "err", err)
+	}
+}
+
+func formatDebugTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
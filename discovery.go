@@ -0,0 +1,167 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+* Copyright 2015 The Prometheus Authors
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// discoverer is a source of servers to measure besides -ntp.server and
+// -config.file, e.g. a fileSD.
+type discoverer interface {
+	Servers() []Server
+}
+
+// resolveServers replaces each server that is an NTP pool (e.g. pool.ntp.org)
+// by one server for each address that the pool hostname resolves to, and each
+// server that is an SRV domain by one server for each target of its _ntp._udp
+// SRV records. It returns the resulting list of servers, and the servers found
+// for each pool and SRV domain.
+func resolveServers(servers []Server) (result []Server, pools, srvDomains map[string][]string) {
+	result = make([]Server, 0, len(servers))
+	pools = make(map[string][]string)
+	srvDomains = make(map[string][]string)
+	for _, s := range servers {
+		if !s.Pool && !s.SRV {
+			result = append(result, s)
+		}
+	}
+	for _, s := range servers {
+		var (
+			addresses []string
+			err       error
+		)
+		switch {
+		case s.Pool:
+			addresses, err = lookupPool(s.Address, s.AddressFamily)
+			pools[s.Address] = addresses
+		case s.SRV:
+			addresses, err = lookupSRV(s.Address)
+			srvDomains[s.Address] = addresses
+		default:
+			continue
+		}
+		if err != nil {
+			slog.Error("couldn't resolve server", "server", s.Address, "err", err)
+		}
+		for _, address := range addresses {
+			m := s
+			m.Address = address
+			m.Pool = false
+			m.SRV = false
+			if s.Pool && m.NTS && m.NTSKEServer == "" {
+				//the certificate of the NTS-KE server is issued for the pool name
+				m.NTSKEServer, _ = splitServerAddress(s.Address)
+			}
+			//an address may also be configured separately, or be found in
+			//multiple places, but is only measured once
+			if !hasServer(result, m.Address) {
+				result = append(result, m)
+			}
+		}
+	}
+	return result, pools, srvDomains
+}
+
+// lookupPool returns the addresses of the given pool. With the address family
+// "ipv4" or "ipv6", only addresses of that family are returned.
+func lookupPool(address, family string) ([]string, error) {
+	hostname, port := splitServerAddress(address)
+	ips, err := net.LookupIP(hostname)
+	if err != nil {
+		return nil, err
+	}
+	portNumber, _ := strconv.Atoi(port)
+	addresses := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		isIPv4 := ip.To4() != nil
+		if (family == "ipv4" && !isIPv4) || (family == "ipv6" && isIPv4) {
+			continue
+		}
+		addresses = append(addresses, joinServerAddress(ip.String(), portNumber))
+	}
+	return addresses, nil
+}
+
+// lookupSRV returns the targets of the _ntp._udp SRV records of the given
+// domain, ordered by priority and weight, as "host:port" (or just "host" if
+// the port is 123).
+func lookupSRV(domain string) ([]string, error) {
+	_, records, err := net.LookupSRV("ntp", "udp", domain)
+	if err != nil {
+		return nil, err
+	}
+	var targets []string
+	for _, r := range records {
+		target := joinServerAddress(strings.TrimSuffix(r.Target, "."), int(r.Port))
+		if !containsString(targets, target) {
+			targets = append(targets, target)
+		}
+	}
+	return targets, nil
+}
+
+// expandServers is like resolveServers, but also updates the discovery
+// metrics and removes the metrics of servers that were not found anymore.
+func (c Collector) expandServers(servers []Server) []Server {
+	result, pools, srvDomains := resolveServers(servers)
+
+	c.discovered.Lock()
+	defer c.discovered.Unlock()
+	c.updateDiscovered(result, c.discovered.ByPool, pools, c.poolMemberCount, c.poolMemberInfo)
+	c.updateDiscovered(result, c.discovered.BySRV, srvDomains, c.srvTargetCount, c.srvTargetInfo)
+	c.discovered.ByPool = pools
+	c.discovered.BySRV = srvDomains
+	return result
+}
+
+func (c Collector) updateDiscovered(servers []Server, before, after map[string][]string, count *prometheus.GaugeVec, info *infoVec) {
+	for source, addresses := range before {
+		for _, address := range addresses {
+			if !containsString(after[source], address) && !hasServer(servers, address) {
+				c.forgetServer(address)
+			}
+		}
+		if _, exists := after[source]; !exists {
+			count.DeleteLabelValues(source)
+		}
+	}
+	for source, addresses := range after {
+		count.WithLabelValues(source).Set(float64(len(addresses)))
+		for _, address := range addresses {
+			info.Set(address, source)
+		}
+	}
+}
+
+func containsString(list []string, value string) bool {
+	for _, s := range list {
+		if s == value {
+			return true
+		}
+	}
+	return false
+}
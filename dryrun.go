@@ -0,0 +1,103 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+* Copyright 2015 The Prometheus Authors
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/beevik/ntp"
+)
+
+// dryRunResult is the output of -dry-run. The JSON field names are part of
+// the command-line interface and must not be changed.
+type dryRunResult struct {
+	Server                string  `json:"server"`
+	OffsetSeconds         float64 `json:"offset_seconds"`
+	Stratum               uint8   `json:"stratum"`
+	RTTSeconds            float64 `json:"rtt_seconds"`
+	RootDelaySeconds      float64 `json:"root_delay_seconds"`
+	RootDispersionSeconds float64 `json:"root_dispersion_seconds"`
+	Leap                  uint8   `json:"leap"`
+	ReferenceID           string  `json:"reference_id"`
+	Error                 string  `json:"error"`
+}
+
+func newDryRunResult(server string, resp *ntp.Response, err error) dryRunResult {
+	result := dryRunResult{Server: server}
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.OffsetSeconds = resp.ClockOffset.Seconds()
+	result.Stratum = resp.Stratum
+	result.RTTSeconds = resp.RTT.Seconds()
+	result.RootDelaySeconds = resp.RootDelay.Seconds()
+	result.RootDispersionSeconds = resp.RootDispersion.Seconds()
+	result.Leap = uint8(resp.Leap)
+	result.ReferenceID = formatReferenceID(resp.Stratum, resp.ReferenceID)
+	return result
+}
+
+// dryRun takes a single measurement of each server and prints it in the given
+// output format ("text" or "json"). It returns false if any measurement failed.
+func dryRun(c Collector, format string, w io.Writer) (bool, error) {
+	allSuccessful := true
+	servers, _, _ := resolveServers(c.servers())
+	for _, s := range servers {
+		resp, err := c.query(s)
+		result := newDryRunResult(s.Address, resp, err)
+		ok, err := printDryRunResult(result, format, w)
+		if err != nil {
+			return false, err
+		}
+		allSuccessful = allSuccessful && ok
+	}
+	return allSuccessful, nil
+}
+
+func printDryRunResult(result dryRunResult, format string, w io.Writer) (bool, error) {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(result); err != nil {
+			return false, err
+		}
+	case "text":
+		if result.Error != "" {
+			_, err := fmt.Fprintf(w, "server: %s\nerror: %s\n", result.Server, result.Error)
+			return false, err
+		}
+		_, err := fmt.Fprintf(w, "server: %s\noffset: %gs\nstratum: %d\nrtt: %gs\nroot delay: %gs\nroot dispersion: %gs\nleap: %d\nreference ID: %s\n",
+			result.Server, result.OffsetSeconds, result.Stratum, result.RTTSeconds,
+			result.RootDelaySeconds, result.RootDispersionSeconds, result.Leap, result.ReferenceID,
+		)
+		if err != nil {
+			return false, err
+		}
+	default:
+		return false, fmt.Errorf("invalid output format %q; must be \"text\" or \"json\"", format)
+	}
+
+	return result.Error == "", nil
+}
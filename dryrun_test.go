@@ -0,0 +1,79 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+* Copyright 2015 The Prometheus Authors
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/beevik/ntp"
+)
+
+// The JSON output of -dry-run is part of the command-line interface, so these
+// tests fail when a field is renamed or removed.
+func TestDryRunJSONOutput(t *testing.T) {
+	resp := &ntp.Response{
+		ClockOffset:    1500 * time.Microsecond,
+		Stratum:        2,
+		RTT:            20 * time.Millisecond,
+		RootDelay:      4 * time.Millisecond,
+		RootDispersion: 8 * time.Millisecond,
+		Leap:           ntp.LeapAddSecond,
+		ReferenceID:    0xC0A80001,
+	}
+	expectDryRunJSON(t, newDryRunResult("ntp.example.com", resp, nil), `{
+  "server": "ntp.example.com",
+  "offset_seconds": 0.0015,
+  "stratum": 2,
+  "rtt_seconds": 0.02,
+  "root_delay_seconds": 0.004,
+  "root_dispersion_seconds": 0.008,
+  "leap": 1,
+  "reference_id": "192.168.0.1",
+  "error": ""
+}`)
+
+	expectDryRunJSON(t, newDryRunResult("ntp.example.com", nil, errors.New("i/o timeout")), `{
+  "server": "ntp.example.com",
+  "offset_seconds": 0,
+  "stratum": 0,
+  "rtt_seconds": 0,
+  "root_delay_seconds": 0,
+  "root_dispersion_seconds": 0,
+  "leap": 0,
+  "reference_id": "",
+  "error": "i/o timeout"
+}`)
+}
+
+func expectDryRunJSON(t *testing.T, result dryRunResult, expected string) {
+	t.Helper()
+	//this is how -dry-run encodes the result
+	buf, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != expected {
+		t.Errorf("expected JSON output:\n%s\ngot:\n%s", expected, string(buf))
+	}
+}
@@ -0,0 +1,47 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+* Copyright 2015 The Prometheus Authors
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// setDSCP sets the DSCP value in the IP header (the upper six bits of the
+// TOS/traffic class byte) of packets sent on the given socket.
+func setDSCP(conn *net.UDPConn, dscp int) error {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	level, option := syscall.IPPROTO_IP, syscall.IP_TOS
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+		level, option = syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS
+	}
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), level, option, dscp<<2)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
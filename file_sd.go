@@ -0,0 +1,248 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+* Copyright 2015 The Prometheus Authors
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/prometheus/client_golang/prometheus"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// fileSD discovers NTP servers from files in the format of the file_sd_configs
+// of Prometheus, i.e. a list of groups with targets and labels. Since JSON is
+// a subset of YAML, both JSON and YAML files are supported. The directories
+// containing the files are watched for changes, and changed files are read
+// again during the next measurement, so that changes are picked up without a
+// restart. If the directories cannot be watched, the modification time of the
+// files is checked during each measurement instead.
+type fileSD struct {
+	Patterns   []string               //paths or glob patterns
+	Defaults   Server                 //settings for all discovered servers
+	ReadErrors *prometheus.CounterVec //from metrics.fileSDReadErrors, may be nil
+
+	mutex    sync.Mutex
+	files    map[string]fileSDFile
+	watching bool //true once watch() was called
+	watcher  *fsnotify.Watcher
+}
+
+type fileSDFile struct {
+	ModTime time.Time
+	Servers []Server
+	//true if the file was changed since it was read (see watch)
+	Changed bool
+}
+
+// fileSDGroup is one entry in a file_sd file.
+type fileSDGroup struct {
+	Targets []string          `yaml:"targets"`
+	Labels  map[string]string `yaml:"labels"`
+}
+
+// Servers returns the servers from all files. If a file cannot be read or
+// parsed, the servers from its last valid version are returned instead.
+func (d *fileSD) Servers() []Server {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if !d.watching {
+		d.watching = true
+		d.watch()
+	}
+
+	var paths []string
+	for _, pattern := range d.Patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			slog.Error("invalid -ntp.file-sd pattern", "pattern", pattern, "err", err)
+			continue
+		}
+		paths = append(paths, matches...)
+	}
+	sort.Strings(paths)
+
+	files := make(map[string]fileSDFile, len(paths))
+	var servers []Server
+	for _, path := range paths {
+		if _, exists := files[path]; exists {
+			continue //matched by multiple patterns
+		}
+		file, err := d.read(path)
+		if err != nil {
+			slog.Error("couldn't read NTP servers", "path", path, "err", err)
+			if d.ReadErrors != nil {
+				d.ReadErrors.WithLabelValues(path).Inc()
+			}
+			file = d.files[path]
+		} else if d.ReadErrors != nil {
+			//report 0 until the first error
+			d.ReadErrors.WithLabelValues(path)
+		}
+		files[path] = file
+		for _, s := range file.Servers {
+			if !hasServer(servers, s.Address) {
+				servers = append(servers, s)
+			}
+		}
+	}
+	if d.ReadErrors != nil {
+		for path := range d.files {
+			if _, exists := files[path]; !exists {
+				d.ReadErrors.DeleteLabelValues(path)
+			}
+		}
+	}
+	d.files = files
+	return servers
+}
+
+// watch starts watching the directories that contain the files, so that read
+// knows which files were changed. It must be called with d.mutex locked.
+func (d *fileSD) watch() {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		slog.Warn("cannot watch -ntp.file-sd files, checking their modification time instead", "err", err)
+		return
+	}
+	dirs := make(map[string]bool)
+	for _, pattern := range d.Patterns {
+		matches, err := filepath.Glob(filepath.Dir(pattern))
+		if err != nil {
+			continue //reported by Servers
+		}
+		for _, dir := range matches {
+			if dirs[dir] {
+				continue
+			}
+			dirs[dir] = true
+			err := watcher.Add(dir)
+			if err != nil {
+				slog.Warn("cannot watch -ntp.file-sd files, checking their modification time instead", "dir", dir, "err", err)
+				watcher.Close()
+				return
+			}
+		}
+	}
+	d.watcher = watcher
+
+	go func() {
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				d.markChanged(event.Name)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				slog.Error("error while watching -ntp.file-sd files", "err", err)
+				//some events may have been lost, so read all files again
+				d.markChanged("")
+			}
+		}
+	}()
+}
+
+// markChanged makes read parse the file at the given path again (or all files
+// if the path is empty).
+func (d *fileSD) markChanged(path string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for p, file := range d.files {
+		if path == "" || filepath.Clean(p) == filepath.Clean(path) {
+			file.Changed = true
+			d.files[p] = file
+		}
+	}
+}
+
+// read returns the servers in the given file. The file is only parsed again if
+// it was changed since the last call.
+func (d *fileSD) read(path string) (fileSDFile, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return fileSDFile{}, err
+	}
+	if file, exists := d.files[path]; exists && !file.Changed {
+		//without a watcher, the modification time is the only indicator
+		if d.watcher != nil || file.ModTime.Equal(fi.ModTime()) {
+			return file, nil
+		}
+	}
+
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fileSDFile{}, err
+	}
+	var groups []fileSDGroup
+	err = yaml.UnmarshalStrict(buf, &groups)
+	if err != nil {
+		return fileSDFile{}, err
+	}
+	file := fileSDFile{ModTime: fi.ModTime()}
+	for idx, group := range groups {
+		err := validateLabels(group.Labels)
+		if err != nil {
+			return fileSDFile{}, fmt.Errorf("group %d: %s", idx, err)
+		}
+		for _, target := range group.Targets {
+			if target == "" {
+				return fileSDFile{}, fmt.Errorf("group %d: empty target", idx)
+			}
+			s := d.Defaults
+			s.Address = target
+			s.Labels = group.Labels
+			file.Servers = append(file.Servers, s)
+		}
+	}
+	slog.Info("read NTP servers", "path", path, "servers", len(file.Servers))
+	return file, nil
+}
+
+var labelNameRx = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// validateLabels checks that the given labels can be added to the metrics of
+// a server.
+func validateLabels(labels map[string]string) error {
+	for name := range labels {
+		switch {
+		case !labelNameRx.MatchString(name):
+			return fmt.Errorf("invalid label name %q", name)
+		case strings.HasPrefix(name, "__"):
+			return fmt.Errorf("label name %q is reserved", name)
+		case name == "server" || name == instanceLabelName:
+			return fmt.Errorf("label name %q is already used by the exporter", name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+* Copyright 2015 The Prometheus Authors
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileSDPicksUpChanges(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "targets.yaml")
+	write := func(content string) {
+		t.Helper()
+		err := os.WriteFile(path, []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("- targets: [\"ntp1.example.com\"]\n")
+
+	d := &fileSD{Patterns: []string{filepath.Join(filepath.Dir(path), "*.yaml")}}
+	servers := d.Servers()
+	if len(servers) != 1 || servers[0].Address != "ntp1.example.com" {
+		t.Fatalf("expected ntp1.example.com, got %#v", servers)
+	}
+	if d.watcher == nil {
+		t.Skip("cannot watch files on this system")
+	}
+
+	//the modification time may not change within the timestamp resolution of
+	//the filesystem, so only the watcher can notice this change
+	write("- targets: [\"ntp2.example.com\"]\n")
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		servers = d.Servers()
+		if len(servers) == 1 && servers[0].Address == "ntp2.example.com" {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("expected ntp2.example.com, got %#v", servers)
+}
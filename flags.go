@@ -0,0 +1,203 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+* Copyright 2015 The Prometheus Authors
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// stringListFlag is a flag.Value that can be given multiple times.
+type stringListFlag []string
+
+// String implements the flag.Value interface.
+func (f *stringListFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+// Set implements the flag.Value interface.
+func (f *stringListFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+func (f stringListFlag) contains(value string) bool {
+	for _, v := range f {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// protocolVersionsFlag is a flag.Value that collects "server=version" pairs.
+type protocolVersionsFlag map[string]int
+
+// String implements the flag.Value interface.
+func (f protocolVersionsFlag) String() string {
+	pairs := make([]string, 0, len(f))
+	for server, version := range f {
+		pairs = append(pairs, fmt.Sprintf("%s=%d", server, version))
+	}
+	return strings.Join(pairs, ",")
+}
+
+// Set implements the flag.Value interface.
+func (f protocolVersionsFlag) Set(value string) error {
+	fields := strings.SplitN(value, "=", 2)
+	if len(fields) != 2 || fields[0] == "" {
+		return fmt.Errorf("expected \"server=version\", got %q", value)
+	}
+	version, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return fmt.Errorf("invalid protocol version in %q: %s", value, err)
+	}
+	f[fields[0]] = version
+	return nil
+}
+
+// timeoutsFlag is a flag.Value that collects "server=duration" pairs.
+type timeoutsFlag map[string]time.Duration
+
+// String implements the flag.Value interface.
+func (f timeoutsFlag) String() string {
+	pairs := make([]string, 0, len(f))
+	for server, timeout := range f {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", server, timeout))
+	}
+	return strings.Join(pairs, ",")
+}
+
+// Set implements the flag.Value interface.
+func (f timeoutsFlag) Set(value string) error {
+	fields := strings.SplitN(value, "=", 2)
+	if len(fields) != 2 || fields[0] == "" {
+		return fmt.Errorf("expected \"server=duration\", got %q", value)
+	}
+	timeout, err := time.ParseDuration(fields[1])
+	if err != nil {
+		return fmt.Errorf("invalid timeout in %q: %s", value, err)
+	}
+	if timeout <= 0 {
+		return fmt.Errorf("timeout in %q must be positive", value)
+	}
+	f[fields[0]] = timeout
+	return nil
+}
+
+// fallbacksFlag is a flag.Value that collects "server=fallback" pairs. The
+// fallbacks of each server are kept in the order in which they were given.
+type fallbacksFlag map[string][]string
+
+// String implements the flag.Value interface.
+func (f fallbacksFlag) String() string {
+	var pairs []string
+	for server, fallbacks := range f {
+		for _, fallback := range fallbacks {
+			pairs = append(pairs, server+"="+fallback)
+		}
+	}
+	return strings.Join(pairs, ",")
+}
+
+// Set implements the flag.Value interface.
+func (f fallbacksFlag) Set(value string) error {
+	fields := strings.SplitN(value, "=", 2)
+	if len(fields) != 2 || fields[0] == "" || fields[1] == "" {
+		return fmt.Errorf("expected \"server=fallback\", got %q", value)
+	}
+	f[fields[0]] = append(f[fields[0]], fields[1])
+	return nil
+}
+
+// bucketsFlag is a flag.Value that contains histogram bucket boundaries as a
+// comma-separated list of positive numbers in increasing order.
+type bucketsFlag []float64
+
+// String implements the flag.Value interface.
+func (f *bucketsFlag) String() string {
+	values := make([]string, len(*f))
+	for idx, v := range *f {
+		values[idx] = strconv.FormatFloat(v, 'g', -1, 64)
+	}
+	return strings.Join(values, ",")
+}
+
+// Set implements the flag.Value interface.
+func (f *bucketsFlag) Set(value string) error {
+	var buckets []float64
+	for _, field := range strings.Split(value, ",") {
+		bucket, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil {
+			return fmt.Errorf("invalid bucket boundary %q: %s", field, err)
+		}
+		if bucket <= 0 {
+			return fmt.Errorf("bucket boundaries must be positive, got %g", bucket)
+		}
+		if len(buckets) > 0 && bucket <= buckets[len(buckets)-1] {
+			return fmt.Errorf("bucket boundaries must be sorted in increasing order, got %g after %g", bucket, buckets[len(buckets)-1])
+		}
+		buckets = append(buckets, bucket)
+	}
+	*f = buckets
+	return nil
+}
+
+// roughtimeServersFlag is a flag.Value that can be given multiple times, each
+// time with a Roughtime server as "address=publickey", where the public key is
+// encoded in base64.
+type roughtimeServersFlag []roughtimeServer
+
+// String implements the flag.Value interface.
+func (f *roughtimeServersFlag) String() string {
+	pairs := make([]string, len(*f))
+	for idx, s := range *f {
+		pairs[idx] = s.Address + "=" + base64.StdEncoding.EncodeToString(s.PublicKey)
+	}
+	return strings.Join(pairs, ",")
+}
+
+// Set implements the flag.Value interface.
+func (f *roughtimeServersFlag) Set(value string) error {
+	//split at the first "=" since base64 may end in "=" as well
+	fields := strings.SplitN(value, "=", 2)
+	if len(fields) != 2 || fields[0] == "" {
+		return fmt.Errorf("expected \"address=publickey\", got %q", value)
+	}
+	key, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return fmt.Errorf("invalid public key in %q: %s", value, err)
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return fmt.Errorf("invalid public key in %q: expected %d bytes, got %d", value, ed25519.PublicKeySize, len(key))
+	}
+	for _, s := range *f {
+		if s.Address == fields[0] {
+			return fmt.Errorf("Roughtime server %s given more than once", s.Address)
+		}
+	}
+	*f = append(*f, roughtimeServer{Address: fields[0], PublicKey: key})
+	return nil
+}
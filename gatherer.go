@@ -0,0 +1,121 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+* Copyright 2015 The Prometheus Authors
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const instanceLabelName = "exporter_instance"
+
+// instanceLabelGatherer wraps a Gatherer and adds the exporter_instance label
+// to all ntp_* and ptp_* metrics. This allows to tell apart measurements of the same NTP
+// server that were taken from different vantage points.
+type instanceLabelGatherer struct {
+	Gatherer prometheus.Gatherer
+	Value    string
+}
+
+// Gather implements the prometheus.Gatherer interface.
+func (g instanceLabelGatherer) Gather() ([]*dto.MetricFamily, error) {
+	mfs, err := g.Gatherer.Gather()
+	for _, mf := range mfs {
+		if !strings.HasPrefix(mf.GetName(), "ntp_") && !strings.HasPrefix(mf.GetName(), "ptp_") {
+			continue
+		}
+		for _, m := range mf.Metric {
+			m.Label = append(m.Label, &dto.LabelPair{
+				Name:  proto.String(instanceLabelName),
+				Value: proto.String(g.Value),
+			})
+		}
+	}
+	return mfs, err
+}
+
+// serverLabelGatherer wraps a Gatherer and adds the labels of each NTP server
+// (e.g. from -ntp.file-sd) to all ntp_* metrics with the "server" label of that
+// server. Labels that a metric already has are not overwritten.
+type serverLabelGatherer struct {
+	Gatherer prometheus.Gatherer
+	Metrics  *metrics
+}
+
+// Gather implements the prometheus.Gatherer interface.
+func (g serverLabelGatherer) Gather() ([]*dto.MetricFamily, error) {
+	mfs, err := g.Gatherer.Gather()
+	for _, mf := range mfs {
+		if !strings.HasPrefix(mf.GetName(), "ntp_") {
+			continue
+		}
+		for _, m := range mf.Metric {
+			labels := g.Metrics.serverLabels(getLabelValue(m, "server"))
+			names := make([]string, 0, len(labels))
+			for name := range labels {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				if getLabelValue(m, name) != "" {
+					continue
+				}
+				m.Label = append(m.Label, &dto.LabelPair{
+					Name:  proto.String(name),
+					Value: proto.String(labels[name]),
+				})
+			}
+		}
+	}
+	return mfs, err
+}
+
+func getLabelValue(m *dto.Metric, name string) string {
+	for _, l := range m.Label {
+		if l.GetName() == name {
+			return l.GetValue()
+		}
+	}
+	return ""
+}
+
+// getInstanceLabelValue validates the value of the -metrics.instance-label
+// flag. The special value "auto" is replaced by the hostname.
+func getInstanceLabelValue(value string) (string, error) {
+	if value == "auto" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return "", fmt.Errorf("cannot determine hostname: %s", err)
+		}
+		value = hostname
+	}
+	if value == "" || !utf8.ValidString(value) {
+		return "", fmt.Errorf("invalid value for label %s: %q", instanceLabelName, value)
+	}
+	return value, nil
+}
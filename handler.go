@@ -0,0 +1,128 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+* Copyright 2015 The Prometheus Authors
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// metricsHandler serves the metrics path. Each request is served by its own
+// copy of the Collector (sharing the same metrics), so that measurements can
+// be cut short to fit into the scrape timeout of that request.
+type metricsHandler struct {
+	Collector     Collector
+	TimeoutOffset time.Duration
+	InstanceLabel string
+}
+
+// ServeHTTP implements the http.Handler interface.
+func (h metricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c := h.Collector
+	c.Deadline = scrapeDeadline(r, h.TimeoutOffset)
+	c.TraceID = traceIDFromRequest(r)
+
+	gatherer, err := newMetricsGatherer(c, h.InstanceLabel)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	serveMetrics(w, r, gatherer, c.metrics)
+}
+
+// newMetricsGatherer returns the gatherer for everything that is exposed on
+// the metrics path: the metrics of `c` and of all collectors in the default
+// registry.
+func newMetricsGatherer(c Collector, instanceLabel string) (prometheus.Gatherer, error) {
+	registry := prometheus.NewRegistry()
+	err := registry.Register(c)
+	if err != nil {
+		return nil, err
+	}
+
+	var gatherer prometheus.Gatherer = prometheus.Gatherers{prometheus.DefaultGatherer, registry}
+	gatherer = serverLabelGatherer{Gatherer: gatherer, Metrics: c.metrics}
+	if instanceLabel != "" {
+		gatherer = instanceLabelGatherer{Gatherer: gatherer, Value: instanceLabel}
+	}
+	return gatherer, nil
+}
+
+// gatherMetrics returns everything that would be served on the metrics path
+// for a scrape that is handled by `c`.
+func gatherMetrics(c Collector, instanceLabel string) ([]*dto.MetricFamily, error) {
+	gatherer, err := newMetricsGatherer(c, instanceLabel)
+	if err != nil {
+		return nil, err
+	}
+	return gatherer.Gather()
+}
+
+// scrapeDeadline returns the time by which the response to the given scrape
+// request must be finished, based on the scrape timeout that Prometheus sends
+// in the X-Prometheus-Scrape-Timeout-Seconds header. The offset is subtracted
+// to leave time for rendering and transmitting the response. The zero time is
+// returned if the header is missing or invalid.
+func scrapeDeadline(r *http.Request, offset time.Duration) time.Time {
+	header := r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds")
+	if header == "" {
+		return time.Time{}
+	}
+	seconds, err := strconv.ParseFloat(header, 64)
+	if err != nil || seconds <= 0 {
+		slog.Debug("ignoring invalid X-Prometheus-Scrape-Timeout-Seconds header", "value", header)
+		return time.Time{}
+	}
+	timeout := time.Duration(seconds * float64(time.Second))
+	//do not subtract the offset if that would leave no time at all
+	if timeout > offset {
+		timeout -= offset
+	}
+	return time.Now().Add(timeout)
+}
+
+// traceIDFromRequest returns the trace ID from the W3C Trace Context header
+// ("traceparent") of the given request if the caller samples that trace, or
+// the empty string otherwise. This is how tracing is enabled for a scrape:
+// the measurements made for it record the trace ID as an exemplar.
+func traceIDFromRequest(r *http.Request) string {
+	//format: version "-" trace-id "-" parent-id "-" trace-flags
+	fields := strings.Split(strings.TrimSpace(r.Header.Get("traceparent")), "-")
+	if len(fields) < 4 || len(fields[0]) != 2 || fields[0] == "ff" || len(fields[1]) != 32 || len(fields[3]) != 2 {
+		return ""
+	}
+	_, err := hex.DecodeString(fields[1])
+	if err != nil || fields[1] == strings.Repeat("0", 32) {
+		return ""
+	}
+	flags, err := hex.DecodeString(fields[3])
+	if err != nil || flags[0]&0x01 == 0 {
+		return ""
+	}
+	return strings.ToLower(fields[1])
+}
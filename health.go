@@ -0,0 +1,58 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+* Copyright 2015 The Prometheus Authors
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import "net/http"
+
+// healthyHandler serves the /-/healthy endpoint, which always succeeds while
+// the exporter is running.
+type healthyHandler struct{}
+
+// ServeHTTP implements the http.Handler interface.
+func (healthyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("OK\n"))
+}
+
+// readyHandler serves the /-/ready endpoint. The exporter is ready once all
+// servers were measured for the first time, so that the first scrapes do not
+// report empty results: With -ntp.poll-interval, this is the first
+// measurement in the background, otherwise the measurement at startup or the
+// first scrape, whichever finishes first.
+type readyHandler struct {
+	Collector Collector
+}
+
+// ServeHTTP implements the http.Handler interface.
+func (h readyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.Collector.isReady() {
+		http.Error(w, "waiting for the first measurement", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("OK\n"))
+}
+
+// isReady returns whether the collector is ready to serve metrics (see
+// readyHandler).
+func (c Collector) isReady() bool {
+	c.ready.Lock()
+	defer c.ready.Unlock()
+	return c.ready.Done
+}
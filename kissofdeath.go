@@ -0,0 +1,119 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+* Copyright 2015 The Prometheus Authors
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// kissOfDeathMaxBackoffFactor limits how much the backoff grows when a server
+// keeps sending kiss-of-death packets.
+const kissOfDeathMaxBackoffFactor = 64
+
+// kissOfDeathError is returned by queries that were answered with a
+// kiss-of-death packet (stratum 0).
+type kissOfDeathError struct {
+	Code string
+}
+
+// Error implements the error interface.
+func (e kissOfDeathError) Error() string {
+	return fmt.Sprintf("received kiss-of-death packet with code %q", e.Code)
+}
+
+// isBackoffKissCode returns whether the given kiss code asks us to stop (DENY,
+// RSTR) or reduce (RATE) our queries. Other kiss codes are informational.
+func isBackoffKissCode(code string) bool {
+	return code == "RATE" || code == "DENY" || code == "RSTR"
+}
+
+// kissOfDeathBackoff stops querying servers that sent a RATE, DENY or RSTR
+// kiss-of-death packet. The first such packet suspends queries to the server
+// for Cooldown. Each further one in a row doubles the time, up to
+// kissOfDeathMaxBackoffFactor times Cooldown.
+type kissOfDeathBackoff struct {
+	Cooldown time.Duration
+
+	mutex   sync.Mutex
+	servers map[string]*kissOfDeathState
+}
+
+type kissOfDeathState struct {
+	Code   string
+	Factor time.Duration
+	Until  time.Time
+}
+
+func newKissOfDeathBackoff(cooldown time.Duration) *kissOfDeathBackoff {
+	return &kissOfDeathBackoff{
+		Cooldown: cooldown,
+		servers:  make(map[string]*kissOfDeathState),
+	}
+}
+
+// Allow returns whether the given server may be queried right now. If not, it
+// also returns the kiss code that caused the backoff.
+func (b *kissOfDeathBackoff) Allow(server string) (bool, string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	s, exists := b.servers[server]
+	if !exists || time.Now().After(s.Until) {
+		return true, ""
+	}
+	return false, s.Code
+}
+
+// State returns the kiss code that caused the backoff of the given server and
+// the time until which it lasts, or "" and the zero time if the server is not
+// backed off.
+func (b *kissOfDeathBackoff) State(server string) (string, time.Time) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	s, exists := b.servers[server]
+	if !exists || time.Now().After(s.Until) {
+		return "", time.Time{}
+	}
+	return s.Code, s.Until
+}
+
+// Record updates the backoff for the given server with the kiss code from its
+// latest response ("" for a regular response).
+func (b *kissOfDeathBackoff) Record(server, code string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if !isBackoffKissCode(code) {
+		delete(b.servers, server)
+		return
+	}
+	s, exists := b.servers[server]
+	if !exists {
+		s = &kissOfDeathState{Factor: 1}
+		b.servers[server] = s
+	} else if s.Factor < kissOfDeathMaxBackoffFactor {
+		s.Factor *= 2
+	}
+	s.Code = code
+	s.Until = time.Now().Add(s.Factor * b.Cooldown)
+	slog.Warn("received kiss-of-death packet, not querying the server during the cooldown", "server", server, "code", code, "cooldown", s.Factor*b.Cooldown)
+}
@@ -0,0 +1,114 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+* Copyright 2015 The Prometheus Authors
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"html/template"
+	"log/slog"
+	"net/http"
+	"sort"
+
+	"github.com/prometheus/common/version"
+)
+
+var landingPageTemplate = template.Must(template.New("landing").Parse(`<html>
+<head><title>NTP Exporter</title></head>
+<body>
+<h1>NTP Exporter</h1>
+<p>Version: {{if .Version}}{{.Version}}{{else}}unknown{{end}}</p>
+<p><a href="{{.MetricsPath}}">Metrics</a></p>
+<p><a href="/probe?target=pool.ntp.org">Probe pool.ntp.org</a></p>
+<p><a href="/targets">Targets</a></p>
+<h2>Servers</h2>
+{{if .Servers}}<table>
+<tr><th>Server</th><th>Last measurement</th><th>Status</th></tr>
+{{range .Servers}}<tr>
+<td>{{.Address}}</td>
+{{if .Time.IsZero}}<td>never</td><td>not measured yet</td>
+{{else}}<td>{{.Time.Format "2006-01-02 15:04:05 MST"}}</td>
+<td>{{if .Error}}down: {{.Error}}{{else}}up, offset {{printf "%.6f" .Offset}}s{{end}}</td>
+{{end}}</tr>
+{{end}}</table>
+{{else}}<p>No servers are measured on the metrics path.</p>
+{{end}}</body>
+</html>
+`))
+
+// landingPageHandler serves the landing page at "/", which shows the status
+// of the servers that are measured on the metrics path.
+type landingPageHandler struct {
+	Collector   Collector
+	MetricsPath string
+}
+
+// addressedServerStatus is the status of a server together with its address.
+type addressedServerStatus struct {
+	Address string
+	serverStatus
+}
+
+// ServeHTTP implements the http.Handler interface.
+func (h landingPageHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := landingPageTemplate.Execute(w, struct {
+		Version     string
+		MetricsPath string
+		Servers     []addressedServerStatus
+	}{version.Version, h.MetricsPath, h.Collector.serverStatuses()})
+	if err != nil {
+		slog.Error("cannot render landing page", "err", err)
+	}
+}
+
+// serverStatuses lists the status of the servers that were measured (which
+// includes the members of pools and SRV domains), and of the configured ones
+// that were not measured yet, ordered by address.
+func (c Collector) serverStatuses() []addressedServerStatus {
+	c.status.Lock()
+	servers := make([]addressedServerStatus, 0, len(c.status.ByServer))
+	for address, status := range c.status.ByServer {
+		servers = append(servers, addressedServerStatus{address, status})
+	}
+	c.status.Unlock()
+	for _, s := range c.servers() {
+		if !s.Pool && !s.SRV && !hasServerStatus(servers, s.Address) {
+			servers = append(servers, addressedServerStatus{Address: s.Address})
+		}
+	}
+	sort.Slice(servers, func(i, j int) bool {
+		return servers[i].Address < servers[j].Address
+	})
+	return servers
+}
+
+func hasServerStatus(servers []addressedServerStatus, address string) bool {
+	for _, s := range servers {
+		if s.Address == address {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,224 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+* Copyright 2015 The Prometheus Authors
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	leapFileUpDesc = prometheus.NewDesc(
+		"ntp_leap_file_up",
+		"Whether the last attempt to read the leap-seconds file succeeded (1) or not (0).",
+		nil, nil,
+	)
+	leapTAIOffsetDesc = prometheus.NewDesc(
+		"ntp_leap_tai_offset_seconds",
+		"Current offset between TAI and UTC according to the leap-seconds file.",
+		nil, nil,
+	)
+	leapScheduledDesc = prometheus.NewDesc(
+		"ntp_leap_second_scheduled",
+		"Whether the leap-seconds file lists a leap second within the window given by -leap.scheduled-window.",
+		nil, nil,
+	)
+	leapExpiryDesc = prometheus.NewDesc(
+		"ntp_leap_file_expiry_timestamp_seconds",
+		"Unix timestamp of the expiration date of the leap-seconds file.",
+		nil, nil,
+	)
+	leapExpiredDesc = prometheus.NewDesc(
+		"ntp_leap_file_expired",
+		"Whether the expiration date of the leap-seconds file has passed.",
+		nil, nil,
+	)
+	leapKernelMismatchDesc = prometheus.NewDesc(
+		"ntp_leap_kernel_tai_offset_mismatch",
+		"Whether the offset between TAI and UTC as known to the kernel differs from the one in the leap-seconds file (Linux only).",
+		nil, nil,
+	)
+)
+
+// leapTable is the content of a leap-seconds file in the format published by
+// the IERS and NIST (leap-seconds.list), which is also shipped by tzdata.
+type leapTable struct {
+	Expiry time.Time
+	Leaps  []leapEntry //in chronological order
+}
+
+// leapEntry is one line of a leap-seconds file: From this time on, TAI is
+// ahead of UTC by TAIOffset seconds.
+type leapEntry struct {
+	Time      time.Time
+	TAIOffset int
+}
+
+// readLeapTable parses the leap-seconds file at the given path.
+func readLeapTable(path string) (leapTable, error) {
+	var table leapTable
+	f, err := os.Open(path)
+	if err != nil {
+		return table, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if strings.HasPrefix(text, "#@") {
+			fields := strings.Fields(text[2:])
+			if len(fields) == 0 {
+				return table, fmt.Errorf("%s:%d: missing expiration date", path, line)
+			}
+			table.Expiry, err = parseNTPSeconds(fields[0])
+			if err != nil {
+				return table, fmt.Errorf("%s:%d: %s", path, line, err)
+			}
+			continue
+		}
+		if idx := strings.IndexByte(text, '#'); idx >= 0 {
+			text = text[:idx]
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return table, fmt.Errorf("%s:%d: expected two fields, got %d", path, line, len(fields))
+		}
+		t, err := parseNTPSeconds(fields[0])
+		if err != nil {
+			return table, fmt.Errorf("%s:%d: %s", path, line, err)
+		}
+		offset, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return table, fmt.Errorf("%s:%d: invalid TAI offset %q", path, line, fields[1])
+		}
+		if len(table.Leaps) > 0 && !t.After(table.Leaps[len(table.Leaps)-1].Time) {
+			return table, fmt.Errorf("%s:%d: entries are not in chronological order", path, line)
+		}
+		table.Leaps = append(table.Leaps, leapEntry{Time: t, TAIOffset: offset})
+	}
+	if err := scanner.Err(); err != nil {
+		return table, err
+	}
+	if len(table.Leaps) == 0 {
+		return table, fmt.Errorf("%s: no leap seconds found", path)
+	}
+	if table.Expiry.IsZero() {
+		return table, fmt.Errorf("%s: no expiration date found", path)
+	}
+	return table, nil
+}
+
+// parseNTPSeconds parses a timestamp given in seconds since the NTP epoch.
+func parseNTPSeconds(value string) (time.Time, error) {
+	secs, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid NTP timestamp %q", value)
+	}
+	return ntpEpoch.Add(time.Duration(secs) * time.Second), nil
+}
+
+// TAIOffset returns the offset between TAI and UTC at the given time.
+func (t leapTable) TAIOffset(now time.Time) int {
+	offset := 0
+	for _, leap := range t.Leaps {
+		if leap.Time.After(now) {
+			break
+		}
+		offset = leap.TAIOffset
+	}
+	return offset
+}
+
+// NextLeap returns the first entry after the given time, or false if the
+// table does not list any.
+func (t leapTable) NextLeap(now time.Time) (leapEntry, bool) {
+	for _, leap := range t.Leaps {
+		if leap.Time.After(now) {
+			return leap, true
+		}
+	}
+	return leapEntry{}, false
+}
+
+// leapCollector reports the leap seconds listed in a leap-seconds file, so
+// that upcoming leap seconds and outdated copies of the file can be noticed.
+// If CheckKernel is set, the TAI offset from the file is compared with the one
+// in the kernel, which is only updated by the time synchronization daemon.
+type leapCollector struct {
+	Path            string
+	ScheduledWindow time.Duration
+	CheckKernel     bool
+}
+
+// Describe implements the prometheus.Collector interface.
+func (c leapCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- leapFileUpDesc
+	ch <- leapTAIOffsetDesc
+	ch <- leapScheduledDesc
+	ch <- leapExpiryDesc
+	ch <- leapExpiredDesc
+	if c.CheckKernel {
+		ch <- leapKernelMismatchDesc
+	}
+}
+
+// Collect implements the prometheus.Collector interface.
+func (c leapCollector) Collect(ch chan<- prometheus.Metric) {
+	table, err := readLeapTable(c.Path)
+	if err != nil {
+		slog.Error("couldn't read leap-seconds file", "path", c.Path, "err", err)
+		ch <- prometheus.MustNewConstMetric(leapFileUpDesc, prometheus.GaugeValue, 0)
+		return
+	}
+	now := time.Now()
+	next, exists := table.NextLeap(now)
+	scheduled := exists && next.Time.Sub(now) <= c.ScheduledWindow
+
+	gauge := func(desc *prometheus.Desc, value float64) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value)
+	}
+	gauge(leapFileUpDesc, 1)
+	taiOffset := table.TAIOffset(now)
+	gauge(leapTAIOffsetDesc, float64(taiOffset))
+	gauge(leapScheduledDesc, boolToFloat(scheduled))
+	gauge(leapExpiryDesc, float64(table.Expiry.Unix()))
+	gauge(leapExpiredDesc, boolToFloat(now.After(table.Expiry)))
+
+	if c.CheckKernel {
+		kernelOffset, err := readKernelTAIOffset()
+		if err != nil {
+			slog.Error("couldn't read TAI offset of the kernel", "err", err)
+			return
+		}
+		gauge(leapKernelMismatchDesc, boolToFloat(kernelOffset != taiOffset))
+	}
+}
@@ -0,0 +1,82 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+* Copyright 2015 The Prometheus Authors
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// setupLogging replaces the default logger with one that writes to w in the
+// given format ("logfmt" or "json"), and only logs messages with the given
+// severity ("debug", "info", "warn" or "error") or above.
+func setupLogging(w io.Writer, level, format string) error {
+	opts := &slog.HandlerOptions{
+		//render durations like "1.5s" instead of as nanoseconds in JSON
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Value.Kind() == slog.KindDuration {
+				a.Value = slog.StringValue(a.Value.Duration().String())
+			}
+			return a
+		},
+	}
+	switch strings.ToLower(level) {
+	case "debug":
+		opts.Level = slog.LevelDebug
+	case "info":
+		opts.Level = slog.LevelInfo
+	case "warn":
+		opts.Level = slog.LevelWarn
+	case "error":
+		opts.Level = slog.LevelError
+	default:
+		return fmt.Errorf("invalid -log.level %q", level)
+	}
+
+	var handler slog.Handler
+	switch format {
+	case "logfmt":
+		handler = slog.NewTextHandler(w, opts)
+	case "json":
+		handler = slog.NewJSONHandler(w, opts)
+	default:
+		return fmt.Errorf("invalid -log.format %q", format)
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// fatal logs the given message and attributes like slog.Error, and then exits
+// the process.
+func fatal(msg string, args ...interface{}) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// newErrorLogger returns a logger for promhttp.HandlerOpts that logs through
+// the default logger with the error severity.
+func newErrorLogger() *log.Logger {
+	return slog.NewLogLogger(slog.Default().Handler(), slog.LevelError)
+}
@@ -21,61 +21,626 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"runtime"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/version"
 )
 
-var version string // will be substituted at compile-time
-
 func main() {
+	//"ntp_exporter check [options]" runs as a Nagios plugin instead of an exporter
+	checkMode := len(os.Args) > 1 && os.Args[1] == "check"
+	if checkMode {
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
+
 	var (
 		showVersion            = flag.Bool("version", false, "Print version information.")
+		logLevel               = flag.String("log.level", "info", "Only log messages with the given severity or above (\"debug\", \"info\", \"warn\" or \"error\").")
+		logFormat              = flag.String("log.format", "logfmt", "Format of log messages (\"logfmt\" or \"json\").")
+		configFile             = flag.String("config.file", "", "Path to a YAML file listing the NTP servers to measure, in addition to those given with -ntp.server.")
+		dryRunMode             = flag.Bool("dry-run", false, "Take a single measurement, print it and exit.")
+		outputFormat           = flag.String("output", "text", "Output format for -dry-run (\"text\" or \"json\").")
+		checkOffsetWarning     = flag.Duration("check.offset-warning", 100*time.Millisecond, "Offset above which the check subcommand reports WARNING (0 disables).")
+		checkOffsetCritical    = flag.Duration("check.offset-critical", time.Second, "Offset above which the check subcommand reports CRITICAL (0 disables).")
+		checkStratumWarning    = flag.Int("check.stratum-warning", 0, "If set, stratum above which the check subcommand reports WARNING.")
+		checkStratumCritical   = flag.Int("check.stratum-critical", 0, "If set, stratum above which the check subcommand reports CRITICAL.")
+		onceMode               = flag.Bool("once", false, "Measure all NTP servers once, write all metrics in the text exposition format and exit, e.g. for the textfile collector of the node_exporter.")
+		outputFile             = flag.String("output.file", "", "File to write the metrics to with -once. By default, they are written to stdout.")
+		pushURL                = flag.String("push.url", "", "If set, push all metrics to the Pushgateway at this URL (e.g. http://pushgateway:9091) every -push.interval, in addition to serving them on the metrics path.")
+		pushInterval           = flag.Duration("push.interval", time.Minute, "Interval at which metrics are pushed to the Pushgateway (see -push.url).")
+		pushJob                = flag.String("push.job", "ntp_exporter", "Value of the job label in the grouping key of the pushed metrics (see -push.url).")
+		pushInstance           = flag.String("push.instance", "", "Value of the instance label in the grouping key of the pushed metrics (see -push.url). Defaults to the hostname.")
+		remoteWriteURL         = flag.String("remote-write.url", "", "If set, send all metrics to this Prometheus remote write endpoint (e.g. https://prometheus.example.com/api/v1/write) every -remote-write.interval, in addition to serving them on the metrics path.")
+		remoteWriteInterval    = flag.Duration("remote-write.interval", time.Minute, "Interval at which metrics are sent to the remote write endpoint (see -remote-write.url).")
+		remoteWriteJob         = flag.String("remote-write.job", "ntp_exporter", "Value of the job label that is added to the metrics sent with remote write (see -remote-write.url).")
+		remoteWriteInstance    = flag.String("remote-write.instance", "", "Value of the instance label that is added to the metrics sent with remote write (see -remote-write.url). Defaults to the hostname.")
+		remoteWriteUsername    = flag.String("remote-write.username", "", "Username for basic authentication at the remote write endpoint. The password is read from -remote-write.password-file.")
+		remoteWritePassword    = flag.String("remote-write.password-file", "", "File containing the password for basic authentication at the remote write endpoint (see -remote-write.username).")
+		remoteWriteBearerToken = flag.String("remote-write.bearer-token-file", "", "File containing a bearer token for authentication at the remote write endpoint.")
+		otlpURL                = flag.String("otlp.url", "", "If set, send all metrics to this OTLP/HTTP endpoint of an OpenTelemetry collector (e.g. http://otel-collector:4318/v1/metrics) every -otlp.interval, in addition to serving them on the metrics path. Request headers can be set in $OTEL_EXPORTER_OTLP_HEADERS.")
+		otlpInterval           = flag.Duration("otlp.interval", time.Minute, "Interval at which metrics are sent to the OTLP endpoint (see -otlp.url).")
 		listenAddress          = flag.String("web.listen-address", ":9559", "Address on which to expose metrics and web interface.")
+		webConfigFile          = flag.String("web.config.file", "", "Path to a web config file (a subset of the Prometheus exporter-toolkit format), to serve the web interface with TLS and/or basic authentication.")
 		metricsPath            = flag.String("web.telemetry-path", "/metrics", "Path under which to expose metrics.")
-		ntpServer              = flag.String("ntp.server", "", "NTP server to use (required).")
+		shutdownTimeout        = flag.Duration("web.shutdown-timeout", 10*time.Second, "On SIGTERM or SIGINT, how long to wait for running scrapes and pushes to finish before exiting.")
+		timeoutOffset          = flag.Duration("web.timeout-offset", 500*time.Millisecond, "Subtract this from the scrape timeout sent by Prometheus, to leave time for sending the response.")
 		ntpProtocolVersion     = flag.Int("ntp.protocol-version", 4, "NTP protocol version to use.")
-		ntpMeasurementDuration = flag.Duration("ntp.measurement-duration", 30*time.Second, "Duration of measurements in case of high (>10ms) drift.")
+		ntpTimeout             = flag.Duration("ntp.timeout", ntpDefaultTimeout, "Timeout for each NTP query.")
+		ntpMeasurementSamples  = flag.Int("ntp.measurement-samples", 0, "Maximum number of measurements in case of high drift (0 means as many as fit into -ntp.measurement-duration).")
+		ntpMeasurementInterval = flag.Duration("ntp.measurement-interval", 0, "Delay between measurements in case of high drift.")
+		ntpHighDriftThreshold  = flag.Duration("ntp.high-drift-threshold", 10*time.Millisecond, "Take multiple measurements for -ntp.measurement-duration if the drift is above this threshold.")
+		ntpDriftThreshold      = flag.Duration("ntp.drift-threshold", 0, "If set, report in ntp_drift_exceeds_threshold whether the absolute drift is above this threshold. Can be overridden per server in the config file.")
+		ntpMaxStratum          = flag.Int("ntp.max-stratum", 0, "If set, report in ntp_stratum_exceeds_maximum whether the stratum of the NTP server is above this value. Can be overridden per server in the config file.")
+		ntpMaxRootDistance     = flag.Duration("ntp.max-root-distance", 1500*time.Millisecond, "Report in ntp_root_distance_exceeds_maximum whether the root distance of the NTP server is above this value. The default is MAXDIST from RFC 5905. Can be overridden per server in the config file.")
+		ntpMeasurementDuration = flag.Duration("ntp.measurement-duration", 30*time.Second, "Duration of measurements in case of high drift (see -ntp.high-drift-threshold).")
+		instanceLabel          = flag.String("metrics.instance-label", "", "If set, add an \"exporter_instance\" label with this value to all NTP and PTP metrics. Use \"auto\" to use the hostname.")
+		failOnError            = flag.Bool("metrics.fail-on-error", false, "Fail scrapes with HTTP status 500 if any NTP server could not be measured, instead of reporting the metrics of the other servers. For /probe, this can be overridden with the \"fail_on_error\" parameter.")
+		reportUnreached        = flag.Bool("metrics.report-unreached-servers", false, "Report NaN values for servers that were never reached since startup, instead of omitting their series.")
+		ntpDualStack           = flag.Bool("ntp.dual-stack", false, "Additionally measure the NTP server over both IPv4 and IPv6 and report the divergence.")
+		ntpReferenceServer     = flag.String("ntp.reference-server", "", "If set, report the offsets of all other servers relative to this one. Must be one of the servers given with -ntp.server or in -config.file.")
+		ntpRetries             = flag.Int("ntp.retries", 0, "Retry NTP queries up to this many times if they time out or fail with a network error.")
+		ntpRetryBackoff        = flag.Duration("ntp.retry-backoff", 200*time.Millisecond, "Delay before the first retry of an NTP query, doubled for each further retry up to -ntp.timeout (see -ntp.retries).")
+		ntpRetryJitter         = flag.Float64("ntp.retry-jitter", 0.2, "Fraction of the delay by which retries of NTP queries are randomly delayed more or less, so that retries to the same server are spread out (see -ntp.retries).")
+		breakerThreshold       = flag.Int("ntp.circuit-breaker.threshold", 0, "Stop querying a server after this many consecutive failures (0 disables the circuit breaker).")
+		breakerCooldown        = flag.Duration("ntp.circuit-breaker.cooldown", 5*time.Minute, "How long to stop querying a server after its circuit breaker opened.")
+		kissOfDeathCooldown    = flag.Duration("ntp.kiss-of-death.cooldown", 15*time.Minute, "How long to stop querying a server after it sent a RATE, DENY or RSTR kiss-of-death packet. Doubles for each further one in a row. 0 disables the backoff.")
+		emaAlpha               = flag.Float64("ntp.ema-alpha", 0, "Smoothing factor (between 0 and 1) for the ntp_offset_ema_seconds metric. 0 disables the metric.")
+		emaHalfLife            = flag.Duration("ntp.ema-half-life", 0, "Half-life of the ntp_drift_seconds_smoothed metric. The smoothing factor is computed from it for each measurement, depending on the time since the previous one. 0 disables the metric.")
+		emaMaxGap              = flag.Duration("ntp.ema-max-gap", 10*time.Minute, "Restart the moving averages of ntp_offset_ema_seconds and ntp_drift_seconds_smoothed when no measurement was taken for this long.")
+		frequencyWindow        = flag.Duration("ntp.frequency-window", 0, "Estimate the frequency error (ntp_frequency_offset_ppm) and stability (ntp_allan_deviation) of the local clock from the drift measured within this time window. 0 disables these metrics.")
+		ntpAggregation         = flag.String("ntp.aggregation", "median", "How to combine the offsets of multiple measurements in case of high drift (\"median\", \"mean\", \"trimmed-mean\" or \"min-rtt\").")
+		ntpCacheTTL            = flag.Duration("ntp.cache-ttl", 0, "If set, scrapes within this duration after a measurement report the results of that measurement instead of querying the NTP servers again.")
+		ntpConcurrency         = flag.Int("ntp.concurrency", 4, "Maximum number of NTP servers that are measured at the same time.")
+		ntpNTS                 = flag.Bool("ntp.nts", false, "Query all NTP servers with Network Time Security (NTS). The NTS key exchange is done with the NTP server on port 4460.")
+		ntpInterleaved         = flag.Bool("ntp.interleaved", false, "Query all NTP servers in interleaved mode, which gives more accurate measurements. Servers without support for interleaved mode are queried in basic mode.")
+		ntpPollInterval        = flag.Duration("ntp.poll-interval", 0, "If set, measure the NTP servers in the background at this interval, and report the latest results on the metrics path. By default, servers are measured during each scrape.")
+		ntpDSCP                = flag.Int("ntp.dscp", 0, "If set, mark NTP queries with this DSCP value (0-63, e.g. 46 for Expedited Forwarding), so that they get the same QoS treatment as other NTP traffic (Linux only).")
+		ntpAddressFamily       = flag.String("ntp.address-family", "any", "Address family to query NTP servers over: \"any\" (as resolved by the system), \"ipv4\", \"ipv6\" or \"prefer-ipv6\" (IPv6 if the server has an IPv6 address, IPv4 otherwise). Can be overridden per server in the config file.")
+		ntpSourceAddress       = flag.String("ntp.source-address", "", "If set, send NTP queries from this local IP address, e.g. to measure over a specific interface on multi-homed hosts. Can be overridden per server in the config file.")
+		ntpSourcePort          = flag.Int("ntp.source-port", 0, "If set, send NTP queries from this UDP port (e.g. 123 for firewalls that only permit NTP between port 123 on both sides). Queries are then sent one at a time.")
+		ntpReadBufferBytes     = flag.Int("ntp.read-buffer-bytes", 0, "Size of the receive buffer for NTP query sockets in bytes (0 means system default).")
+		consulAddress          = flag.String("consul.address", "localhost:8500", "Address of the Consul agent (see -consul.service). The ACL token is taken from $CONSUL_HTTP_TOKEN.")
+		consulService          = flag.String("consul.service", "", "If set, measure the NTP servers registered under this service name in the Consul catalog on the metrics path.")
+		consulTag              = flag.String("consul.tag", "", "Only measure the instances of -consul.service that have this tag.")
+		consulTimeout          = flag.Duration("consul.timeout", 5*time.Second, "Timeout for requests to Consul.")
+		chronyAddress          = flag.String("chrony.address", "", "If set, report the tracking status and time sources of the local chronyd. Either the path of its command socket (e.g. /var/run/chrony/chronyd.sock) or the address of its UDP command port (e.g. 127.0.0.1:323).")
+		chronyTimeout          = flag.Duration("chrony.timeout", time.Second, "Timeout for requests to chronyd (see -chrony.address).")
+		ntpdAddress            = flag.String("ntpd.address", "", "If set, report the system variables and peers of the ntpd at this address (e.g. localhost), which is queried with the NTP control protocol like ntpq does.")
+		ntpdTimeout            = flag.Duration("ntpd.timeout", time.Second, "Timeout for requests to ntpd (see -ntpd.address).")
+		timexEnabled           = flag.Bool("timex", false, "Report the state of the kernel clock discipline, which is read with the adjtimex syscall (Linux only).")
+		timexPPS               = flag.Bool("timex.pps", false, "Also report the statistics of the kernel PPS discipline (implies -timex).")
+		ptpSocket              = flag.String("ptp.socket", "", "If set, report the state of the ptp4l that listens on this Unix socket (usually /var/run/ptp4l).")
+		ptpDomain              = flag.Uint("ptp.domain", 0, "PTP domain number of ptp4l (see -ptp.socket).")
+		ptpTimeout             = flag.Duration("ptp.timeout", time.Second, "Timeout for requests to ptp4l (see -ptp.socket).")
+		ptpPHCDevice           = flag.String("ptp.phc-device", "", "If set, report the offset of this PTP hardware clock (e.g. /dev/ptp0) from the system time (Linux only).")
+		roughtimeTimeout       = flag.Duration("roughtime.timeout", 2*time.Second, "Timeout for queries to Roughtime servers (see -roughtime.server).")
+		clockStepThreshold     = flag.Duration("clock.step-threshold", 10*time.Millisecond, "Count a step of the system clock (see ntp_clock_steps_total) when the wall clock and the monotonic clock diverged by more than this between two scrapes.")
+		rtcDevice              = flag.String("rtc.device", "", "If set, report the offset of the hardware clock at this device (e.g. /dev/rtc0) from the system time (Linux only).")
+		leapFile               = flag.String("leap.file", "", "If set, report the leap seconds listed in this leap-seconds file (e.g. /usr/share/zoneinfo/leap-seconds.list).")
+		leapScheduledWindow    = flag.Duration("leap.scheduled-window", 28*24*time.Hour, "Report a leap second as scheduled in ntp_leap_second_scheduled if it takes place within this duration (see -leap.file).")
+		timesyncdEnabled       = flag.Bool("timesyncd", false, "Report the state of systemd-timesyncd, which is read over D-Bus.")
+		timesyncdTimeout       = flag.Duration("timesyncd.timeout", time.Second, "Timeout for requests to systemd-timesyncd over D-Bus (see -timesyncd).")
 	)
+	var roughtimeServers roughtimeServersFlag
+	flag.Var(&roughtimeServers, "roughtime.server", "Roughtime server to query on the metrics path, given as \"address=publickey\" with the base64-encoded public key of the server. Can be given multiple times.")
+	var ntpServers stringListFlag
+	flag.Var(&ntpServers, "ntp.server", "NTP server to measure on the metrics path. Can be given multiple times.")
+	var ntpPools stringListFlag
+	flag.Var(&ntpPools, "ntp.pool", "Hostname of an NTP pool (e.g. pool.ntp.org) to measure on the metrics path. Each address that it resolves to is measured separately. Can be given multiple times.")
+	var ntpFileSD stringListFlag
+	flag.Var(&ntpFileSD, "ntp.file-sd", "Path or glob pattern of files with NTP servers to measure on the metrics path, in the format of the file_sd_configs of Prometheus (JSON or YAML). The files are read again when they change. Can be given multiple times.")
+	var ntpSRVDomains stringListFlag
+	flag.Var(&ntpSRVDomains, "ntp.srv-domain", "Measure the NTP servers listed in the _ntp._udp SRV records of this domain on the metrics path. Can be given multiple times.")
+	rttBuckets := bucketsFlag(defaultRTTBuckets)
+	flag.Var(&rttBuckets, "metrics.rtt-buckets", "Comma-separated bucket boundaries for the ntp_query_rtt_seconds histogram.")
+	offsetBuckets := bucketsFlag(defaultOffsetBuckets)
+	flag.Var(&offsetBuckets, "metrics.offset-buckets", "Comma-separated bucket boundaries for the ntp_query_abs_offset_seconds histogram.")
+	scrapeDurationBuckets := bucketsFlag(defaultScrapeDurationBuckets)
+	flag.Var(&scrapeDurationBuckets, "metrics.scrape-duration-buckets", "Comma-separated bucket boundaries for the ntp_scrape_duration_seconds histogram.")
+	ntpServerProtocolVersions := protocolVersionsFlag{}
+	flag.Var(ntpServerProtocolVersions, "ntp.server-protocol-version", "Override -ntp.protocol-version for one server, given as \"server=version\". Can be given multiple times.")
+	ntpServerTimeouts := timeoutsFlag{}
+	flag.Var(ntpServerTimeouts, "ntp.server-timeout", "Override -ntp.timeout for one server, given as \"server=duration\". Can be given multiple times.")
+	ntpServerFallbacks := fallbacksFlag{}
+	flag.Var(ntpServerFallbacks, "ntp.server-fallback", "Measure a fallback server instead of a server given with -ntp.server when that server cannot be queried, given as \"server=fallback\". Can be given multiple times; the fallbacks are tried in order.")
+	flag.BoolVar(&ntpv5Enabled, "ntp.experimental-ntpv5", false, "Allow -ntp.protocol-version=5 to query NTP servers with the NTPv5 draft protocol. Servers without NTPv5 support are queried with NTPv4.")
 	flag.Parse()
 
 	if *showVersion {
-		fmt.Println(version)
+		fmt.Println(version.Print("ntp_exporter"))
+		os.Exit(0)
+	}
+
+	err := setupLogging(os.Stderr, *logLevel, *logFormat)
+	if err != nil {
+		fatal(err.Error())
+	}
+
+	if *ntpReadBufferBytes < 0 {
+		fatal("-ntp.read-buffer-bytes must not be negative")
+	}
+	var sourceAddress net.IP
+	if *ntpSourceAddress != "" {
+		sourceAddress = net.ParseIP(*ntpSourceAddress)
+		if sourceAddress == nil {
+			fatal("invalid -ntp.source-address", "value", *ntpSourceAddress)
+		}
+	}
+	if *ntpDSCP < 0 || *ntpDSCP > 63 {
+		fatal("-ntp.dscp must be between 0 and 63")
+	}
+	if *ntpDSCP > 0 && runtime.GOOS != "linux" {
+		fatal("-ntp.dscp is only supported on Linux")
+	}
+	if *ntpSourcePort < 0 || *ntpSourcePort > 65535 {
+		fatal("-ntp.source-port must be between 0 and 65535")
+	}
+	if *ntpConcurrency < 1 {
+		fatal("-ntp.concurrency must be at least 1")
+	}
+	validateProtocolVersion(*ntpProtocolVersion)
+	if *ntpTimeout <= 0 {
+		fatal("-ntp.timeout must be positive")
+	}
+
+	if *ntpPollInterval < 0 {
+		fatal("-ntp.poll-interval must not be negative")
+	}
+	if *outputFile != "" && !*onceMode {
+		fatal("-output.file can only be used with -once")
+	}
+	if *pushURL != "" {
+		if *pushInterval <= 0 {
+			fatal("-push.interval must be positive")
+		}
+		if *pushJob == "" {
+			fatal("-push.job must not be empty")
+		}
+		if *pushInstance == "" {
+			*pushInstance, err = os.Hostname()
+			if err != nil {
+				fatal("cannot determine hostname for -push.instance", "err", err)
+			}
+		}
+	}
+	var remoteWriter *remoteWriter
+	if *remoteWriteURL != "" {
+		remoteWriter, err = newRemoteWriter(*remoteWriteURL, *remoteWriteJob, *remoteWriteInstance, *remoteWriteInterval,
+			*remoteWriteUsername, *remoteWritePassword, *remoteWriteBearerToken)
+		if err != nil {
+			fatal("invalid remote write configuration", "err", err)
+		}
+	}
+	var otlpExporter *otlpExporter
+	if *otlpURL != "" {
+		otlpExporter, err = newOTLPExporter(*otlpURL, *otlpInterval)
+		if err != nil {
+			fatal("invalid OTLP configuration", "err", err)
+		}
+	}
+	if *ntpCacheTTL < 0 {
+		fatal("-ntp.cache-ttl must not be negative")
+	}
+
+	if *frequencyWindow < 0 {
+		fatal("-ntp.frequency-window must not be negative")
+	}
+	if *emaAlpha < 0 || *emaAlpha > 1 {
+		fatal("-ntp.ema-alpha must be between 0 and 1")
+	}
+	if *emaHalfLife < 0 {
+		fatal("-ntp.ema-half-life must not be negative")
+	}
+
+	buckets := HistogramBuckets{RTT: rttBuckets, Offset: offsetBuckets, ScrapeDuration: scrapeDurationBuckets}
+	collector := Collector{
+		NtpReadBufferBytes: *ntpReadBufferBytes,
+		NtpSourcePort:      *ntpSourcePort,
+		NtpDSCP:            *ntpDSCP,
+		NtpDualStack:       *ntpDualStack,
+		Concurrency:        *ntpConcurrency,
+		NtpReferenceServer: *ntpReferenceServer,
+
+		ReportUnreachedServers: *reportUnreached,
+		FailOnError:            *failOnError,
+		EMAAlpha:               *emaAlpha,
+		EMAHalfLife:            *emaHalfLife,
+		EMAMaxGap:              *emaMaxGap,
+		FrequencyWindow:        *frequencyWindow,
+		PollInterval:           *ntpPollInterval,
+		CacheTTL:               *ntpCacheTTL,
+
+		metrics: newMetrics(buckets),
+	}
+	if *breakerThreshold < 0 {
+		fatal("-ntp.circuit-breaker.threshold must not be negative")
+	}
+	if *breakerThreshold > 0 {
+		collector.CircuitBreaker = newCircuitBreaker(*breakerThreshold, *breakerCooldown)
+	}
+	if *ntpRetries < 0 {
+		fatal("-ntp.retries must not be negative")
+	}
+	if *ntpRetryBackoff < 0 {
+		fatal("-ntp.retry-backoff must not be negative")
+	}
+	if *ntpRetryJitter < 0 || *ntpRetryJitter > 1 {
+		fatal("-ntp.retry-jitter must be between 0 and 1")
+	}
+	collector.Retry = retryPolicy{
+		Attempts: *ntpRetries,
+		Backoff:  *ntpRetryBackoff,
+		//waiting longer than a query may take is pointless
+		MaxDelay: *ntpTimeout,
+		Jitter:   *ntpRetryJitter,
+	}
+	if *kissOfDeathCooldown < 0 {
+		fatal("-ntp.kiss-of-death.cooldown must not be negative")
+	}
+	if *kissOfDeathCooldown > 0 {
+		collector.KissOfDeath = newKissOfDeathBackoff(*kissOfDeathCooldown)
+	}
+	if *ntpHighDriftThreshold <= 0 {
+		fatal("-ntp.high-drift-threshold must be positive")
+	}
+	if *ntpDriftThreshold < 0 {
+		fatal("-ntp.drift-threshold must not be negative")
+	}
+	if *ntpMaxStratum < 0 || *ntpMaxStratum > 15 {
+		fatal("-ntp.max-stratum must be between 0 and 15")
+	}
+	if *ntpMaxRootDistance <= 0 {
+		fatal("-ntp.max-root-distance must be positive")
+	}
+	if *ntpMeasurementSamples < 0 {
+		fatal("-ntp.measurement-samples must not be negative")
+	}
+	if *ntpMeasurementInterval < 0 {
+		fatal("-ntp.measurement-interval must not be negative")
+	}
+	if _, exists := aggregationStrategies[*ntpAggregation]; !exists {
+		fatal("invalid -ntp.aggregation", "value", *ntpAggregation)
+	}
+	if _, exists := addressFamilies[*ntpAddressFamily]; !exists {
+		fatal("invalid -ntp.address-family", "value", *ntpAddressFamily)
+	}
+	//settings for all servers, unless overridden for a specific server
+	defaultServer := Server{
+		ProtocolVersion:     *ntpProtocolVersion,
+		Timeout:             *ntpTimeout,
+		MeasurementDuration: *ntpMeasurementDuration,
+		HighDriftThreshold:  *ntpHighDriftThreshold,
+		DriftThreshold:      *ntpDriftThreshold,
+		MaxStratum:          *ntpMaxStratum,
+		MaxRootDistance:     *ntpMaxRootDistance,
+		Aggregation:         *ntpAggregation,
+		MeasurementSamples:  *ntpMeasurementSamples,
+		MeasurementInterval: *ntpMeasurementInterval,
+		NTS:                 *ntpNTS,
+		Interleaved:         *ntpInterleaved,
+		SourceAddress:       sourceAddress,
+		AddressFamily:       *ntpAddressFamily,
+	}
+	for _, address := range ntpServers {
+		s := defaultServer
+		s.Address = address
+		if version, exists := ntpServerProtocolVersions[address]; exists {
+			validateProtocolVersion(version)
+			s.ProtocolVersion = version
+		}
+		if timeout, exists := ntpServerTimeouts[address]; exists {
+			s.Timeout = timeout
+		}
+		s.Fallbacks = ntpServerFallbacks[address]
+		collector.Servers = append(collector.Servers, s)
+	}
+	for _, address := range ntpPools {
+		s := defaultServer
+		s.Address = address
+		s.Pool = true
+		collector.Servers = append(collector.Servers, s)
+	}
+	for _, domain := range ntpSRVDomains {
+		s := defaultServer
+		s.Address = domain
+		s.SRV = true
+		collector.Servers = append(collector.Servers, s)
+	}
+	for _, s := range collector.Servers {
+		if s.ProtocolVersion == 5 && s.NTS {
+			fatal("cannot query server with NTS and protocol version 5", "server", s.Address)
+		}
+		if s.Interleaved && s.NTS {
+			fatal("cannot query server with NTS in interleaved mode", "server", s.Address)
+		}
+	}
+	for address := range ntpServerProtocolVersions {
+		if !ntpServers.contains(address) {
+			fatal("-ntp.server-protocol-version given for a server that is not configured with -ntp.server", "server", address)
+		}
+	}
+	for address := range ntpServerTimeouts {
+		if !ntpServers.contains(address) {
+			fatal("-ntp.server-timeout given for a server that is not configured with -ntp.server", "server", address)
+		}
+	}
+	for address := range ntpServerFallbacks {
+		if !ntpServers.contains(address) {
+			fatal("-ntp.server-fallback given for a server that is not configured with -ntp.server", "server", address)
+		}
+	}
+
+	if *configFile != "" {
+		collector.Config = &configReloader{
+			Path:            *configFile,
+			Defaults:        defaultServer,
+			StaticServers:   collector.Servers,
+			ReferenceServer: *ntpReferenceServer,
+		}
+		err := collector.Config.Reload()
+		if err != nil {
+			fatal("cannot load config file", "err", err)
+		}
+	} else {
+		configLastReloadTimestamp.SetToCurrentTime()
+		configLastReloadSuccessful.Set(1)
+	}
+	if len(ntpFileSD) > 0 {
+		collector.Discoverers = append(collector.Discoverers, &fileSD{
+			Patterns:   ntpFileSD,
+			Defaults:   defaultServer,
+			ReadErrors: collector.fileSDReadErrors,
+		})
+	}
+	if *consulService != "" {
+		collector.Discoverers = append(collector.Discoverers, &consulSD{
+			Address:  *consulAddress,
+			Service:  *consulService,
+			Tag:      *consulTag,
+			Token:    os.Getenv("CONSUL_HTTP_TOKEN"),
+			Timeout:  *consulTimeout,
+			Defaults: defaultServer,
+		})
+		prometheus.MustRegister(consulSDErrors)
+	}
+	if *ntpReferenceServer != "" && !hasServer(collector.servers(), *ntpReferenceServer) {
+		fatal("-ntp.reference-server is not configured with -ntp.server or in -config.file", "server", *ntpReferenceServer)
+	}
+
+	if checkMode {
+		os.Exit(runCheck(collector, checkThresholds{
+			OffsetWarning:   *checkOffsetWarning,
+			OffsetCritical:  *checkOffsetCritical,
+			StratumWarning:  *checkStratumWarning,
+			StratumCritical: *checkStratumCritical,
+		}, os.Stdout))
+	}
+
+	if *dryRunMode {
+		if len(collector.servers()) == 0 {
+			fatal("no NTP server specified, see -ntp.server, -ntp.pool, -ntp.srv-domain, -ntp.file-sd, -consul.service and -config.file")
+		}
+		ok, err := dryRun(collector, *outputFormat, os.Stdout)
+		if err != nil {
+			fatal("dry run failed", "err", err)
+		}
+		if !ok {
+			os.Exit(1)
+		}
 		os.Exit(0)
 	}
 
-	if *ntpServer == "" {
-		log.Fatalln("no NTP server specified, see -ntp.server")
+	slog.Info("starting ntp_exporter", "version", version.Version, "revision", version.Revision, "branch", version.Branch)
+	slog.Info("build context", "go", version.GoVersion, "user", version.BuildUser, "date", version.BuildDate)
+	prometheus.MustRegister(version.NewCollector("ntp_exporter"))
+	prometheus.MustRegister(configLastReloadTimestamp, configLastReloadSuccessful)
+	prometheus.MustRegister(&clockStepCollector{Threshold: *clockStepThreshold})
+	if *chronyAddress != "" {
+		prometheus.MustRegister(chronyCollector{
+			Client: chronyClient{Address: *chronyAddress, Timeout: *chronyTimeout},
+		})
+	}
+	if *ntpdAddress != "" {
+		prometheus.MustRegister(ntpdCollector{
+			Client: ntpdClient{Address: *ntpdAddress, Timeout: *ntpdTimeout},
+		})
+	}
+	if *timexEnabled || *timexPPS {
+		if runtime.GOOS != "linux" {
+			fatal("-timex is only supported on Linux")
+		}
+		prometheus.MustRegister(timexCollector{PPS: *timexPPS})
+	}
+	if *ptpSocket != "" || *ptpPHCDevice != "" {
+		if *ptpDomain > 255 {
+			fatal("-ptp.domain must be between 0 and 255")
+		}
+		prometheus.MustRegister(ptpCollector{
+			Client:    ptpClient{Socket: *ptpSocket, Domain: uint8(*ptpDomain), Timeout: *ptpTimeout},
+			PHCDevice: *ptpPHCDevice,
+		})
+	}
+	if len(roughtimeServers) > 0 {
+		prometheus.MustRegister(roughtimeCollector{Servers: roughtimeServers, Timeout: *roughtimeTimeout})
+	}
+	if *rtcDevice != "" {
+		if runtime.GOOS != "linux" {
+			fatal("-rtc.device is only supported on Linux")
+		}
+		prometheus.MustRegister(rtcCollector{Device: *rtcDevice})
+	}
+	if *leapFile != "" {
+		prometheus.MustRegister(leapCollector{
+			Path:            *leapFile,
+			ScheduledWindow: *leapScheduledWindow,
+			CheckKernel:     runtime.GOOS == "linux",
+		})
+	}
+	if *timesyncdEnabled {
+		prometheus.MustRegister(timesyncdCollector{Timeout: *timesyncdTimeout})
+	}
+	instanceLabelValue := ""
+	if *instanceLabel != "" {
+		var err error
+		instanceLabelValue, err = getInstanceLabelValue(*instanceLabel)
+		if err != nil {
+			fatal("cannot determine value of instance label", "err", err)
+		}
+	}
+	if *onceMode {
+		//the metrics of this short-lived process are of no interest, and
+		//would collide with those of the node_exporter in its textfile collector
+		prometheus.Unregister(prometheus.NewGoCollector())
+		prometheus.Unregister(prometheus.NewProcessCollector(os.Getpid(), ""))
+		err := writeMetricsOnce(collector, instanceLabelValue, *outputFile)
+		if err != nil {
+			fatal("cannot write metrics", "err", err)
+		}
+		os.Exit(0)
 	}
-	if *ntpProtocolVersion < 2 || *ntpProtocolVersion > 4 {
-		log.Fatalf("invalid NTP protocol version %d; must be 2, 3, or 4", *ntpProtocolVersion)
+
+	//on shutdown, running measurements are cut short, so that scrapes and
+	//pushes can finish quickly
+	ctx, stopSignals := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stopSignals()
+	collector.Context = ctx
+	var pushes sync.WaitGroup
+	runPushes := func(run func(context.Context)) {
+		pushes.Add(1)
+		go func() {
+			defer pushes.Done()
+			run(ctx)
+		}()
 	}
 
-	log.Infoln("starting ntp_exporter", version)
-	prometheus.MustRegister(Collector{*ntpServer, *ntpProtocolVersion, *ntpMeasurementDuration})
-	handler := promhttp.HandlerFor(prometheus.DefaultGatherer,
-		promhttp.HandlerOpts{ErrorLog: log.NewErrorLogger()})
+	if collector.Config != nil {
+		go reloadOnSIGHUP(collector)
+	}
+	if collector.PollInterval > 0 {
+		go collector.Poll()
+	} else {
+		//the servers are measured during each scrape, but measure them once
+		//right away, so that /-/ready does not wait for the first scrape
+		go collector.update()
+	}
+	if *pushURL != "" {
+		runPushes(pusher{
+			Collector:     collector,
+			URL:           *pushURL,
+			Job:           *pushJob,
+			Instance:      *pushInstance,
+			Interval:      *pushInterval,
+			InstanceLabel: instanceLabelValue,
+		}.Run)
+	}
+	if remoteWriter != nil {
+		remoteWriter.Collector = collector
+		remoteWriter.InstanceLabel = instanceLabelValue
+		runPushes(remoteWriter.Run)
+	}
+	if otlpExporter != nil {
+		otlpExporter.Collector = collector
+		otlpExporter.InstanceLabel = instanceLabelValue
+		runPushes(otlpExporter.Run)
+	}
+	handler := metricsHandler{
+		Collector:     collector,
+		TimeoutOffset: *timeoutOffset,
+		InstanceLabel: instanceLabelValue,
+	}
 
 	http.Handle(*metricsPath, prometheus.InstrumentHandler("prometheus", handler))
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte(`<html>
-			<head><title>NTP Exporter</title></head>
-			<body>
-			<h1>NTP Exporter</h1>
-			<p><a href="` + *metricsPath + `">Metrics</a></p>
-			</body>
-			</html>`))
+	http.Handle("/probe", probeHandler{
+		Collector:     collector,
+		Server:        defaultServer,
+		Buckets:       buckets,
+		TimeoutOffset: *timeoutOffset,
+		InstanceLabel: instanceLabelValue,
+	})
+	http.Handle("/debug/ntp", debugHandler{
+		Collector:     collector,
+		Server:        defaultServer,
+		Buckets:       buckets,
+		TimeoutOffset: *timeoutOffset,
 	})
+	http.Handle("/api/v1/status", statusHandler{collector})
+	http.Handle("/targets", targetsHandler{collector})
+	http.Handle("/-/reload", reloadHandler{collector})
+	http.Handle("/-/healthy", healthyHandler{})
+	http.Handle("/-/ready", readyHandler{collector})
+	http.Handle("/", landingPageHandler{Collector: collector, MetricsPath: *metricsPath})
+
+	server, err := newHTTPServer(*listenAddress, *webConfigFile)
+	if err != nil {
+		fatal("cannot load web config", "err", err)
+	}
+	listener, err := systemdListener()
+	if err != nil {
+		fatal("cannot use socket from systemd", "err", err)
+	}
+	go func() {
+		if listener != nil {
+			slog.Info("listening on socket from systemd", "address", listener.Addr().String())
+		} else {
+			slog.Info("listening", "address", *listenAddress)
+		}
+		err := serveHTTP(server, listener)
+		if err != http.ErrServerClosed {
+			fatal("cannot serve HTTP", "err", err)
+		}
+	}()
+	go notifySystemd(ctx, collector)
+
+	<-ctx.Done()
+	//a second signal terminates the process right away
+	stopSignals()
+	err = sdNotify("STOPPING=1")
+	if err != nil {
+		slog.Error("cannot notify systemd", "err", err)
+	}
+	slog.Info("shutting down", "timeout", *shutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	err = server.Shutdown(shutdownCtx)
+	if err != nil {
+		slog.Error("cannot shut down HTTP server gracefully", "err", err)
+	}
+	pushesDone := make(chan struct{})
+	go func() {
+		pushes.Wait()
+		close(pushesDone)
+	}()
+	select {
+	case <-pushesDone:
+	case <-shutdownCtx.Done():
+		slog.Error("pushes did not finish before the shutdown timeout")
+	}
+}
 
-	log.Infoln("listening on", *listenAddress)
-	err := http.ListenAndServe(*listenAddress, nil)
+func validateProtocolVersion(version int) {
+	err := checkProtocolVersion(version)
 	if err != nil {
-		log.Fatal(err)
+		fatal("invalid protocol version", "err", err)
+	}
+}
+
+func hasServer(servers []Server, address string) bool {
+	for _, s := range servers {
+		if s.Address == address {
+			return true
+		}
 	}
+	return false
 }
@@ -0,0 +1,823 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+* Copyright 2015 The Prometheus Authors
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var (
+	defaultRTTBuckets    = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1}
+	defaultOffsetBuckets = []float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 1}
+	//measurements in case of high drift take up to -ntp.measurement-duration
+	defaultScrapeDurationBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+)
+
+// measurementFailedDesc is used for reporting failed measurements as scrape
+// errors (see Collector.FailOnError).
+var measurementFailedDesc = prometheus.NewDesc(
+	"ntp_measurement_failed",
+	"Measurement of an NTP server failed (never exported, only reported as a scrape error).",
+	nil, nil,
+)
+
+// HistogramBuckets contains the bucket boundaries for the histogram metrics.
+type HistogramBuckets struct {
+	RTT            []float64
+	Offset         []float64
+	ScrapeDuration []float64
+}
+
+// metrics contains the metrics reported by a Collector. Each Collector has its
+// own set of metrics, so that e.g. measurements for /probe requests do not
+// show up on /metrics.
+type metrics struct {
+	serverIsUp                 *prometheus.GaugeVec
+	serverUsable               *prometheus.GaugeVec
+	drift                      *prometheus.GaugeVec
+	driftExceedsThreshold      *prometheus.GaugeVec
+	rtt                        *prometheus.GaugeVec
+	minError                   *prometheus.GaugeVec
+	rootDelay                  *prometheus.GaugeVec
+	rootDispersion             *prometheus.GaugeVec
+	rootDistance               *prometheus.GaugeVec
+	rootDistanceExceedsMaximum *prometheus.GaugeVec
+	leapIndicator              *prometheus.GaugeVec
+	precision                  *prometheus.GaugeVec
+	pollInterval               *prometheus.GaugeVec
+	referenceTimeAge           *prometheus.GaugeVec
+	responseValid              *prometheus.GaugeVec
+	referenceInfo              *infoVec
+	kissCode                   *infoVec
+	stratum                    *prometheus.GaugeVec
+	stratumExceedsMaximum      *prometheus.GaugeVec
+	scrapeDuration             *prometheus.HistogramVec
+	highDriftLoopDuration      *prometheus.GaugeVec
+	offsetUpperBound           *prometheus.GaugeVec
+	offsetLowerBound           *prometheus.GaugeVec
+	ipDivergence               *prometheus.GaugeVec
+	familyDrift                *prometheus.GaugeVec
+	droppedResponses           *prometheus.CounterVec
+	queryRetries               *prometheus.CounterVec
+	queries                    *prometheus.CounterVec
+	lastSuccess                *prometheus.GaugeVec
+	offsetJitter               *prometheus.GaugeVec
+	offsetMin                  *prometheus.GaugeVec
+	offsetMax                  *prometheus.GaugeVec
+	offsetFromReference        *prometheus.GaugeVec
+	replayedResponses          *prometheus.CounterVec
+	fileSDReadErrors           *prometheus.CounterVec
+	measurementConfidence      *prometheus.GaugeVec
+	bestServerInfo             *prometheus.GaugeVec
+	consensusOffset            *prometheus.GaugeVec
+	consensusAgrees            *prometheus.GaugeVec
+	queryRTT                   *prometheus.HistogramVec
+	queryAbsOffset             *prometheus.HistogramVec
+	offsetEMA                  *prometheus.GaugeVec
+	driftSmoothed              *prometheus.GaugeVec
+	frequencyOffset            *prometheus.GaugeVec
+	allanDeviation             *prometheus.GaugeVec
+	allanDeviationTau          *prometheus.GaugeVec
+	ntsEnabled                 *prometheus.GaugeVec
+	ntsCookieCount             *prometheus.GaugeVec
+	protocolVersion            *prometheus.GaugeVec
+	interleaved                *prometheus.GaugeVec
+	poolMemberCount            *prometheus.GaugeVec
+	poolMemberInfo             *infoVec
+	srvTargetCount             *prometheus.GaugeVec
+	srvTargetInfo              *infoVec
+	addressInfo                *infoVec
+	fallbackActive             *prometheus.GaugeVec
+	serverUsed                 *infoVec
+
+	//emaStates contains the state of ntp_offset_ema_seconds for each server
+	//(see updateEMA)
+	emaStates struct {
+		sync.Mutex
+		ByServer map[string]emaState
+	}
+	//smoothedDriftStates contains the state of ntp_drift_seconds_smoothed
+	//for each server (see updateSmoothedDrift)
+	smoothedDriftStates struct {
+		sync.Mutex
+		ByServer map[string]emaState
+	}
+	//reachedServers contains all servers that have been measured
+	//successfully at least once since this collector was created
+	reachedServers struct {
+		sync.Mutex
+		Set map[string]bool
+	}
+	//cache remembers when the metrics were last updated (for -ntp.cache-ttl)
+	cache struct {
+		sync.Mutex
+		LastUpdate time.Time
+	}
+	//measured contains the labels of the servers that were measured in the
+	//last update (see Collector.rememberMeasured)
+	measured struct {
+		sync.Mutex
+		Labels map[string]map[string]string
+	}
+	//discovered contains the servers found behind each NTP pool and SRV
+	//domain from the last time that they were resolved, so that the metrics
+	//of servers that disappeared can be removed (see expandServers)
+	discovered struct {
+		sync.Mutex
+		ByPool map[string][]string
+		BySRV  map[string][]string
+	}
+	//offsetHistories contains the offsets of each server within the last
+	//Collector.FrequencyWindow, for ntp_frequency_offset_ppm and
+	//ntp_allan_deviation (see updateFrequency)
+	offsetHistories struct {
+		sync.Mutex
+		ByServer map[string][]offsetSample
+	}
+	//createdAt is when these metrics were created, and seriesCreated contains
+	//when the series of each server were created, for the _created samples of
+	//counters in the OpenMetrics format (see createdTimestamp)
+	createdAt     time.Time
+	seriesCreated struct {
+		sync.Mutex
+		ByServer map[string]time.Time
+	}
+	//scrapeExemplars contains the last observation of
+	//ntp_scrape_duration_seconds for each server that was made for a traced
+	//request (see Collector.TraceID)
+	scrapeExemplars struct {
+		sync.Mutex
+		ByServer map[string]openMetricsExemplar
+	}
+	//status contains the result of the last measurement of each server (for
+	//the landing page)
+	status struct {
+		sync.Mutex
+		ByServer map[string]serverStatus
+	}
+	//ready is set once all servers were measured for the first time, either
+	//in the background or during a scrape (for /-/ready)
+	ready struct {
+		sync.Mutex
+		Done bool
+	}
+}
+
+// serverStatus is the result of the last measurement of a server.
+type serverStatus struct {
+	Time         time.Time
+	LastSuccess  time.Time
+	Offset       float64
+	Stratum      float64
+	RTT          float64
+	RootDistance float64
+	ReferenceID  string
+	Error        string //empty if the measurement was successful
+}
+
+// setStatus records the result of a measurement of the given server. For
+// failed measurements, the time of the last success is kept.
+func (m *metrics) setStatus(address string, status serverStatus) {
+	m.status.Lock()
+	defer m.status.Unlock()
+	if m.status.ByServer == nil {
+		m.status.ByServer = make(map[string]serverStatus)
+	}
+	if status.Error != "" {
+		status.LastSuccess = m.status.ByServer[address].LastSuccess
+	}
+	m.status.ByServer[address] = status
+}
+
+// setSeriesCreated records that the series of the given server were created
+// at `now`, unless they already exist.
+func (m *metrics) setSeriesCreated(address string, now time.Time) {
+	m.seriesCreated.Lock()
+	defer m.seriesCreated.Unlock()
+	if m.seriesCreated.ByServer == nil {
+		m.seriesCreated.ByServer = make(map[string]time.Time)
+	}
+	if _, exists := m.seriesCreated.ByServer[address]; !exists {
+		m.seriesCreated.ByServer[address] = now
+	}
+}
+
+// createdTimestamp implements the openMetricsExtras interface. It knows the
+// counters of these metrics by their "server" label.
+func (m *metrics) createdTimestamp(family string, metric *dto.Metric) (time.Time, bool) {
+	address := getLabelValue(metric, "server")
+	if !strings.HasPrefix(family, "ntp_") || address == "" {
+		return time.Time{}, false
+	}
+	m.seriesCreated.Lock()
+	defer m.seriesCreated.Unlock()
+	created, exists := m.seriesCreated.ByServer[address]
+	if !exists {
+		return m.createdAt, true
+	}
+	return created, true
+}
+
+func (m *metrics) setScrapeExemplar(address string, exemplar openMetricsExemplar) {
+	m.scrapeExemplars.Lock()
+	defer m.scrapeExemplars.Unlock()
+	if m.scrapeExemplars.ByServer == nil {
+		m.scrapeExemplars.ByServer = make(map[string]openMetricsExemplar)
+	}
+	m.scrapeExemplars.ByServer[address] = exemplar
+}
+
+// exemplar implements the openMetricsExtras interface.
+func (m *metrics) exemplar(family string, metric *dto.Metric) (openMetricsExemplar, bool) {
+	if family != "ntp_scrape_duration_seconds" {
+		return openMetricsExemplar{}, false
+	}
+	m.scrapeExemplars.Lock()
+	defer m.scrapeExemplars.Unlock()
+	exemplar, exists := m.scrapeExemplars.ByServer[getLabelValue(metric, "server")]
+	return exemplar, exists
+}
+
+// measurementErrors returns the errors from the last measurement of each
+// server that could not be measured, ordered by server.
+func (m *metrics) measurementErrors() []error {
+	m.status.Lock()
+	defer m.status.Unlock()
+	addresses := make([]string, 0, len(m.status.ByServer))
+	for address, status := range m.status.ByServer {
+		if status.Error != "" {
+			addresses = append(addresses, address)
+		}
+	}
+	sort.Strings(addresses)
+	errs := make([]error, len(addresses))
+	for idx, address := range addresses {
+		errs[idx] = errors.New(m.status.ByServer[address].Error)
+	}
+	return errs
+}
+
+// serverLabels returns the labels of the given server from the last update.
+func (m *metrics) serverLabels(address string) map[string]string {
+	m.measured.Lock()
+	defer m.measured.Unlock()
+	return m.measured.Labels[address]
+}
+
+func newMetrics(buckets HistogramBuckets) *metrics {
+	return &metrics{
+		createdAt: time.Now(),
+		serverIsUp: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "ntp",
+			Name:      "server_is_up",
+			Help:      "Ntp server is functionnal or not.",
+		}, []string{"server"}),
+		serverUsable: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "ntp",
+			Name:      "server_usable",
+			Help:      "Whether the NTP server is reachable, synchronized (leap indicator is not 3) and reports a valid stratum (1-15).",
+		}, []string{"server"}),
+		drift: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "ntp",
+			Name:      "drift_seconds",
+			Help:      "Difference between system time and NTP time.",
+		}, []string{"server"}),
+		driftExceedsThreshold: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "ntp",
+			Name:      "drift_exceeds_threshold",
+			Help:      "Whether the absolute drift exceeds the drift threshold of the NTP server (only if a threshold is configured).",
+		}, []string{"server"}),
+		rtt: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "ntp",
+			Name:      "rtt_seconds",
+			Help:      "Round-trip time of the NTP query (median if multiple measurements were taken).",
+		}, []string{"server"}),
+		minError: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "ntp",
+			Name:      "min_error_seconds",
+			Help:      "Lower bound on the error of the clock offset, derived from causality violations between the timestamps of the NTP response (0 if there are none).",
+		}, []string{"server"}),
+		rootDelay: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "ntp",
+			Name:      "root_delay_seconds",
+			Help:      "Total round-trip delay from the NTP server to the reference clock, as reported by the server.",
+		}, []string{"server"}),
+		rootDispersion: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "ntp",
+			Name:      "root_dispersion_seconds",
+			Help:      "Total dispersion from the NTP server to the reference clock, as reported by the server.",
+		}, []string{"server"}),
+		rootDistance: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "ntp",
+			Name:      "root_distance_seconds",
+			Help:      "Estimate of the maximum error of the NTP time, computed from the root delay, root dispersion and round-trip time.",
+		}, []string{"server"}),
+		rootDistanceExceedsMaximum: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "ntp",
+			Name:      "root_distance_exceeds_maximum",
+			Help:      "Whether the root distance of the NTP server is above the maximum root distance configured for it (MAXDIST from RFC 5905 by default).",
+		}, []string{"server"}),
+		leapIndicator: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "ntp",
+			Name:      "leap_indicator",
+			Help:      "Leap indicator reported by the NTP server (0 = no warning, 1 = last minute of the day has 61 seconds, 2 = last minute of the day has 59 seconds, 3 = not synchronized).",
+		}, []string{"server"}),
+		precision: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "ntp",
+			Name:      "precision_seconds",
+			Help:      "Precision of the NTP server's clock, as reported by the server.",
+		}, []string{"server"}),
+		pollInterval: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "ntp",
+			Name:      "poll_interval_seconds",
+			Help:      "Maximum interval between successive NTP queries that the NTP server requested in its response.",
+		}, []string{"server"}),
+		referenceInfo: newInfoVec(prometheus.GaugeOpts{
+			Namespace: "ntp",
+			Name:      "reference_info",
+			Help:      "Has the value 1 for the reference ID reported by the NTP server, i.e. the upstream source that the server is synchronized to.",
+		}, "ref_id"),
+		referenceTimeAge: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "ntp",
+			Name:      "reference_time_age_seconds",
+			Help:      "Time since the NTP server last updated its clock from its reference source, as seen by the server.",
+		}, []string{"server"}),
+		kissCode: newInfoVec(prometheus.GaugeOpts{
+			Namespace: "ntp",
+			Name:      "kiss_code",
+			Help:      "Has the value 1 for the kiss code of a kiss-of-death packet sent by the NTP server.",
+		}, "code"),
+		responseValid: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "ntp",
+			Name:      "response_valid",
+			Help:      "Whether the NTP response passed the sanity checks of the NTP client library (valid stratum and leap indicator, fresh reference time, sane root dispersion).",
+		}, []string{"server"}),
+		stratum: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "ntp",
+			Name:      "stratum",
+			Help:      "Stratum of NTP server.",
+		}, []string{"server"}),
+		stratumExceedsMaximum: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "ntp",
+			Name:      "stratum_exceeds_maximum",
+			Help:      "Whether the NTP server reports a stratum above the maximum stratum configured for it (only if a maximum is configured).",
+		}, []string{"server"}),
+		scrapeDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "ntp",
+			Name:      "scrape_duration_seconds",
+			Help:      "Duration of the measurement of each NTP server, including failed measurements.",
+			Buckets:   buckets.ScrapeDuration,
+		}, []string{"server"}),
+		highDriftLoopDuration: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "ntp",
+			Name:      "high_drift_loop_duration_seconds",
+			Help:      "Time spent taking repeated measurements because of high drift (0 if the drift was not high).",
+		}, []string{"server"}),
+		offsetUpperBound: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "ntp",
+			Name:      "offset_upper_bound_seconds",
+			Help:      "Clock offset plus root distance, i.e. the upper bound of the interval that contains the true offset.",
+		}, []string{"server"}),
+		offsetLowerBound: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "ntp",
+			Name:      "offset_lower_bound_seconds",
+			Help:      "Clock offset minus root distance, i.e. the lower bound of the interval that contains the true offset.",
+		}, []string{"server"}),
+		ipDivergence: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "ntp",
+			Name:      "ipv4_ipv6_offset_divergence_seconds",
+			Help:      "Clock offset measured over IPv4 minus clock offset measured over IPv6 (only with -ntp.dual-stack).",
+		}, []string{"server"}),
+		familyDrift: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "ntp",
+			Name:      "address_family_drift_seconds",
+			Help:      "Difference between system time and NTP time, measured over IPv4 (af=\"ipv4\") or IPv6 (af=\"ipv6\") (only with -ntp.dual-stack).",
+		}, []string{"server", "af"}),
+		droppedResponses: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "ntp",
+			Name:      "suspected_dropped_responses_total",
+			Help:      "Number of NTP queries whose response was lost (timeout) or truncated.",
+		}, []string{"server"}),
+		queryRetries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "ntp",
+			Name:      "query_retries_total",
+			Help:      "Number of NTP queries that were retried after a transient failure (see -ntp.retries).",
+		}, []string{"server"}),
+		queries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "ntp",
+			Name:      "queries_total",
+			Help:      "Number of NTP queries by result (\"success\", \"timeout\", \"network_error\", \"invalid_response\" or \"kiss_of_death\").",
+		}, []string{"server", "result"}),
+		lastSuccess: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "ntp",
+			Name:      "last_success_timestamp_seconds",
+			Help:      "Unix timestamp of the last successful measurement of the NTP server.",
+		}, []string{"server"}),
+		offsetJitter: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "ntp",
+			Name:      "offset_jitter_seconds",
+			Help:      "Standard deviation of the clock offsets of the samples of the last measurement (only if multiple samples were taken because of high drift).",
+		}, []string{"server"}),
+		offsetMin: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "ntp",
+			Name:      "offset_min_seconds",
+			Help:      "Lowest clock offset among the samples of the last measurement (only if multiple samples were taken because of high drift).",
+		}, []string{"server"}),
+		offsetMax: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "ntp",
+			Name:      "offset_max_seconds",
+			Help:      "Highest clock offset among the samples of the last measurement (only if multiple samples were taken because of high drift).",
+		}, []string{"server"}),
+		offsetFromReference: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "ntp",
+			Name:      "offset_from_reference_seconds",
+			Help:      "Clock offset of the NTP server minus clock offset of the trusted reference server (only with -ntp.reference-server).",
+		}, []string{"server", "reference"}),
+		fileSDReadErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "ntp_exporter",
+			Name:      "file_sd_read_errors_total",
+			Help:      "Number of times that a file given with -ntp.file-sd could not be read or parsed.",
+		}, []string{"path"}),
+		replayedResponses: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "ntp",
+			Name:      "replayed_responses_total",
+			Help:      "Number of NTP responses whose origin timestamp did not match any recent query.",
+		}, []string{"server"}),
+		measurementConfidence: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "ntp",
+			Name:      "measurement_confidence",
+			Help:      "Score between 0 and 1 describing how much the reported drift can be trusted, based on the number of samples, their agreement and their round-trip times.",
+		}, []string{"server"}),
+		bestServerInfo: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "ntp",
+			Name:      "best_server_info",
+			Help:      "Has the value 1 for the usable NTP server with the lowest root distance.",
+		}, []string{"server"}),
+		consensusOffset: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "ntp",
+			Name:      "consensus_offset_seconds",
+			Help:      "Median drift of the NTP servers that agree with the majority of servers (not reported if no majority agrees).",
+		}, []string{}),
+		consensusAgrees: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "ntp",
+			Name:      "consensus_agrees",
+			Help:      "Whether the NTP server agrees with the majority of servers (0 means that it is a falseticker).",
+		}, []string{"server"}),
+		queryRTT: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "ntp",
+			Name:      "query_rtt_seconds",
+			Help:      "Round-trip time of individual NTP queries.",
+			Buckets:   buckets.RTT,
+		}, []string{"server"}),
+		queryAbsOffset: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "ntp",
+			Name:      "query_abs_offset_seconds",
+			Help:      "Absolute clock offset measured by individual NTP queries.",
+			Buckets:   buckets.Offset,
+		}, []string{"server"}),
+		offsetEMA: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "ntp",
+			Name:      "offset_ema_seconds",
+			Help:      "Exponential moving average of the drift across scrapes (only with -ntp.ema-alpha).",
+		}, []string{"server"}),
+		driftSmoothed: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "ntp",
+			Name:      "drift_seconds_smoothed",
+			Help:      "Exponentially weighted moving average of the drift across scrapes (only with -ntp.ema-half-life).",
+		}, []string{"server"}),
+		frequencyOffset: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "ntp",
+			Name:      "frequency_offset_ppm",
+			Help:      "Frequency error of the local clock in ppm (positive if it runs fast), estimated from the change of the drift over time (only with -ntp.frequency-window).",
+		}, []string{"server"}),
+		allanDeviation: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "ntp",
+			Name:      "allan_deviation",
+			Help:      "Allan deviation of the drift within -ntp.frequency-window, at the averaging time in ntp_allan_deviation_tau_seconds.",
+		}, []string{"server"}),
+		allanDeviationTau: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "ntp",
+			Name:      "allan_deviation_tau_seconds",
+			Help:      "Averaging time of ntp_allan_deviation, i.e. the mean interval between measurements within -ntp.frequency-window.",
+		}, []string{"server"}),
+		ntsEnabled: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "ntp",
+			Name:      "nts_enabled",
+			Help:      "Whether the NTP server is queried with Network Time Security (NTS).",
+		}, []string{"server"}),
+		ntsCookieCount: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "ntp",
+			Name:      "nts_cookie_count",
+			Help:      "Number of unused NTS cookies for the NTP server (only for servers queried with NTS).",
+		}, []string{"server"}),
+		protocolVersion: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "ntp",
+			Name:      "protocol_version",
+			Help:      "NTP protocol version of the last response from the NTP server (5 if NTPv5 was negotiated).",
+		}, []string{"server"}),
+		interleaved: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "ntp",
+			Name:      "interleaved",
+			Help:      "Whether the last query to the NTP server was measured in interleaved mode.",
+		}, []string{"server"}),
+		poolMemberCount: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "ntp",
+			Name:      "pool_members",
+			Help:      "Number of addresses that the NTP pool hostname resolved to.",
+		}, []string{"pool"}),
+		poolMemberInfo: newInfoVec(prometheus.GaugeOpts{
+			Namespace: "ntp",
+			Name:      "pool_member_info",
+			Help:      "Has the value 1 for each address of an NTP pool, with the pool hostname in the \"pool\" label.",
+		}, "pool"),
+		srvTargetCount: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "ntp",
+			Name:      "srv_targets",
+			Help:      "Number of NTP servers found in the _ntp._udp SRV records of the domain.",
+		}, []string{"domain"}),
+		srvTargetInfo: newInfoVec(prometheus.GaugeOpts{
+			Namespace: "ntp",
+			Name:      "srv_target_info",
+			Help:      "Has the value 1 for each NTP server found in SRV records, with the domain in the \"domain\" label.",
+		}, "domain"),
+		addressInfo: newInfoVec(prometheus.GaugeOpts{
+			Namespace: "ntp",
+			Name:      "server_address_info",
+			Help:      "Has the value 1, with the IP address that the NTP server hostname resolved to (and that answered the last query) in the \"ip\" label.",
+		}, "ip"),
+		fallbackActive: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "ntp",
+			Name:      "fallback_active",
+			Help:      "Whether the NTP server could not be queried, so that one of its fallback servers was measured instead (only for servers with fallbacks).",
+		}, []string{"server"}),
+		serverUsed: newInfoVec(prometheus.GaugeOpts{
+			Namespace: "ntp",
+			Name:      "server_used_info",
+			Help:      "Has the value 1, with the server that was actually measured (the server itself or one of its fallbacks) in the \"used\" label.",
+		}, "used"),
+	}
+}
+
+func (m *metrics) describe(ch chan<- *prometheus.Desc) {
+	m.serverIsUp.Describe(ch)
+	m.serverUsable.Describe(ch)
+	m.drift.Describe(ch)
+	m.driftExceedsThreshold.Describe(ch)
+	m.rtt.Describe(ch)
+	m.minError.Describe(ch)
+	m.rootDelay.Describe(ch)
+	m.rootDispersion.Describe(ch)
+	m.rootDistance.Describe(ch)
+	m.rootDistanceExceedsMaximum.Describe(ch)
+	m.leapIndicator.Describe(ch)
+	m.precision.Describe(ch)
+	m.pollInterval.Describe(ch)
+	m.referenceTimeAge.Describe(ch)
+	m.responseValid.Describe(ch)
+	m.referenceInfo.Describe(ch)
+	m.kissCode.Describe(ch)
+	m.stratum.Describe(ch)
+	m.stratumExceedsMaximum.Describe(ch)
+	m.scrapeDuration.Describe(ch)
+	m.highDriftLoopDuration.Describe(ch)
+	m.offsetUpperBound.Describe(ch)
+	m.offsetLowerBound.Describe(ch)
+	m.ipDivergence.Describe(ch)
+	m.familyDrift.Describe(ch)
+	m.droppedResponses.Describe(ch)
+	m.queryRetries.Describe(ch)
+	m.queries.Describe(ch)
+	m.lastSuccess.Describe(ch)
+	m.offsetJitter.Describe(ch)
+	m.offsetMin.Describe(ch)
+	m.offsetMax.Describe(ch)
+	m.offsetFromReference.Describe(ch)
+	m.replayedResponses.Describe(ch)
+	m.fileSDReadErrors.Describe(ch)
+	m.measurementConfidence.Describe(ch)
+	m.bestServerInfo.Describe(ch)
+	m.consensusOffset.Describe(ch)
+	m.consensusAgrees.Describe(ch)
+	m.queryRTT.Describe(ch)
+	m.queryAbsOffset.Describe(ch)
+	m.offsetEMA.Describe(ch)
+	m.driftSmoothed.Describe(ch)
+	m.frequencyOffset.Describe(ch)
+	m.allanDeviation.Describe(ch)
+	m.allanDeviationTau.Describe(ch)
+	m.ntsEnabled.Describe(ch)
+	m.ntsCookieCount.Describe(ch)
+	m.protocolVersion.Describe(ch)
+	m.interleaved.Describe(ch)
+	m.poolMemberCount.Describe(ch)
+	m.poolMemberInfo.Describe(ch)
+	m.srvTargetCount.Describe(ch)
+	m.srvTargetInfo.Describe(ch)
+	m.addressInfo.Describe(ch)
+	m.fallbackActive.Describe(ch)
+	m.serverUsed.Describe(ch)
+}
+
+func (m *metrics) collect(ch chan<- prometheus.Metric) {
+	m.serverIsUp.Collect(ch)
+	m.serverUsable.Collect(ch)
+	m.drift.Collect(ch)
+	m.driftExceedsThreshold.Collect(ch)
+	m.rtt.Collect(ch)
+	m.minError.Collect(ch)
+	m.rootDelay.Collect(ch)
+	m.rootDispersion.Collect(ch)
+	m.rootDistance.Collect(ch)
+	m.rootDistanceExceedsMaximum.Collect(ch)
+	m.leapIndicator.Collect(ch)
+	m.precision.Collect(ch)
+	m.pollInterval.Collect(ch)
+	m.referenceTimeAge.Collect(ch)
+	m.responseValid.Collect(ch)
+	m.referenceInfo.Collect(ch)
+	m.kissCode.Collect(ch)
+	m.stratum.Collect(ch)
+	m.stratumExceedsMaximum.Collect(ch)
+	m.scrapeDuration.Collect(ch)
+	m.highDriftLoopDuration.Collect(ch)
+	m.offsetUpperBound.Collect(ch)
+	m.offsetLowerBound.Collect(ch)
+	m.ipDivergence.Collect(ch)
+	m.familyDrift.Collect(ch)
+	m.droppedResponses.Collect(ch)
+	m.queryRetries.Collect(ch)
+	m.queries.Collect(ch)
+	m.lastSuccess.Collect(ch)
+	m.offsetJitter.Collect(ch)
+	m.offsetMin.Collect(ch)
+	m.offsetMax.Collect(ch)
+	m.offsetFromReference.Collect(ch)
+	m.replayedResponses.Collect(ch)
+	m.fileSDReadErrors.Collect(ch)
+	m.measurementConfidence.Collect(ch)
+	m.bestServerInfo.Collect(ch)
+	m.consensusOffset.Collect(ch)
+	m.consensusAgrees.Collect(ch)
+	m.queryRTT.Collect(ch)
+	m.queryAbsOffset.Collect(ch)
+	m.offsetEMA.Collect(ch)
+	m.driftSmoothed.Collect(ch)
+	m.frequencyOffset.Collect(ch)
+	m.allanDeviation.Collect(ch)
+	m.allanDeviationTau.Collect(ch)
+	m.ntsEnabled.Collect(ch)
+	m.ntsCookieCount.Collect(ch)
+	m.protocolVersion.Collect(ch)
+	m.interleaved.Collect(ch)
+	m.poolMemberCount.Collect(ch)
+	m.poolMemberInfo.Collect(ch)
+	m.srvTargetCount.Collect(ch)
+	m.srvTargetInfo.Collect(ch)
+	m.addressInfo.Collect(ch)
+	m.fallbackActive.Collect(ch)
+	m.serverUsed.Collect(ch)
+}
+
+// forgetServer removes all series for the given server, e.g. because it was
+// removed from the configuration.
+func (m *metrics) forgetServer(address string) {
+	m.reachedServers.Lock()
+	delete(m.reachedServers.Set, address)
+	m.reachedServers.Unlock()
+	m.emaStates.Lock()
+	delete(m.emaStates.ByServer, address)
+	m.emaStates.Unlock()
+	m.smoothedDriftStates.Lock()
+	delete(m.smoothedDriftStates.ByServer, address)
+	m.smoothedDriftStates.Unlock()
+	m.serverIsUp.DeleteLabelValues(address)
+	m.stratum.DeleteLabelValues(address)
+	m.stratumExceedsMaximum.DeleteLabelValues(address)
+	m.scrapeDuration.DeleteLabelValues(address)
+	m.serverUsable.DeleteLabelValues(address)
+	m.drift.DeleteLabelValues(address)
+	m.driftExceedsThreshold.DeleteLabelValues(address)
+	m.rtt.DeleteLabelValues(address)
+	m.minError.DeleteLabelValues(address)
+	m.rootDelay.DeleteLabelValues(address)
+	m.rootDispersion.DeleteLabelValues(address)
+	m.rootDistance.DeleteLabelValues(address)
+	m.rootDistanceExceedsMaximum.DeleteLabelValues(address)
+	m.leapIndicator.DeleteLabelValues(address)
+	m.precision.DeleteLabelValues(address)
+	m.pollInterval.DeleteLabelValues(address)
+	m.referenceTimeAge.DeleteLabelValues(address)
+	m.responseValid.DeleteLabelValues(address)
+	m.highDriftLoopDuration.DeleteLabelValues(address)
+	m.offsetUpperBound.DeleteLabelValues(address)
+	m.offsetLowerBound.DeleteLabelValues(address)
+	m.ipDivergence.DeleteLabelValues(address)
+	m.familyDrift.DeleteLabelValues(address, "ipv4")
+	m.familyDrift.DeleteLabelValues(address, "ipv6")
+	m.droppedResponses.DeleteLabelValues(address)
+	m.queryRetries.DeleteLabelValues(address)
+	m.lastSuccess.DeleteLabelValues(address)
+	m.offsetJitter.DeleteLabelValues(address)
+	m.offsetMin.DeleteLabelValues(address)
+	m.offsetMax.DeleteLabelValues(address)
+	for _, result := range queryResults {
+		m.queries.DeleteLabelValues(address, result)
+	}
+	m.replayedResponses.DeleteLabelValues(address)
+	m.measurementConfidence.DeleteLabelValues(address)
+	m.queryRTT.DeleteLabelValues(address)
+	m.queryAbsOffset.DeleteLabelValues(address)
+	m.offsetEMA.DeleteLabelValues(address)
+	m.driftSmoothed.DeleteLabelValues(address)
+	m.frequencyOffset.DeleteLabelValues(address)
+	m.allanDeviation.DeleteLabelValues(address)
+	m.allanDeviationTau.DeleteLabelValues(address)
+	m.ntsEnabled.DeleteLabelValues(address)
+	m.ntsCookieCount.DeleteLabelValues(address)
+	m.protocolVersion.DeleteLabelValues(address)
+	m.interleaved.DeleteLabelValues(address)
+	m.fallbackActive.DeleteLabelValues(address)
+	m.poolMemberCount.DeleteLabelValues(address)
+	m.srvTargetCount.DeleteLabelValues(address)
+	m.referenceInfo.Delete(address)
+	m.kissCode.Delete(address)
+	m.status.Lock()
+	delete(m.status.ByServer, address)
+	m.status.Unlock()
+	m.seriesCreated.Lock()
+	delete(m.seriesCreated.ByServer, address)
+	m.seriesCreated.Unlock()
+	m.scrapeExemplars.Lock()
+	delete(m.scrapeExemplars.ByServer, address)
+	m.scrapeExemplars.Unlock()
+	m.offsetHistories.Lock()
+	delete(m.offsetHistories.ByServer, address)
+	m.offsetHistories.Unlock()
+	m.poolMemberInfo.Delete(address)
+	m.srvTargetInfo.Delete(address)
+	m.addressInfo.Delete(address)
+	m.serverUsed.Delete(address)
+}
+
+// infoVec is a GaugeVec with the labels "server" and one other label, which
+// contains at most one series with the value 1 per server. Unlike resetting a
+// GaugeVec and filling it again, updating an infoVec never makes the series
+// of other servers disappear temporarily.
+type infoVec struct {
+	*prometheus.GaugeVec
+	mutex  sync.Mutex
+	values map[string]string
+}
+
+func newInfoVec(opts prometheus.GaugeOpts, label string) *infoVec {
+	return &infoVec{
+		GaugeVec: prometheus.NewGaugeVec(opts, []string{"server", label}),
+		values:   make(map[string]string),
+	}
+}
+
+// Set replaces the series for the given server.
+func (v *infoVec) Set(server, value string) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if old, exists := v.values[server]; exists && old != value {
+		v.GaugeVec.DeleteLabelValues(server, old)
+	}
+	v.values[server] = value
+	v.GaugeVec.WithLabelValues(server, value).Set(1)
+}
+
+// Delete removes the series for the given server.
+func (v *infoVec) Delete(server string) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if old, exists := v.values[server]; exists {
+		v.GaugeVec.DeleteLabelValues(server, old)
+		delete(v.values, server)
+	}
+}
@@ -0,0 +1,232 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+* Copyright 2015 The Prometheus Authors
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+//This implements the read-only part of the NTP control protocol (mode 6, see
+//RFC 1305 appendix B and RFC 9327) that ntpq uses to query ntpd.
+
+const (
+	ntpdControlHeaderLength = 12
+	ntpdOpReadStatus        = 1
+	ntpdOpReadVariables     = 2
+
+	ntpdResponseBit = 0x80
+	ntpdErrorBit    = 0x40
+	ntpdMoreBit     = 0x20
+)
+
+var ntpdErrorNames = map[uint16]string{
+	1: "unspecified error",
+	2: "authentication failure",
+	3: "invalid message length or format",
+	4: "invalid opcode",
+	5: "unknown association ID",
+	6: "unknown variable name",
+	7: "invalid variable value",
+	8: "administratively prohibited",
+}
+
+// ntpdPeerSelections are the names of the peer selection states, as shown by
+// "ntpq -p" in its tally column.
+var ntpdPeerSelections = []string{"reject", "falsetick", "excess", "outlier", "candidate", "backup", "sys.peer", "pps.peer"}
+
+// ntpdClient queries ntpd with the NTP control protocol. The Address is
+// "host:port", where the port defaults to 123. Note that ntpd refuses control
+// queries from remote hosts when it is configured with "restrict noquery".
+type ntpdClient struct {
+	Address string
+	Timeout time.Duration
+}
+
+// ntpdConn is a connection to ntpd, over which multiple requests can be sent.
+type ntpdConn struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+// Dial opens a connection to ntpd.
+func (c ntpdClient) Dial() (*ntpdConn, error) {
+	address := c.Address
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, "123")
+	}
+	conn, err := net.DialTimeout("udp", address, c.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &ntpdConn{conn, c.Timeout}, nil
+}
+
+// Close closes the connection.
+func (c *ntpdConn) Close() error {
+	return c.conn.Close()
+}
+
+// request sends a control message with the given opcode for the given
+// association (0 for the system itself), and returns the status word and the
+// data of the response. Responses that are split over multiple packets are
+// reassembled.
+func (c *ntpdConn) request(opcode uint8, associationID uint16) (status uint16, data []byte, err error) {
+	err = c.conn.SetDeadline(time.Now().Add(c.timeout))
+	if err != nil {
+		return 0, nil, err
+	}
+
+	req := make([]byte, ntpdControlHeaderLength)
+	req[0] = 2<<3 | 6 //LI = 0, VN = 2, mode = 6 (like ntpq)
+	req[1] = opcode
+	_, err = rand.Read(req[2:4])
+	if err != nil {
+		return 0, nil, err
+	}
+	sequence := binary.BigEndian.Uint16(req[2:])
+	binary.BigEndian.PutUint16(req[6:], associationID)
+	_, err = c.conn.Write(req)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	fragments := make(map[uint16][]byte)
+	received := 0
+	total := -1
+	buf := make([]byte, 2048)
+	for total < 0 || received < total {
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		resp := buf[:n]
+		if n < ntpdControlHeaderLength || resp[0]&0x7 != 6 || resp[1]&ntpdResponseBit == 0 ||
+			resp[1]&0x1f != opcode || binary.BigEndian.Uint16(resp[2:]) != sequence {
+			continue //not a response to our request
+		}
+		status = binary.BigEndian.Uint16(resp[4:])
+		if resp[1]&ntpdErrorBit != 0 {
+			name, exists := ntpdErrorNames[status>>8]
+			if !exists {
+				name = fmt.Sprintf("error code %d", status>>8)
+			}
+			return 0, nil, errors.New("ntpd refused request: " + name)
+		}
+		offset := binary.BigEndian.Uint16(resp[8:])
+		count := int(binary.BigEndian.Uint16(resp[10:]))
+		if ntpdControlHeaderLength+count > n {
+			return 0, nil, fmt.Errorf("ntpd sent a truncated response (%d bytes)", n)
+		}
+		if _, exists := fragments[offset]; !exists {
+			fragments[offset] = append([]byte(nil), resp[ntpdControlHeaderLength:ntpdControlHeaderLength+count]...)
+			received += count
+		}
+		if resp[1]&ntpdMoreBit == 0 {
+			total = int(offset) + count
+		}
+	}
+
+	data = make([]byte, 0, total)
+	for len(data) < total {
+		fragment, exists := fragments[uint16(len(data))]
+		if !exists || len(fragment) == 0 {
+			return 0, nil, errors.New("ntpd sent overlapping response fragments")
+		}
+		data = append(data, fragment...)
+	}
+	return status, data[:total], nil
+}
+
+// ntpdPeerStatus is the status of one association of ntpd.
+type ntpdPeerStatus struct {
+	AssociationID uint16
+	Selection     string
+}
+
+// Associations executes the "associations" command of ntpq.
+func (c *ntpdConn) Associations() ([]ntpdPeerStatus, error) {
+	_, data, err := c.request(ntpdOpReadStatus, 0)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]ntpdPeerStatus, 0, len(data)/4)
+	for len(data) >= 4 {
+		status := binary.BigEndian.Uint16(data[2:])
+		result = append(result, ntpdPeerStatus{
+			AssociationID: binary.BigEndian.Uint16(data[0:]),
+			Selection:     ntpdPeerSelections[(status>>8)&0x7],
+		})
+		data = data[4:]
+	}
+	return result, nil
+}
+
+// ReadVariables executes the "readvar" command of ntpq for the given
+// association (0 for the system variables).
+func (c *ntpdConn) ReadVariables(associationID uint16) (map[string]string, error) {
+	_, data, err := c.request(ntpdOpReadVariables, associationID)
+	if err != nil {
+		return nil, err
+	}
+	return parseNtpdVariables(string(data)), nil
+}
+
+// parseNtpdVariables parses a list of variables like `a=1, b="x, y", c`.
+// Quotes are removed from the values.
+func parseNtpdVariables(text string) map[string]string {
+	result := make(map[string]string)
+	for len(text) > 0 {
+		//find the end of this item (the next comma outside of quotes)
+		end := len(text)
+		inQuotes := false
+		for idx, ch := range text {
+			if ch == '"' {
+				inQuotes = !inQuotes
+			} else if ch == ',' && !inQuotes {
+				end = idx
+				break
+			}
+		}
+		item := strings.TrimSpace(strings.TrimRight(text[:end], "\x00"))
+		if end < len(text) {
+			text = text[end+1:]
+		} else {
+			text = ""
+		}
+
+		if item == "" {
+			continue
+		}
+		fields := strings.SplitN(item, "=", 2)
+		value := ""
+		if len(fields) == 2 {
+			value = strings.Trim(strings.TrimSpace(fields[1]), `"`)
+		}
+		result[strings.TrimSpace(fields[0])] = value
+	}
+	return result
+}
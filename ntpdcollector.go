@@ -0,0 +1,197 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+* Copyright 2015 The Prometheus Authors
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"log/slog"
+	"math"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	ntpdUpDesc = prometheus.NewDesc(
+		"ntp_ntpd_up",
+		"Whether the last query to ntpd succeeded (1) or not (0).",
+		nil, nil,
+	)
+	ntpdReferenceDesc = prometheus.NewDesc(
+		"ntp_ntpd_reference_info",
+		"Reference ID of the source that ntpd is synchronized to (always 1).",
+		[]string{"refid"}, nil,
+	)
+	ntpdPeerSelectionDesc = prometheus.NewDesc(
+		"ntp_ntpd_peer_selection_info",
+		"Selection status of the peer of ntpd, as shown in the tally column of \"ntpq -p\" (always 1).",
+		[]string{"peer", "refid", "selection"}, nil,
+	)
+
+	ntpdPeerLabels = []string{"peer", "refid"}
+
+	//system variables and peer variables that are reported as-is (after
+	//conversion of milliseconds into seconds or log2 values into seconds)
+	ntpdSystemVariables = []ntpdVariable{
+		{"stratum", "stratum", "Stratum of the local clock as reported by ntpd.", ntpdPlain},
+		{"leap", "leap_indicator", "Leap indicator of ntpd (0 = no warning, 1 = insert second, 2 = delete second, 3 = not synchronized).", ntpdBinary},
+		{"precision", "precision_seconds", "Precision of the local clock as reported by ntpd.", ntpdLog2},
+		{"rootdelay", "root_delay_seconds", "Total round-trip delay to the primary reference clock of ntpd.", ntpdMilliseconds},
+		{"rootdisp", "root_dispersion_seconds", "Total dispersion to the primary reference clock of ntpd.", ntpdMilliseconds},
+		{"offset", "offset_seconds", "Offset of the local clock from the system peer of ntpd.", ntpdMilliseconds},
+		{"frequency", "frequency_ppm", "Frequency error of the local clock that ntpd compensates for, in parts per million.", ntpdPlain},
+		{"sys_jitter", "system_jitter_seconds", "Combined jitter of the peers that ntpd selected.", ntpdMilliseconds},
+		{"clk_jitter", "clock_jitter_seconds", "Jitter of the local clock as estimated by ntpd.", ntpdMilliseconds},
+		{"clk_wander", "clock_wander_ppm", "Frequency wander of the local clock as estimated by ntpd, in parts per million.", ntpdPlain},
+		{"tc", "time_constant", "Time constant of the clock discipline of ntpd (log2 of seconds).", ntpdPlain},
+	}
+	ntpdPeerVariables = []ntpdVariable{
+		{"stratum", "peer_stratum", "Stratum of the peer of ntpd.", ntpdPlain},
+		{"offset", "peer_offset_seconds", "Offset of the local clock from the peer of ntpd.", ntpdMilliseconds},
+		{"delay", "peer_delay_seconds", "Round-trip delay to the peer of ntpd.", ntpdMilliseconds},
+		{"dispersion", "peer_dispersion_seconds", "Dispersion of the measurements of the peer of ntpd.", ntpdMilliseconds},
+		{"jitter", "peer_jitter_seconds", "Jitter of the measurements of the peer of ntpd.", ntpdMilliseconds},
+		{"reach", "peer_reachability", "Reachability register of the peer of ntpd (one bit per poll, the lowest bit is the latest poll).", ntpdPlain},
+		{"hpoll", "peer_poll_interval_seconds", "Interval at which ntpd polls the peer.", ntpdLog2},
+	}
+)
+
+// ntpdVariable describes a metric that is taken from a variable reported by
+// ntpd.
+type ntpdVariable struct {
+	Variable string
+	Name     string
+	Help     string
+	Parse    func(string) (float64, error)
+}
+
+func (v ntpdVariable) desc(labels ...string) *prometheus.Desc {
+	return prometheus.NewDesc("ntp_ntpd_"+v.Name, v.Help, labels, nil)
+}
+
+func ntpdPlain(value string) (float64, error) {
+	//also accepts hex values like reach=0xff
+	if i, err := strconv.ParseInt(value, 0, 64); err == nil {
+		return float64(i), nil
+	}
+	return strconv.ParseFloat(value, 64)
+}
+
+func ntpdBinary(value string) (float64, error) {
+	i, err := strconv.ParseUint(value, 2, 8)
+	return float64(i), err
+}
+
+func ntpdMilliseconds(value string) (float64, error) {
+	f, err := strconv.ParseFloat(value, 64)
+	return f / 1000, err
+}
+
+func ntpdLog2(value string) (float64, error) {
+	i, err := strconv.ParseInt(value, 10, 8)
+	return math.Pow(2, float64(i)), err
+}
+
+// ntpdCollector reports the system variables and the peers of ntpd, like
+// "ntpq -c rv -p". Unlike the Collector, which measures NTP servers with
+// regular time queries, ntpd is asked for its own view during each scrape.
+type ntpdCollector struct {
+	Client ntpdClient
+}
+
+// Describe implements the prometheus.Collector interface.
+func (c ntpdCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- ntpdUpDesc
+	ch <- ntpdReferenceDesc
+	ch <- ntpdPeerSelectionDesc
+	for _, v := range ntpdSystemVariables {
+		ch <- v.desc()
+	}
+	for _, v := range ntpdPeerVariables {
+		ch <- v.desc(ntpdPeerLabels...)
+	}
+}
+
+// Collect implements the prometheus.Collector interface.
+func (c ntpdCollector) Collect(ch chan<- prometheus.Metric) {
+	up := 0.0
+	defer func() {
+		ch <- prometheus.MustNewConstMetric(ntpdUpDesc, prometheus.GaugeValue, up)
+	}()
+
+	conn, err := c.Client.Dial()
+	if err != nil {
+		slog.Error("couldn't connect to ntpd", "address", c.Client.Address, "err", err)
+		return
+	}
+	defer conn.Close()
+
+	vars, err := conn.ReadVariables(0)
+	if err != nil {
+		slog.Error("couldn't get system variables from ntpd", "address", c.Client.Address, "err", err)
+		return
+	}
+	if refid, exists := vars["refid"]; exists {
+		ch <- prometheus.MustNewConstMetric(ntpdReferenceDesc, prometheus.GaugeValue, 1, refid)
+	}
+	collectNtpdVariables(ch, ntpdSystemVariables, vars, nil)
+
+	peers, err := conn.Associations()
+	if err != nil {
+		slog.Error("couldn't get associations from ntpd", "address", c.Client.Address, "err", err)
+		return
+	}
+	seen := make(map[string]bool)
+	for _, peer := range peers {
+		vars, err := conn.ReadVariables(peer.AssociationID)
+		if err != nil {
+			slog.Error("couldn't get variables of association from ntpd", "address", c.Client.Address, "association", peer.AssociationID, "err", err)
+			return
+		}
+		//the same address can appear in multiple associations (e.g. for
+		//"pool" entries), which would make the whole scrape fail
+		address := vars["srcadr"]
+		if address == "" || seen[address] {
+			slog.Debug("skipping association of ntpd with duplicate or missing address", "association", peer.AssociationID, "peer", address)
+			continue
+		}
+		seen[address] = true
+
+		refid := vars["refid"]
+		ch <- prometheus.MustNewConstMetric(ntpdPeerSelectionDesc, prometheus.GaugeValue, 1, address, refid, peer.Selection)
+		collectNtpdVariables(ch, ntpdPeerVariables, vars, ntpdPeerLabels, address, refid)
+	}
+	up = 1
+}
+
+func collectNtpdVariables(ch chan<- prometheus.Metric, variables []ntpdVariable, values map[string]string, labelNames []string, labelValues ...string) {
+	for _, v := range variables {
+		text, exists := values[v.Variable]
+		if !exists {
+			continue
+		}
+		value, err := v.Parse(text)
+		if err != nil {
+			slog.Debug("ignoring invalid value for ntpd variable", "variable", v.Variable, "value", text)
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(v.desc(labelNames...), prometheus.GaugeValue, value, labelValues...)
+	}
+}
@@ -0,0 +1,227 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+* Copyright 2015 The Prometheus Authors
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/beevik/ntp"
+)
+
+//This file contains an experimental client for NTPv5 as described in
+//draft-ietf-ntp-ntpv5. Since the draft may still change in incompatible ways,
+//protocol version 5 has to be enabled with -ntp.experimental-ntpv5.
+//
+//Servers are asked for NTPv5 support by sending an NTPv4 query with a magic
+//value in the reference timestamp. Servers that support NTPv5 echo it back;
+//only then is the actual NTPv5 query sent. All other servers are measured
+//with their NTPv4 response.
+
+const (
+	ntpv5NegotiationMagic = 0x4E54503544524654 //"NTP5DRFT"
+	ntpv5TimescaleUTC     = 0
+	ntpv5DraftID          = "draft-ietf-ntp-ntpv5-02"
+	ntpv5DraftIDFieldType = 0xF5FF
+)
+
+// ntpv5Enabled is set by -ntp.experimental-ntpv5.
+var ntpv5Enabled bool
+
+// checkProtocolVersion returns an error if the given NTP protocol version
+// cannot be used.
+func checkProtocolVersion(version int) error {
+	if version == 5 && ntpv5Enabled {
+		return nil
+	}
+	if version < 2 || version > 4 {
+		return fmt.Errorf("invalid NTP protocol version %d; must be 2, 3, or 4 (or 5 with -ntp.experimental-ntpv5)", version)
+	}
+	return nil
+}
+
+// ntpv5Packet is the NTPv5 packet header as described in draft-ietf-ntp-ntpv5,
+// section 5.
+type ntpv5Packet struct {
+	LiVnMode       uint8
+	Stratum        uint8
+	Poll           int8
+	Precision      int8
+	Timescale      uint8
+	Era            uint8
+	Flags          uint16
+	RootDelay      uint32
+	RootDispersion uint32
+	ServerCookie   uint64
+	ClientCookie   uint64
+	ReceiveTime    uint64
+	TransmitTime   uint64
+}
+
+// queryNTPv5 sends an NTPv5 query over the given connection, which has
+// already been used to find out that the server supports NTPv5. NTPv5
+// responses do not contain a reference ID, so the one from the NTPv4
+// response is reported instead. If result is not nil, it receives the
+// timestamps of the exchange.
+func queryNTPv5(conn *net.UDPConn, host string, refID uint32, result *queryResult) (*ntp.Response, error) {
+	//the client cookie takes the role of the random transmit timestamp in NTPv4
+	req := ntpv5Packet{
+		LiVnMode:  uint8(ntp.LeapNotInSync)<<6 | 5<<3 | ntpModeClient,
+		Timescale: ntpv5TimescaleUTC,
+	}
+	var cookie [8]byte
+	_, err := rand.Read(cookie[:])
+	if err != nil {
+		return nil, err
+	}
+	req.ClientCookie = binary.BigEndian.Uint64(cookie[:])
+
+	var packet bytes.Buffer
+	err = binary.Write(&packet, binary.BigEndian, &req)
+	if err != nil {
+		return nil, err
+	}
+	//the draft identification extension field tells the server which version
+	//of the draft we implement
+	value := []byte(ntpv5DraftID)
+	for len(value)%4 != 0 {
+		value = append(value, 0)
+	}
+	var header [4]byte
+	binary.BigEndian.PutUint16(header[0:2], ntpv5DraftIDFieldType)
+	binary.BigEndian.PutUint16(header[2:4], uint16(4+len(value)))
+	packet.Write(header[:])
+	packet.Write(value)
+
+	xmitTime := time.Now()
+	_, err = conn.Write(packet.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 2048)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		recvTime := xmitTime.Add(time.Since(xmitTime))
+		if n < ntpPacketSize {
+			return nil, errTruncatedResponse
+		}
+
+		var resp ntpv5Packet
+		err = binary.Read(bytes.NewReader(buf[:ntpPacketSize]), binary.BigEndian, &resp)
+		if err != nil {
+			return nil, err
+		}
+		if (resp.LiVnMode>>3)&0x07 != 5 || resp.ClientCookie != req.ClientCookie {
+			//probably a late response to the NTPv4 query
+			slog.Debug("discarding unexpected response while waiting for NTPv5 response", "server", host)
+			continue
+		}
+
+		switch {
+		case resp.LiVnMode&0x07 != ntpModeServer:
+			return nil, errors.New("invalid mode in NTPv5 response")
+		case resp.Timescale != ntpv5TimescaleUTC:
+			return nil, fmt.Errorf("unexpected timescale %d in NTPv5 response", resp.Timescale)
+		case resp.TransmitTime == 0:
+			return nil, errors.New("invalid transmit time in NTPv5 response")
+		case resp.ReceiveTime > resp.TransmitTime:
+			return nil, errors.New("server clock ticked backwards")
+		}
+
+		if result != nil {
+			result.Timestamps = [4]time.Time{
+				xmitTime,
+				ntpv5TimestampToTime(resp.Era, resp.ReceiveTime),
+				ntpv5TimestampToTime(resp.Era, resp.TransmitTime),
+				recvTime,
+			}
+		}
+		return parseNTPv5Response(resp, refID, xmitTime, recvTime), nil
+	}
+}
+
+func parseNTPv5Response(p ntpv5Packet, refID uint32, xmitTime, recvTime time.Time) *ntp.Response {
+	//t1..t4 as in RFC 5905, section 8
+	t1 := xmitTime
+	t2 := ntpv5TimestampToTime(p.Era, p.ReceiveTime)
+	t3 := ntpv5TimestampToTime(p.Era, p.TransmitTime)
+	t4 := recvTime
+
+	rtt := t4.Sub(t1) - t3.Sub(t2)
+	if rtt < 0 {
+		rtt = 0
+	}
+	rootDelay := ntpv5Time32ToDuration(p.RootDelay)
+	rootDispersion := ntpv5Time32ToDuration(p.RootDispersion)
+
+	var minError time.Duration
+	if d := t1.Sub(t2); d > minError {
+		minError = d
+	}
+	if d := t3.Sub(t4); d > minError {
+		minError = d
+	}
+
+	return &ntp.Response{
+		Time:        t3,
+		ClockOffset: (t2.Sub(t1) + t3.Sub(t4)) / 2,
+		RTT:         rtt,
+		Precision:   log2ToDuration(p.Precision),
+		Stratum:     p.Stratum,
+		ReferenceID: refID,
+		//NTPv5 has no reference timestamp anymore
+		ReferenceTime:  t3,
+		RootDelay:      rootDelay,
+		RootDispersion: rootDispersion,
+		RootDistance:   (rtt+rootDelay)/2 + rootDispersion,
+		Leap:           ntp.LeapIndicator(p.LiVnMode >> 6),
+		MinError:       minError,
+		Poll:           log2ToDuration(p.Poll),
+	}
+}
+
+// ntpv5TimestampToTime converts an NTPv5 timestamp (32.32 fixed point seconds
+// since the start of the given era) into a time.Time.
+func ntpv5TimestampToTime(era uint8, t uint64) time.Time {
+	result := ntpTimestampToTime(t)
+	for i := uint8(0); i < era; i++ {
+		result = result.Add(time.Duration(1<<32) * time.Second)
+	}
+	return result
+}
+
+// ntpv5Time32ToDuration converts an NTPv5 time32 value (4.28 fixed point
+// seconds) into a time.Duration.
+func ntpv5Time32ToDuration(t uint32) time.Duration {
+	sec := time.Duration(t>>28) * time.Second
+	nsec := time.Duration((uint64(t&0x0FFFFFFF) * 1e9) >> 28)
+	return sec + nsec
+}
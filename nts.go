@@ -0,0 +1,409 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+* Copyright 2015 The Prometheus Authors
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//This file implements the client side of Network Time Security (RFC 8915):
+//The NTS key exchange (NTS-KE) over TLS yields a pair of AEAD keys and a set
+//of cookies. Each NTP query then carries one cookie and is authenticated with
+//the client-to-server key, and the server's response is authenticated with
+//the server-to-client key and contains a fresh cookie.
+
+const (
+	ntsKEDefaultPort = "4460"
+	ntsKEALPN        = "ntske/1"
+	ntsKEExporter    = "EXPORTER-network-time-security"
+
+	ntsProtocolNTPv4     = 0
+	ntsAEADAESSIVCMAC256 = 15
+
+	//NTS-KE record types (RFC 8915, section 4)
+	ntsKERecordEndOfMessage      = 0
+	ntsKERecordNextProtocol      = 1
+	ntsKERecordError             = 2
+	ntsKERecordWarning           = 3
+	ntsKERecordAEADAlgorithm     = 4
+	ntsKERecordNewCookie         = 5
+	ntsKERecordServerNegotiation = 6
+	ntsKERecordPortNegotiation   = 7
+	ntsKECriticalBit             = 0x8000
+
+	//NTP extension field types (RFC 8915, section 5)
+	ntsExtUniqueIdentifier  = 0x0104
+	ntsExtCookie            = 0x0204
+	ntsExtCookiePlaceholder = 0x0304
+	ntsExtAuthenticator     = 0x0404
+
+	ntsNonceSize    = 16
+	ntsUniqueIDSize = 32
+	//when the number of cookies drops below this, we ask the server for more
+	ntsMinCookies = 4
+)
+
+// ntsSession contains the results of an NTS key exchange.
+type ntsSession struct {
+	C2SKey  []byte
+	S2CKey  []byte
+	Host    string //NTP server to query (may differ from the NTS-KE server)
+	Port    string
+	Cookies [][]byte
+}
+
+// ntsSessions contains the NTS sessions for each measured server, so that
+// the NTS-KE does not have to be repeated for every query.
+var ntsSessions = struct {
+	sync.Mutex
+	byServer map[string]*ntsSession
+	//the NTS-KE that is currently running for each server (see takeNTSCookie)
+	exchanges map[string]*ntsExchange
+}{byServer: make(map[string]*ntsSession), exchanges: make(map[string]*ntsExchange)}
+
+// ntsExchange is an NTS-KE that is currently running. Concurrent queries to
+// the same server wait for it instead of doing their own NTS-KE.
+type ntsExchange struct {
+	done    chan struct{} //closed when session and err are set
+	session *ntsSession
+	err     error
+}
+
+// takeNTSCookie returns the session for the given server and removes one
+// cookie from it, doing a new NTS-KE if necessary. The NTS-KE runs without
+// holding the lock on ntsSessions, so that it does not block queries to
+// other servers.
+func takeNTSCookie(address, keServer string, timeout time.Duration) (ntsSession, []byte, error) {
+	for {
+		ntsSessions.Lock()
+		session := ntsSessions.byServer[address]
+		if session != nil && len(session.Cookies) > 0 {
+			cookie := session.Cookies[0]
+			session.Cookies = session.Cookies[1:]
+			result := *session
+			ntsSessions.Unlock()
+			return result, cookie, nil
+		}
+
+		exchange := ntsSessions.exchanges[address]
+		if exchange == nil {
+			exchange = &ntsExchange{done: make(chan struct{})}
+			ntsSessions.exchanges[address] = exchange
+			ntsSessions.Unlock()
+
+			exchange.session, exchange.err = ntsKeyExchange(keServer, timeout)
+
+			ntsSessions.Lock()
+			delete(ntsSessions.exchanges, address)
+			if exchange.err == nil {
+				ntsSessions.byServer[address] = exchange.session
+			}
+			close(exchange.done)
+			ntsSessions.Unlock()
+		} else {
+			ntsSessions.Unlock()
+			<-exchange.done
+		}
+		if exchange.err != nil {
+			return ntsSession{}, nil, fmt.Errorf("NTS key exchange with %s failed: %s", keServer, exchange.err)
+		}
+		//take a cookie from the new session in the next iteration (if other
+		//queries used them all up in the meantime, this does another NTS-KE)
+	}
+}
+
+// addNTSCookies adds the cookies from a server response to the session.
+func addNTSCookies(address string, cookies [][]byte) {
+	ntsSessions.Lock()
+	defer ntsSessions.Unlock()
+	if session := ntsSessions.byServer[address]; session != nil {
+		session.Cookies = append(session.Cookies, cookies...)
+	}
+}
+
+// ntsCookieCount returns the number of unused cookies for the given server.
+func ntsCookieCount(address string) int {
+	ntsSessions.Lock()
+	defer ntsSessions.Unlock()
+	if session := ntsSessions.byServer[address]; session != nil {
+		return len(session.Cookies)
+	}
+	return 0
+}
+
+// forgetNTSSession discards the session for the given server, e.g. because
+// the server did not accept its cookies.
+func forgetNTSSession(address string) {
+	ntsSessions.Lock()
+	defer ntsSessions.Unlock()
+	delete(ntsSessions.byServer, address)
+}
+
+// ntsKeyExchange performs the NTS-KE with the given server ("host" or
+// "host:port").
+func ntsKeyExchange(server string, timeout time.Duration) (*ntsSession, error) {
+	host, port, err := net.SplitHostPort(server)
+	if err != nil {
+		host, port = server, ntsKEDefaultPort
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", net.JoinHostPort(host, port), &tls.Config{
+		ServerName: host,
+		NextProtos: []string{ntsKEALPN},
+		MinVersion: tls.VersionTLS13,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	err = conn.SetDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return nil, err
+	}
+	if conn.ConnectionState().NegotiatedProtocol != ntsKEALPN {
+		return nil, errors.New("server does not support the NTS-KE protocol")
+	}
+
+	var req bytes.Buffer
+	writeNTSKERecord(&req, ntsKECriticalBit|ntsKERecordNextProtocol, uint16Bytes(ntsProtocolNTPv4))
+	writeNTSKERecord(&req, ntsKERecordAEADAlgorithm, uint16Bytes(ntsAEADAESSIVCMAC256))
+	writeNTSKERecord(&req, ntsKECriticalBit|ntsKERecordEndOfMessage, nil)
+	_, err = conn.Write(req.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	session := &ntsSession{Host: host, Port: "123"}
+	var protocolOK, aeadOK bool
+	for {
+		var header [4]byte
+		_, err := io.ReadFull(conn, header[:])
+		if err != nil {
+			return nil, err
+		}
+		recordType := binary.BigEndian.Uint16(header[0:2]) &^ ntsKECriticalBit
+		body := make([]byte, binary.BigEndian.Uint16(header[2:4]))
+		_, err = io.ReadFull(conn, body)
+		if err != nil {
+			return nil, err
+		}
+
+		switch recordType {
+		case ntsKERecordEndOfMessage:
+			if !protocolOK || !aeadOK {
+				return nil, errors.New("server did not agree to NTPv4 with AEAD_AES_SIV_CMAC_256")
+			}
+			if len(session.Cookies) == 0 {
+				return nil, errors.New("server did not send any cookies")
+			}
+			state := conn.ConnectionState()
+			session.C2SKey, err = state.ExportKeyingMaterial(ntsKEExporter, ntsKEExporterContext(0), 32)
+			if err != nil {
+				return nil, err
+			}
+			session.S2CKey, err = state.ExportKeyingMaterial(ntsKEExporter, ntsKEExporterContext(1), 32)
+			if err != nil {
+				return nil, err
+			}
+			return session, nil
+		case ntsKERecordNextProtocol:
+			protocolOK = len(body) == 2 && binary.BigEndian.Uint16(body) == ntsProtocolNTPv4
+		case ntsKERecordAEADAlgorithm:
+			aeadOK = len(body) == 2 && binary.BigEndian.Uint16(body) == ntsAEADAESSIVCMAC256
+		case ntsKERecordError:
+			return nil, fmt.Errorf("server reported error %x", body)
+		case ntsKERecordNewCookie:
+			session.Cookies = append(session.Cookies, body)
+		case ntsKERecordServerNegotiation:
+			session.Host = string(body)
+		case ntsKERecordPortNegotiation:
+			if len(body) == 2 {
+				session.Port = strconv.Itoa(int(binary.BigEndian.Uint16(body)))
+			}
+		}
+	}
+}
+
+func writeNTSKERecord(buf *bytes.Buffer, recordType uint16, body []byte) {
+	buf.Write(uint16Bytes(recordType))
+	buf.Write(uint16Bytes(uint16(len(body))))
+	buf.Write(body)
+}
+
+// ntsKEExporterContext returns the context for the TLS key exporter. The
+// direction is 0 for the client-to-server key and 1 for the server-to-client
+// key.
+func ntsKEExporterContext(direction byte) []byte {
+	return []byte{0, ntsProtocolNTPv4, 0, ntsAEADAESSIVCMAC256, direction}
+}
+
+func uint16Bytes(value uint16) []byte {
+	var buf [2]byte
+	binary.BigEndian.PutUint16(buf[:], value)
+	return buf[:]
+}
+
+// ntsRequest contains the state for a single NTS-authenticated query.
+type ntsRequest struct {
+	Session    ntsSession
+	Cookie     []byte
+	UniqueID   []byte
+	NewCookies [][]byte //filled by verifyResponse
+}
+
+// ntsVerificationError is returned by queryServer when the response could not
+// be authenticated with NTS.
+type ntsVerificationError struct {
+	Err error
+}
+
+// Error implements the error interface.
+func (e ntsVerificationError) Error() string {
+	return "NTS verification failed: " + e.Err.Error()
+}
+
+// appendExtensionFields appends the NTS extension fields to the given NTP
+// request packet.
+func (r *ntsRequest) appendExtensionFields(packet []byte) ([]byte, error) {
+	r.UniqueID = make([]byte, ntsUniqueIDSize)
+	_, err := rand.Read(r.UniqueID)
+	if err != nil {
+		return nil, err
+	}
+	packet = appendExtensionField(packet, ntsExtUniqueIdentifier, r.UniqueID)
+	packet = appendExtensionField(packet, ntsExtCookie, r.Cookie)
+	//ask for additional cookies if we are running low
+	for i := len(r.Session.Cookies) + 1; i < ntsMinCookies; i++ {
+		packet = appendExtensionField(packet, ntsExtCookiePlaceholder, make([]byte, len(r.Cookie)))
+	}
+
+	nonce := make([]byte, ntsNonceSize)
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, err := sivSeal(r.Session.C2SKey, [][]byte{packet, nonce}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return appendExtensionField(packet, ntsExtAuthenticator, authenticatorBody(nonce, ciphertext)), nil
+}
+
+// verifyResponse checks the NTS extension fields of a response packet, and
+// stores the new cookies contained in it in r.NewCookies.
+func (r *ntsRequest) verifyResponse(packet []byte) error {
+	var uniqueIDOK bool
+	offset := ntpPacketSize
+	for offset+4 <= len(packet) {
+		fieldType := binary.BigEndian.Uint16(packet[offset : offset+2])
+		fieldLength := int(binary.BigEndian.Uint16(packet[offset+2 : offset+4]))
+		if fieldLength < 4 || offset+fieldLength > len(packet) {
+			return errors.New("malformed extension field in NTS response")
+		}
+		body := packet[offset+4 : offset+fieldLength]
+
+		switch fieldType {
+		case ntsExtUniqueIdentifier:
+			uniqueIDOK = bytes.Equal(body, r.UniqueID)
+		case ntsExtAuthenticator:
+			if !uniqueIDOK {
+				return errors.New("NTS response does not belong to our query")
+			}
+			nonce, ciphertext, err := parseAuthenticatorBody(body)
+			if err != nil {
+				return err
+			}
+			plaintext, err := sivOpen(r.Session.S2CKey, [][]byte{packet[:offset], nonce}, ciphertext)
+			if err != nil {
+				return err
+			}
+			r.NewCookies = parseEncryptedCookies(plaintext)
+			return nil
+		}
+		offset += fieldLength
+	}
+	return errors.New("NTS response is not authenticated")
+}
+
+// parseEncryptedCookies extracts the cookies from the decrypted extension
+// fields of a response.
+func parseEncryptedCookies(fields []byte) [][]byte {
+	var cookies [][]byte
+	for offset := 0; offset+4 <= len(fields); {
+		fieldType := binary.BigEndian.Uint16(fields[offset : offset+2])
+		fieldLength := int(binary.BigEndian.Uint16(fields[offset+2 : offset+4]))
+		if fieldLength < 4 || offset+fieldLength > len(fields) {
+			break
+		}
+		if fieldType == ntsExtCookie {
+			cookies = append(cookies, append([]byte(nil), fields[offset+4:offset+fieldLength]...))
+		}
+		offset += fieldLength
+	}
+	return cookies
+}
+
+// appendExtensionField appends an NTP extension field (RFC 7822) with the
+// given body, padded to a multiple of 4 bytes.
+func appendExtensionField(packet []byte, fieldType uint16, body []byte) []byte {
+	length := 4 + padTo4(len(body))
+	packet = append(packet, uint16Bytes(fieldType)...)
+	packet = append(packet, uint16Bytes(uint16(length))...)
+	packet = append(packet, body...)
+	return append(packet, make([]byte, length-4-len(body))...)
+}
+
+// authenticatorBody builds the body of the NTS Authenticator and Encrypted
+// Extension Fields extension field (RFC 8915, section 5.6).
+func authenticatorBody(nonce, ciphertext []byte) []byte {
+	body := append(uint16Bytes(uint16(len(nonce))), uint16Bytes(uint16(len(ciphertext)))...)
+	body = append(body, nonce...)
+	body = append(body, make([]byte, padTo4(len(nonce))-len(nonce))...)
+	body = append(body, ciphertext...)
+	return append(body, make([]byte, padTo4(len(ciphertext))-len(ciphertext))...)
+}
+
+func parseAuthenticatorBody(body []byte) (nonce, ciphertext []byte, err error) {
+	if len(body) < 4 {
+		return nil, nil, errors.New("truncated NTS authenticator")
+	}
+	nonceLength := int(binary.BigEndian.Uint16(body[0:2]))
+	ciphertextLength := int(binary.BigEndian.Uint16(body[2:4]))
+	ciphertextOffset := 4 + padTo4(nonceLength)
+	if ciphertextOffset+ciphertextLength > len(body) {
+		return nil, nil, errors.New("truncated NTS authenticator")
+	}
+	return body[4 : 4+nonceLength], body[ciphertextOffset : ciphertextOffset+ciphertextLength], nil
+}
+
+func padTo4(length int) int {
+	return (length + 3) &^ 3
+}
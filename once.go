@@ -0,0 +1,79 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+* Copyright 2015 The Prometheus Authors
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// writeMetricsOnce measures all NTP servers once and writes all metrics in
+// the text exposition format to the file at `path`, or to stdout if `path` is
+// empty. Nothing is written if any metric could not be gathered.
+//
+// The file is replaced atomically, so that the textfile collector of the
+// node_exporter never sees a partially written file.
+func writeMetricsOnce(c Collector, instanceLabel, path string) error {
+	c.PollInterval = 0
+	c.CacheTTL = 0
+	families, err := gatherMetrics(c, instanceLabel)
+	if err != nil {
+		return err
+	}
+
+	if path == "" {
+		return writeMetricFamilies(os.Stdout, families)
+	}
+
+	//the temporary file must be in the same directory for the rename to be
+	//atomic; the leading dot keeps the textfile collector from picking it up
+	tmpFile, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	err = writeMetricFamilies(tmpFile, families)
+	if err == nil {
+		err = tmpFile.Chmod(0644)
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), path)
+}
+
+func writeMetricFamilies(w io.Writer, families []*dto.MetricFamily) error {
+	enc := expfmt.NewEncoder(w, expfmt.FmtText)
+	for _, family := range families {
+		err := enc.Encode(family)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
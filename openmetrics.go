@@ -0,0 +1,240 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+* Copyright 2015 The Prometheus Authors
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// openMetricsContentType is the content type of the OpenMetrics text format.
+const openMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+// openMetricsExtras provides what the OpenMetrics format can carry beyond the
+// gathered metrics, since the vendored client library tracks neither created
+// timestamps nor exemplars.
+type openMetricsExtras interface {
+	// createdTimestamp returns when the given counter was created, or false
+	// if that is not known.
+	createdTimestamp(family string, m *dto.Metric) (time.Time, bool)
+	// exemplar returns the exemplar of the given histogram, if any.
+	exemplar(family string, m *dto.Metric) (openMetricsExemplar, bool)
+}
+
+// openMetricsExemplar is an observation of a histogram that was made while
+// handling a traced request.
+type openMetricsExemplar struct {
+	TraceID string
+	Value   float64
+	Time    time.Time
+}
+
+// serveMetrics serves the metrics from the given gatherer in the format that
+// the client asked for: OpenMetrics if it prefers that (like Prometheus does
+// by default), otherwise whatever promhttp negotiates.
+//
+// The vendored promhttp predates OpenMetrics, so this encodes it by hand,
+// with the created timestamps and exemplars from `extras` (which may be nil).
+func serveMetrics(w http.ResponseWriter, r *http.Request, gatherer prometheus.Gatherer, extras openMetricsExtras) {
+	if !prefersOpenMetrics(r.Header.Get("Accept")) {
+		promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{ErrorLog: newErrorLogger()}).ServeHTTP(w, r)
+		return
+	}
+
+	families, err := gatherer.Gather()
+	if err != nil {
+		newErrorLogger().Println("error gathering metrics:", err)
+		http.Error(w, "An error has occurred during metrics gathering:\n\n"+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", openMetricsContentType)
+	err = writeOpenMetrics(w, families, extras)
+	if err != nil {
+		slog.Debug("cannot write metrics", "err", err)
+	}
+}
+
+// prefersOpenMetrics returns whether the given Accept header ranks OpenMetrics
+// (version 1.0.0 or 0.0.1) at least as high as the text format.
+func prefersOpenMetrics(accept string) bool {
+	var openMetricsQ, textQ float64
+	for _, mediaRange := range strings.Split(accept, ",") {
+		params := strings.Split(mediaRange, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(params[0]))
+		q, version := 1.0, ""
+		for _, param := range params[1:] {
+			key, value, _ := strings.Cut(param, "=")
+			switch strings.ToLower(strings.TrimSpace(key)) {
+			case "q":
+				parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+				if err == nil {
+					q = parsed
+				}
+			case "version":
+				version = strings.TrimSpace(value)
+			}
+		}
+		switch {
+		case mediaType == "application/openmetrics-text" && (version == "" || version == "1.0.0" || version == "0.0.1"):
+			openMetricsQ = math.Max(openMetricsQ, q)
+		case mediaType == "text/plain":
+			textQ = math.Max(textQ, q)
+		}
+	}
+	return openMetricsQ > 0 && openMetricsQ >= textQ
+}
+
+// writeOpenMetrics writes the given metrics in the OpenMetrics text format.
+func writeOpenMetrics(w io.Writer, families []*dto.MetricFamily, extras openMetricsExtras) error {
+	bw := bufio.NewWriter(w)
+	for _, family := range families {
+		name := family.GetName()
+		var typeName string
+		switch family.GetType() {
+		case dto.MetricType_COUNTER:
+			//the name of a counter family has no _total suffix, but the
+			//name of its samples always has
+			typeName = "counter"
+			name = strings.TrimSuffix(name, "_total")
+		case dto.MetricType_GAUGE:
+			typeName = "gauge"
+		case dto.MetricType_SUMMARY:
+			typeName = "summary"
+		case dto.MetricType_HISTOGRAM:
+			typeName = "histogram"
+		default:
+			typeName = "unknown"
+		}
+		if family.Help != nil {
+			fmt.Fprintf(bw, "# HELP %s %s\n", name, escapeOpenMetrics(family.GetHelp()))
+		}
+		fmt.Fprintf(bw, "# TYPE %s %s\n", name, typeName)
+
+		for _, m := range family.GetMetric() {
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				writeOpenMetricsSample(bw, name+"_total", m, "", 0, m.GetCounter().GetValue())
+				if extras != nil {
+					if created, ok := extras.createdTimestamp(family.GetName(), m); ok {
+						writeOpenMetricsSample(bw, name+"_created", m, "", 0, float64(created.UnixNano())/1e9)
+					}
+				}
+			case dto.MetricType_GAUGE:
+				writeOpenMetricsSample(bw, name, m, "", 0, m.GetGauge().GetValue())
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				for _, q := range s.GetQuantile() {
+					writeOpenMetricsSample(bw, name, m, "quantile", q.GetQuantile(), q.GetValue())
+				}
+				writeOpenMetricsSample(bw, name+"_sum", m, "", 0, s.GetSampleSum())
+				writeOpenMetricsSample(bw, name+"_count", m, "", 0, float64(s.GetSampleCount()))
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				var exemplar *openMetricsExemplar
+				if extras != nil {
+					if e, ok := extras.exemplar(family.GetName(), m); ok {
+						exemplar = &e
+					}
+				}
+				//the exemplar goes into the first bucket that contains it
+				buckets := h.GetBucket()
+				for _, b := range buckets {
+					if exemplar != nil && exemplar.Value <= b.GetUpperBound() {
+						writeOpenMetricsSampleWithExemplar(bw, name+"_bucket", m, "le", b.GetUpperBound(), float64(b.GetCumulativeCount()), exemplar)
+						exemplar = nil
+					} else {
+						writeOpenMetricsSample(bw, name+"_bucket", m, "le", b.GetUpperBound(), float64(b.GetCumulativeCount()))
+					}
+				}
+				if len(buckets) == 0 || !math.IsInf(buckets[len(buckets)-1].GetUpperBound(), +1) {
+					writeOpenMetricsSampleWithExemplar(bw, name+"_bucket", m, "le", math.Inf(+1), float64(h.GetSampleCount()), exemplar)
+				}
+				writeOpenMetricsSample(bw, name+"_sum", m, "", 0, h.GetSampleSum())
+				writeOpenMetricsSample(bw, name+"_count", m, "", 0, float64(h.GetSampleCount()))
+			default:
+				writeOpenMetricsSample(bw, name, m, "", 0, m.GetUntyped().GetValue())
+			}
+		}
+	}
+	bw.WriteString("# EOF\n")
+	return bw.Flush()
+}
+
+// writeOpenMetricsSample writes a sample with the labels of `m`, and with the
+// additional label `extraName` (e.g. "le"), unless that is empty.
+func writeOpenMetricsSample(w *bufio.Writer, name string, m *dto.Metric, extraName string, extraValue float64, value float64) {
+	writeOpenMetricsSampleWithExemplar(w, name, m, extraName, extraValue, value, nil)
+}
+
+// writeOpenMetricsSampleWithExemplar is like writeOpenMetricsSample, but also
+// writes the given exemplar, unless it is nil.
+func writeOpenMetricsSampleWithExemplar(w *bufio.Writer, name string, m *dto.Metric, extraName string, extraValue float64, value float64, exemplar *openMetricsExemplar) {
+	labels := make([]string, 0, len(m.GetLabel())+1)
+	for _, l := range m.GetLabel() {
+		labels = append(labels, fmt.Sprintf("%s=\"%s\"", l.GetName(), escapeOpenMetrics(l.GetValue())))
+	}
+	if extraName != "" {
+		labels = append(labels, fmt.Sprintf("%s=\"%s\"", extraName, formatOpenMetricsFloat(extraValue)))
+	}
+
+	w.WriteString(name)
+	if len(labels) > 0 {
+		w.WriteString("{" + strings.Join(labels, ",") + "}")
+	}
+	w.WriteString(" " + formatOpenMetricsFloat(value))
+	if exemplar != nil {
+		fmt.Fprintf(w, " # {trace_id=\"%s\"} %s %s",
+			escapeOpenMetrics(exemplar.TraceID), formatOpenMetricsFloat(exemplar.Value),
+			formatOpenMetricsFloat(float64(exemplar.Time.UnixNano())/1e9),
+		)
+	}
+	w.WriteString("\n")
+}
+
+var openMetricsEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeOpenMetrics(value string) string {
+	return openMetricsEscaper.Replace(value)
+}
+
+func formatOpenMetricsFloat(value float64) string {
+	switch {
+	case math.IsNaN(value):
+		return "NaN"
+	case math.IsInf(value, +1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	}
+}
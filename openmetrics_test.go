@@ -0,0 +1,88 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+* Copyright 2015 The Prometheus Authors
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestOpenMetricsCreatedAndExemplars(t *testing.T) {
+	c := Collector{
+		TraceID: "4bf92f3577b34da6a3ce929d0e0e4736",
+		metrics: newMetrics(HistogramBuckets{ScrapeDuration: []float64{1, 10}}),
+	}
+	created := time.Unix(1700000000, 0)
+	c.setSeriesCreated("ntp.example.com", created)
+	c.queries.WithLabelValues("ntp.example.com", "success").Inc()
+	c.observeScrapeDuration("ntp.example.com", time.Now().Add(-2*time.Second))
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(c.queries, c.scrapeDuration)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	err = writeOpenMetrics(&buf, families, c.metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := buf.String()
+
+	expected := `ntp_queries_created{result="success",server="ntp.example.com"} 1.7e+09` + "\n"
+	if !strings.Contains(output, expected) {
+		t.Errorf("expected %q in output:\n%s", expected, output)
+	}
+	//the observation of ~2s belongs into the bucket with le="10"
+	expected = `ntp_scrape_duration_seconds_bucket{server="ntp.example.com",le="10"} 1 # {trace_id="4bf92f3577b34da6a3ce929d0e0e4736"} 2`
+	if !strings.Contains(output, expected) {
+		t.Errorf("expected %q in output:\n%s", expected, output)
+	}
+	if strings.Count(output, "trace_id") != 1 {
+		t.Errorf("expected exactly one exemplar in output:\n%s", output)
+	}
+}
+
+func TestTraceIDFromRequest(t *testing.T) {
+	testCases := map[string]string{
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01": "4bf92f3577b34da6a3ce929d0e0e4736",
+		//not sampled
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00": "",
+		//invalid trace ID
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01": "",
+		"00-4bf92f3577b34da6a3ce929d0e0e473x-00f067aa0ba902b7-01": "",
+		"": "",
+	}
+	for header, expected := range testCases {
+		r := httptest.NewRequest("GET", "/metrics", nil)
+		r.Header.Set("traceparent", header)
+		actual := traceIDFromRequest(r)
+		if actual != expected {
+			t.Errorf("%q: expected trace ID %q, got %q", header, expected, actual)
+		}
+	}
+}
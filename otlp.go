@@ -0,0 +1,373 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+* Copyright 2015 The Prometheus Authors
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/version"
+)
+
+// otlpExporter sends all metrics from the metrics path to an OpenTelemetry
+// collector (or any other OTLP receiver) at a fixed interval.
+//
+// It uses OTLP over HTTP with the JSON encoding, since the protobuf encoding
+// would need the OpenTelemetry protobuf definitions, which are not vendored.
+type otlpExporter struct {
+	Collector     Collector
+	URL           string
+	Interval      time.Duration
+	InstanceLabel string
+	Headers       map[string]string
+	Hostname      string
+	//start of the cumulative counters and histograms
+	StartTime time.Time
+}
+
+// newOTLPExporter validates the OTLP flags and returns an otlpExporter without
+// Collector and InstanceLabel. Additional request headers (e.g. for
+// authentication) are taken from $OTEL_EXPORTER_OTLP_HEADERS.
+func newOTLPExporter(url string, interval time.Duration) (*otlpExporter, error) {
+	if interval <= 0 {
+		return nil, errors.New("-otlp.interval must be positive")
+	}
+	headers, err := parseOTLPHeaders(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"))
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse $OTEL_EXPORTER_OTLP_HEADERS: %s", err)
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("cannot determine hostname: %s", err)
+	}
+	return &otlpExporter{
+		URL:       url,
+		Interval:  interval,
+		Headers:   headers,
+		Hostname:  hostname,
+		StartTime: time.Now(),
+	}, nil
+}
+
+// parseOTLPHeaders parses the value of $OTEL_EXPORTER_OTLP_HEADERS, a comma-
+// separated list of "key=value" pairs with URL-encoded values.
+func parseOTLPHeaders(value string) (map[string]string, error) {
+	headers := make(map[string]string)
+	for _, field := range strings.Split(value, ",") {
+		if strings.TrimSpace(field) == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(field, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid header %q: expected \"key=value\"", field)
+		}
+		value, err := url.QueryUnescape(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid header %q: %s", key, err)
+		}
+		headers[key] = value
+	}
+	return headers, nil
+}
+
+// Run sends the metrics every e.Interval until ctx is cancelled, like
+// pusher.Run.
+func (e otlpExporter) Run(ctx context.Context) {
+	ticker := time.NewTicker(e.Interval)
+	defer ticker.Stop()
+	for {
+		err := e.export(ctx)
+		if err != nil && ctx.Err() == nil {
+			slog.Error("cannot export metrics with OTLP", "url", e.URL, "err", err)
+		} else {
+			slog.Debug("exported metrics with OTLP", "url", e.URL)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// export measures all servers and sends the results. Nothing is sent if any
+// metric could not be gathered.
+func (e otlpExporter) export(ctx context.Context) error {
+	//the measurement must not delay the next export
+	c := e.Collector
+	c.Deadline = time.Now().Add(e.Interval)
+	families, err := gatherMetrics(c, e.InstanceLabel)
+	if err != nil {
+		return err
+	}
+	if ctx.Err() != nil {
+		//the measurements were cut short by the shutdown
+		return ctx.Err()
+	}
+	body, err := json.Marshal(e.newRequest(families, time.Now()))
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, e.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for key, value := range e.Headers {
+		req.Header.Set(key, value)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "ntp_exporter/"+version.Version)
+	client := http.Client{Timeout: e.Interval}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// The JSON encoding of ExportMetricsServiceRequest from opentelemetry-proto,
+// in which 64-bit integers are encoded as strings, and enums as numbers.
+type (
+	otlpRequest struct {
+		ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+	}
+	otlpResourceMetrics struct {
+		Resource     otlpResource       `json:"resource"`
+		ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+	}
+	otlpResource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	}
+	otlpScopeMetrics struct {
+		Scope   otlpScope    `json:"scope"`
+		Metrics []otlpMetric `json:"metrics"`
+	}
+	otlpScope struct {
+		Name    string `json:"name"`
+		Version string `json:"version,omitempty"`
+	}
+	otlpAttribute struct {
+		Key   string             `json:"key"`
+		Value otlpAttributeValue `json:"value"`
+	}
+	otlpAttributeValue struct {
+		StringValue string `json:"stringValue"`
+	}
+	otlpMetric struct {
+		Name        string         `json:"name"`
+		Description string         `json:"description,omitempty"`
+		Gauge       *otlpGauge     `json:"gauge,omitempty"`
+		Sum         *otlpSum       `json:"sum,omitempty"`
+		Histogram   *otlpHistogram `json:"histogram,omitempty"`
+		Summary     *otlpSummary   `json:"summary,omitempty"`
+	}
+	otlpGauge struct {
+		DataPoints []otlpNumberDataPoint `json:"dataPoints"`
+	}
+	otlpSum struct {
+		DataPoints             []otlpNumberDataPoint `json:"dataPoints"`
+		AggregationTemporality int                   `json:"aggregationTemporality"`
+		IsMonotonic            bool                  `json:"isMonotonic"`
+	}
+	otlpHistogram struct {
+		DataPoints             []otlpHistogramDataPoint `json:"dataPoints"`
+		AggregationTemporality int                      `json:"aggregationTemporality"`
+	}
+	otlpSummary struct {
+		DataPoints []otlpSummaryDataPoint `json:"dataPoints"`
+	}
+	otlpNumberDataPoint struct {
+		Attributes        []otlpAttribute `json:"attributes,omitempty"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano,omitempty"`
+		TimeUnixNano      string          `json:"timeUnixNano"`
+		AsDouble          otlpDouble      `json:"asDouble"`
+	}
+	otlpHistogramDataPoint struct {
+		Attributes        []otlpAttribute `json:"attributes,omitempty"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano"`
+		TimeUnixNano      string          `json:"timeUnixNano"`
+		Count             string          `json:"count"`
+		Sum               otlpDouble      `json:"sum"`
+		BucketCounts      []string        `json:"bucketCounts"`
+		ExplicitBounds    []float64       `json:"explicitBounds"`
+	}
+	otlpSummaryDataPoint struct {
+		Attributes        []otlpAttribute     `json:"attributes,omitempty"`
+		StartTimeUnixNano string              `json:"startTimeUnixNano"`
+		TimeUnixNano      string              `json:"timeUnixNano"`
+		Count             string              `json:"count"`
+		Sum               otlpDouble          `json:"sum"`
+		QuantileValues    []otlpQuantileValue `json:"quantileValues"`
+	}
+	otlpQuantileValue struct {
+		Quantile float64    `json:"quantile"`
+		Value    otlpDouble `json:"value"`
+	}
+)
+
+// AGGREGATION_TEMPORALITY_CUMULATIVE
+const otlpCumulative = 2
+
+// otlpDouble is a float64 that is encoded like the protobuf JSON mapping does,
+// i.e. with NaN and infinities as strings, which encoding/json rejects.
+type otlpDouble float64
+
+// MarshalJSON implements the json.Marshaler interface.
+func (d otlpDouble) MarshalJSON() ([]byte, error) {
+	f := float64(d)
+	switch {
+	case math.IsNaN(f):
+		return []byte(`"NaN"`), nil
+	case math.IsInf(f, +1):
+		return []byte(`"Infinity"`), nil
+	case math.IsInf(f, -1):
+		return []byte(`"-Infinity"`), nil
+	default:
+		return json.Marshal(f)
+	}
+}
+
+func (e otlpExporter) newRequest(families []*dto.MetricFamily, now time.Time) otlpRequest {
+	timestamp := strconv.FormatInt(now.UnixNano(), 10)
+	startTimestamp := strconv.FormatInt(e.StartTime.UnixNano(), 10)
+
+	var metrics []otlpMetric
+	for _, family := range families {
+		metric := otlpMetric{Name: family.GetName(), Description: family.GetHelp()}
+		switch family.GetType() {
+		case dto.MetricType_COUNTER:
+			metric.Sum = &otlpSum{AggregationTemporality: otlpCumulative, IsMonotonic: true}
+			for _, m := range family.GetMetric() {
+				metric.Sum.DataPoints = append(metric.Sum.DataPoints, otlpNumberDataPoint{
+					Attributes:        otlpAttributes(m),
+					StartTimeUnixNano: startTimestamp,
+					TimeUnixNano:      timestamp,
+					AsDouble:          otlpDouble(m.GetCounter().GetValue()),
+				})
+			}
+		case dto.MetricType_HISTOGRAM:
+			metric.Histogram = &otlpHistogram{AggregationTemporality: otlpCumulative}
+			for _, m := range family.GetMetric() {
+				h := m.GetHistogram()
+				point := otlpHistogramDataPoint{
+					Attributes:        otlpAttributes(m),
+					StartTimeUnixNano: startTimestamp,
+					TimeUnixNano:      timestamp,
+					Count:             strconv.FormatUint(h.GetSampleCount(), 10),
+					Sum:               otlpDouble(h.GetSampleSum()),
+					ExplicitBounds:    []float64{},
+				}
+				//OTLP has the count per bucket instead of the cumulative
+				//count, and an implicit last bucket up to +Inf
+				previous := uint64(0)
+				for _, b := range h.GetBucket() {
+					point.BucketCounts = append(point.BucketCounts, strconv.FormatUint(b.GetCumulativeCount()-previous, 10))
+					point.ExplicitBounds = append(point.ExplicitBounds, b.GetUpperBound())
+					previous = b.GetCumulativeCount()
+				}
+				point.BucketCounts = append(point.BucketCounts, strconv.FormatUint(h.GetSampleCount()-previous, 10))
+				metric.Histogram.DataPoints = append(metric.Histogram.DataPoints, point)
+			}
+		case dto.MetricType_SUMMARY:
+			metric.Summary = &otlpSummary{}
+			for _, m := range family.GetMetric() {
+				s := m.GetSummary()
+				point := otlpSummaryDataPoint{
+					Attributes:        otlpAttributes(m),
+					StartTimeUnixNano: startTimestamp,
+					TimeUnixNano:      timestamp,
+					Count:             strconv.FormatUint(s.GetSampleCount(), 10),
+					Sum:               otlpDouble(s.GetSampleSum()),
+				}
+				for _, q := range s.GetQuantile() {
+					point.QuantileValues = append(point.QuantileValues, otlpQuantileValue{
+						Quantile: q.GetQuantile(),
+						Value:    otlpDouble(q.GetValue()),
+					})
+				}
+				metric.Summary.DataPoints = append(metric.Summary.DataPoints, point)
+			}
+		default:
+			//gauges and untyped metrics
+			metric.Gauge = &otlpGauge{}
+			for _, m := range family.GetMetric() {
+				value := m.GetGauge().GetValue()
+				if family.GetType() == dto.MetricType_UNTYPED {
+					value = m.GetUntyped().GetValue()
+				}
+				metric.Gauge.DataPoints = append(metric.Gauge.DataPoints, otlpNumberDataPoint{
+					Attributes:   otlpAttributes(m),
+					TimeUnixNano: timestamp,
+					AsDouble:     otlpDouble(value),
+				})
+			}
+		}
+		metrics = append(metrics, metric)
+	}
+
+	resource := otlpResource{Attributes: []otlpAttribute{
+		newOTLPAttribute("service.name", "ntp_exporter"),
+		newOTLPAttribute("service.instance.id", e.Hostname),
+		newOTLPAttribute("host.name", e.Hostname),
+	}}
+	if version.Version != "" {
+		resource.Attributes = append(resource.Attributes, newOTLPAttribute("service.version", version.Version))
+	}
+	return otlpRequest{ResourceMetrics: []otlpResourceMetrics{{
+		Resource: resource,
+		ScopeMetrics: []otlpScopeMetrics{{
+			Scope:   otlpScope{Name: "github.com/sapcc/ntp_exporter", Version: version.Version},
+			Metrics: metrics,
+		}},
+	}}}
+}
+
+func newOTLPAttribute(key, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpAttributeValue{StringValue: value}}
+}
+
+func otlpAttributes(m *dto.Metric) []otlpAttribute {
+	var result []otlpAttribute
+	for _, l := range m.GetLabel() {
+		result = append(result, newOTLPAttribute(l.GetName(), l.GetValue()))
+	}
+	return result
+}
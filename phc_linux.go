@@ -0,0 +1,50 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+* Copyright 2015 The Prometheus Authors
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// readPHC reads a PTP hardware clock (e.g. /dev/ptp0), and returns its time
+// minus system time (measured like "phc_ctl cmp" does).
+func readPHC(device string) (time.Duration, error) {
+	f, err := os.Open(device)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	//dynamic clock ID for a file descriptor, see FD_TO_CLOCKID in the kernel
+	clockID := uintptr((^int32(f.Fd()))<<3 | 3)
+
+	var ts syscall.Timespec
+	before := time.Now()
+	_, _, errno := syscall.Syscall(syscall.SYS_CLOCK_GETTIME, clockID, uintptr(unsafe.Pointer(&ts)), 0)
+	after := time.Now()
+	if errno != 0 {
+		return 0, errno
+	}
+	phcTime := time.Unix(ts.Unix())
+	return phcTime.Sub(before.Add(after.Sub(before) / 2)), nil
+}
@@ -0,0 +1,211 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+* Copyright 2015 The Prometheus Authors
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// probeHandler serves the /probe endpoint. Like the blackbox_exporter, it
+// measures the NTP server given in the "target" query parameter, so that the
+// set of measured servers can be managed in the Prometheus configuration.
+type probeHandler struct {
+	// Collector is used as a template for the Collector that serves each
+	// request. Its list of servers is ignored.
+	Collector Collector
+	// Server is used as a template for the probed server unless a module
+	// from the config file is selected with the "module" query parameter.
+	// Its address is ignored.
+	Server        Server
+	Buckets       HistogramBuckets
+	TimeoutOffset time.Duration
+	InstanceLabel string
+}
+
+// ServeHTTP implements the http.Handler interface.
+func (h probeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s, err := probeTarget(r.URL.Query(), h.Server, h.Collector.Config)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c := h.Collector
+	if value := r.URL.Query().Get("fail_on_error"); value != "" {
+		c.FailOnError, err = strconv.ParseBool(value)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid \"fail_on_error\" parameter: %q", value), http.StatusBadRequest)
+			return
+		}
+	}
+	c.Servers = []Server{s}
+	c.Config = nil
+	c.Discoverers = nil
+	c.NtpReferenceServer = ""
+	c.CircuitBreaker = nil
+	c.PollInterval = 0
+	c.Deadline = scrapeDeadline(r, h.TimeoutOffset)
+	c.TraceID = traceIDFromRequest(r)
+	c.metrics = newMetrics(h.Buckets)
+
+	registry := prometheus.NewRegistry()
+	err = registry.Register(probeCollector{c})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var gatherer prometheus.Gatherer = registry
+	if h.InstanceLabel != "" {
+		gatherer = instanceLabelGatherer{Gatherer: gatherer, Value: h.InstanceLabel}
+	}
+	serveMetrics(w, r, gatherer, c.metrics)
+}
+
+var (
+	probeSuccessDesc = prometheus.NewDesc(
+		"probe_success",
+		"Whether the probe was successful.",
+		nil, nil,
+	)
+	probeDurationDesc = prometheus.NewDesc(
+		"probe_duration_seconds",
+		"Returns how long the probe took to complete in seconds.",
+		nil, nil,
+	)
+)
+
+// probeCollector wraps the Collector for a /probe request to also report
+// probe_success and probe_duration_seconds, like the blackbox_exporter does,
+// so that dashboards and alerts for blackbox probes work for NTP probes, too.
+type probeCollector struct {
+	Collector
+}
+
+// Describe implements the prometheus.Collector interface.
+func (c probeCollector) Describe(ch chan<- *prometheus.Desc) {
+	c.Collector.Describe(ch)
+	ch <- probeSuccessDesc
+	ch <- probeDurationDesc
+}
+
+// Collect implements the prometheus.Collector interface.
+func (c probeCollector) Collect(ch chan<- prometheus.Metric) {
+	begin := time.Now()
+	c.Collector.Collect(ch)
+	duration := time.Since(begin)
+
+	c.status.Lock()
+	status, measured := c.status.ByServer[c.Servers[0].Address]
+	c.status.Unlock()
+	success := measured && status.Error == ""
+	ch <- prometheus.MustNewConstMetric(probeSuccessDesc, prometheus.GaugeValue, boolToFloat(success))
+	ch <- prometheus.MustNewConstMetric(probeDurationDesc, prometheus.GaugeValue, duration.Seconds())
+}
+
+// probeTarget returns the server to probe for the given query parameters: The
+// "target" parameter is the address of the server, and its settings are taken
+// from the module in the "module" parameter or from `template`, and overridden
+// by applyProbeParams.
+func probeTarget(params url.Values, template Server, config *configReloader) (Server, error) {
+	target := params.Get("target")
+	if target == "" {
+		return Server{}, errors.New("missing \"target\" parameter")
+	}
+
+	s := template
+	if module := params.Get("module"); module != "" {
+		var exists bool
+		if config != nil {
+			s, exists = config.Module(module)
+		}
+		if !exists {
+			return Server{}, fmt.Errorf("unknown module %q", module)
+		}
+	}
+	s.Address = target
+	err := applyProbeParams(&s, params)
+	return s, err
+}
+
+// applyProbeParams overrides the settings of the probed server with the
+// optional query parameters "version", "timeout", "duration" and "samples",
+// so that different classes of targets can be probed with different settings.
+// The configured timeout, duration and samples are upper limits for the query
+// parameters, so that a caller cannot make the exporter query a server for
+// longer or more often than the operator allowed.
+func applyProbeParams(s *Server, params url.Values) error {
+	if value := params.Get("version"); value != "" {
+		version, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid \"version\" parameter: %s", err)
+		}
+		err = checkProtocolVersion(version)
+		if err != nil {
+			return err
+		}
+		if version == 5 && s.NTS {
+			return errors.New("cannot use NTS with protocol version 5")
+		}
+		s.ProtocolVersion = version
+	}
+	if value := params.Get("timeout"); value != "" {
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout <= 0 {
+			return fmt.Errorf("invalid \"timeout\" parameter: %q", value)
+		}
+		maxTimeout := s.Timeout
+		if maxTimeout == 0 {
+			maxTimeout = ntpDefaultTimeout
+		}
+		if timeout > maxTimeout {
+			return fmt.Errorf("\"timeout\" parameter must not exceed %s", maxTimeout)
+		}
+		s.Timeout = timeout
+	}
+	if value := params.Get("duration"); value != "" {
+		duration, err := time.ParseDuration(value)
+		if err != nil || duration < 0 {
+			return fmt.Errorf("invalid \"duration\" parameter: %q", value)
+		}
+		if duration > s.MeasurementDuration {
+			return fmt.Errorf("\"duration\" parameter must not exceed %s", s.MeasurementDuration)
+		}
+		s.MeasurementDuration = duration
+	}
+	if value := params.Get("samples"); value != "" {
+		samples, err := strconv.Atoi(value)
+		if err != nil || samples < 0 {
+			return fmt.Errorf("invalid \"samples\" parameter: %q", value)
+		}
+		if s.MeasurementSamples > 0 && (samples == 0 || samples > s.MeasurementSamples) {
+			return fmt.Errorf("\"samples\" parameter must be between 1 and %d", s.MeasurementSamples)
+		}
+		s.MeasurementSamples = samples
+	}
+	return nil
+}
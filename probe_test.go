@@ -0,0 +1,110 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+* Copyright 2015 The Prometheus Authors
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProbeIgnoresDiscoveredServers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "targets.yaml")
+	err := os.WriteFile(path, []byte("- targets: [\"127.0.0.2:1\"]\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//nothing listens on port 1, so both servers fail right away
+	server := Server{ProtocolVersion: 4, Timeout: 100 * time.Millisecond}
+	h := probeHandler{
+		Collector: Collector{
+			Discoverers: []discoverer{&fileSD{Patterns: []string{path}, Defaults: server}},
+		},
+		Server: server,
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/probe?target=127.0.0.1:1", nil))
+
+	body := rec.Body.String()
+	if !strings.Contains(body, `server="127.0.0.1:1"`) {
+		t.Errorf("expected series for the probed server, got:\n%s", body)
+	}
+	if strings.Contains(body, "127.0.0.2") {
+		t.Errorf("expected no series for the discovered server, got:\n%s", body)
+	}
+}
+
+func TestDebugLimitsSamples(t *testing.T) {
+	//nothing listens on port 1, so every query fails right away
+	h := debugHandler{Server: Server{ProtocolVersion: 4, Timeout: 100 * time.Millisecond}}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/debug/ntp?target=127.0.0.1:1&samples=1000", nil))
+
+	var result debugResult
+	err := json.Unmarshal(rec.Body.Bytes(), &result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Queries) != maxDebugSamples {
+		t.Errorf("expected %d queries, got %d", maxDebugSamples, len(result.Queries))
+	}
+}
+
+func TestApplyProbeParamsLimits(t *testing.T) {
+	configured := Server{
+		ProtocolVersion:     4,
+		Timeout:             2 * time.Second,
+		MeasurementDuration: 30 * time.Second,
+		MeasurementSamples:  10,
+	}
+	testCases := []struct {
+		Query string
+		Error string
+	}{
+		{"timeout=1s&duration=10s&samples=5", ""},
+		{"timeout=2s&duration=30s&samples=10", ""},
+		{"timeout=3s", `"timeout" parameter must not exceed 2s`},
+		{"duration=1h", `"duration" parameter must not exceed 30s`},
+		{"samples=11", `"samples" parameter must be between 1 and 10`},
+		{"samples=0", `"samples" parameter must be between 1 and 10`},
+	}
+	for _, tc := range testCases {
+		params, err := url.ParseQuery(tc.Query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := configured
+		err = applyProbeParams(&s, params)
+		errMsg := ""
+		if err != nil {
+			errMsg = err.Error()
+		}
+		if errMsg != tc.Error {
+			t.Errorf("%s: expected error %q, got %q", tc.Query, tc.Error, errMsg)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+* Copyright 2015 The Prometheus Authors
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+//This implements GET requests of the PTP management protocol (IEEE 1588-2008,
+//section 15) over the Unix socket of ptp4l, like "pmc -u" does.
+
+const (
+	ptpHeaderLength           = 34
+	ptpManagementHeaderLength = 48
+
+	ptpMessageManagement = 0x0D
+	ptpVersion           = 2
+	ptpControlManagement = 4
+	ptpActionGet         = 0
+	ptpActionResponse    = 2
+
+	ptpTLVManagement            = 0x0001
+	ptpTLVManagementErrorStatus = 0x0002
+
+	ptpCurrentDataSet = 0x2001
+	ptpTimeStatusNP   = 0xC000 //linuxptp extension
+)
+
+var ptpManagementErrorNames = map[uint16]string{
+	0x0001: "response too big",
+	0x0002: "no such id",
+	0x0003: "wrong length",
+	0x0004: "wrong value",
+	0x0005: "not setable",
+	0x0006: "not supported",
+	0xFFFE: "general error",
+}
+
+// ptpClient queries ptp4l through its Unix socket (usually /var/run/ptp4l).
+type ptpClient struct {
+	Socket  string
+	Domain  uint8
+	Timeout time.Duration
+}
+
+// ptpConn is a connection to ptp4l, over which multiple requests can be sent.
+type ptpConn struct {
+	conn    *unixgramConn
+	client  ptpClient
+	portID  uint16
+	counter uint16
+}
+
+// Dial opens a connection to ptp4l.
+func (c ptpClient) Dial() (*ptpConn, error) {
+	conn, err := dialUnixgram(c.Socket)
+	if err != nil {
+		return nil, err
+	}
+	var seq [2]byte
+	_, err = rand.Read(seq[:])
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &ptpConn{
+		conn:    conn,
+		client:  c,
+		portID:  uint16(os.Getpid()),
+		counter: binary.BigEndian.Uint16(seq[:]),
+	}, nil
+}
+
+// Close closes the connection.
+func (c *ptpConn) Close() error {
+	return c.conn.Close()
+}
+
+// get sends a GET request for the given management ID and returns the data
+// of the response.
+func (c *ptpConn) get(managementID uint16) ([]byte, error) {
+	err := c.conn.SetDeadline(time.Now().Add(c.client.Timeout))
+	if err != nil {
+		return nil, err
+	}
+
+	c.counter++
+	sequence := c.counter
+	req := make([]byte, ptpManagementHeaderLength+6)
+	req[0] = ptpMessageManagement
+	req[1] = ptpVersion
+	binary.BigEndian.PutUint16(req[2:], uint16(len(req)))
+	req[4] = c.client.Domain
+	//sourcePortIdentity: clock identity stays zero, port number is our PID
+	binary.BigEndian.PutUint16(req[28:], c.portID)
+	binary.BigEndian.PutUint16(req[30:], sequence)
+	req[32] = ptpControlManagement
+	req[33] = 0x7F //logMessageInterval
+	//targetPortIdentity: all ones (wildcard)
+	for idx := 34; idx < 44; idx++ {
+		req[idx] = 0xFF
+	}
+	req[46] = ptpActionGet
+	binary.BigEndian.PutUint16(req[48:], ptpTLVManagement)
+	binary.BigEndian.PutUint16(req[50:], 2)
+	binary.BigEndian.PutUint16(req[52:], managementID)
+	_, err = c.conn.Write(req)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		resp := buf[:n]
+		if n < ptpManagementHeaderLength+6 || resp[0]&0x0F != ptpMessageManagement ||
+			binary.BigEndian.Uint16(resp[30:]) != sequence || resp[46]&0x0F != ptpActionResponse {
+			continue //not a response to our request
+		}
+		tlvType := binary.BigEndian.Uint16(resp[48:])
+		tlvLength := int(binary.BigEndian.Uint16(resp[50:]))
+		if tlvLength < 2 || ptpManagementHeaderLength+4+tlvLength > n {
+			return nil, errors.New("ptp4l sent a malformed response")
+		}
+		switch tlvType {
+		case ptpTLVManagement:
+			if binary.BigEndian.Uint16(resp[52:]) != managementID {
+				return nil, errors.New("ptp4l sent a response for the wrong management ID")
+			}
+			return resp[54 : 52+tlvLength], nil
+		case ptpTLVManagementErrorStatus:
+			code := binary.BigEndian.Uint16(resp[52:])
+			name, exists := ptpManagementErrorNames[code]
+			if !exists {
+				name = fmt.Sprintf("error 0x%04X", code)
+			}
+			return nil, errors.New("ptp4l refused request: " + name)
+		default:
+			return nil, fmt.Errorf("ptp4l sent a response with unexpected TLV type 0x%04X", tlvType)
+		}
+	}
+}
+
+// ptpCurrentData is the CURRENT_DATA_SET of the PTP clock.
+type ptpCurrentData struct {
+	StepsRemoved     uint16
+	OffsetFromMaster float64 //in seconds
+	MeanPathDelay    float64 //in seconds
+}
+
+// CurrentDataSet executes "GET CURRENT_DATA_SET".
+func (c *ptpConn) CurrentDataSet() (ptpCurrentData, error) {
+	data, err := c.get(ptpCurrentDataSet)
+	if err != nil {
+		return ptpCurrentData{}, err
+	}
+	if len(data) < 18 {
+		return ptpCurrentData{}, errors.New("ptp4l sent a short CURRENT_DATA_SET")
+	}
+	return ptpCurrentData{
+		StepsRemoved:     binary.BigEndian.Uint16(data[0:]),
+		OffsetFromMaster: ptpTimeInterval(data[2:]),
+		MeanPathDelay:    ptpTimeInterval(data[10:]),
+	}, nil
+}
+
+// ptpTimeStatus is the TIME_STATUS_NP data set of ptp4l.
+type ptpTimeStatus struct {
+	MasterOffset float64 //in seconds
+	//frequency offset to the grandmaster in parts per million
+	RateOffsetPPM      float64
+	GrandmasterPresent bool
+	GrandmasterID      string
+}
+
+// TimeStatus executes "GET TIME_STATUS_NP".
+func (c *ptpConn) TimeStatus() (ptpTimeStatus, error) {
+	data, err := c.get(ptpTimeStatusNP)
+	if err != nil {
+		return ptpTimeStatus{}, err
+	}
+	if len(data) < 50 {
+		return ptpTimeStatus{}, errors.New("ptp4l sent a short TIME_STATUS_NP")
+	}
+	id := data[42:50]
+	return ptpTimeStatus{
+		MasterOffset: float64(int64(binary.BigEndian.Uint64(data[0:]))) / 1e9,
+		//cumulativeScaledRateOffset is (rateRatio - 1) * 2^41
+		RateOffsetPPM:      float64(int32(binary.BigEndian.Uint32(data[16:]))) / (1 << 41) * 1e6,
+		GrandmasterPresent: binary.BigEndian.Uint32(data[38:]) != 0,
+		GrandmasterID: fmt.Sprintf("%02x%02x%02x.%02x%02x.%02x%02x%02x",
+			id[0], id[1], id[2], id[3], id[4], id[5], id[6], id[7]),
+	}, nil
+}
+
+// ptpTimeInterval decodes a TimeInterval (nanoseconds multiplied by 2^16)
+// into seconds.
+func ptpTimeInterval(b []byte) float64 {
+	return float64(int64(binary.BigEndian.Uint64(b))) / (1 << 16) / 1e9
+}
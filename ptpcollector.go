@@ -0,0 +1,140 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+* Copyright 2015 The Prometheus Authors
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"log/slog"
+)
+
+var (
+	ptpUpDesc = prometheus.NewDesc(
+		"ptp_up",
+		"Whether the last query to ptp4l succeeded (1) or not (0).",
+		nil, nil,
+	)
+	ptpOffsetDesc = prometheus.NewDesc(
+		"ptp_offset_from_master_seconds",
+		"Offset of the PTP clock from its master, as measured by ptp4l.",
+		nil, nil,
+	)
+	ptpMeanPathDelayDesc = prometheus.NewDesc(
+		"ptp_mean_path_delay_seconds",
+		"Mean propagation delay between the master and the PTP clock.",
+		nil, nil,
+	)
+	ptpStepsRemovedDesc = prometheus.NewDesc(
+		"ptp_steps_removed",
+		"Number of communication paths between the grandmaster and the PTP clock.",
+		nil, nil,
+	)
+	ptpFrequencyOffsetDesc = prometheus.NewDesc(
+		"ptp_frequency_offset_ppm",
+		"Frequency offset of the master relative to the PTP clock, in parts per million.",
+		nil, nil,
+	)
+	ptpGrandmasterPresentDesc = prometheus.NewDesc(
+		"ptp_grandmaster_present",
+		"Whether ptp4l currently receives time from a grandmaster (1) or not (0).",
+		nil, nil,
+	)
+	ptpGrandmasterDesc = prometheus.NewDesc(
+		"ptp_grandmaster_info",
+		"Clock identity of the grandmaster (always 1).",
+		[]string{"clock_identity"}, nil,
+	)
+	ptpPHCOffsetDesc = prometheus.NewDesc(
+		"ptp_phc_offset_seconds",
+		"Time of the PTP hardware clock minus system time. This usually includes the offset between TAI and UTC.",
+		[]string{"device"}, nil,
+	)
+)
+
+// ptpCollector reports the state of PTP synchronization on the host. If a
+// Client socket is set, ptp4l is queried through its management interface. If
+// a PHCDevice is set, the PTP hardware clock is compared with the system
+// clock, which shows how well phc2sys synchronizes the two.
+type ptpCollector struct {
+	Client    ptpClient
+	PHCDevice string
+}
+
+// Describe implements the prometheus.Collector interface.
+func (c ptpCollector) Describe(ch chan<- *prometheus.Desc) {
+	if c.Client.Socket != "" {
+		ch <- ptpUpDesc
+		ch <- ptpOffsetDesc
+		ch <- ptpMeanPathDelayDesc
+		ch <- ptpStepsRemovedDesc
+		ch <- ptpFrequencyOffsetDesc
+		ch <- ptpGrandmasterPresentDesc
+		ch <- ptpGrandmasterDesc
+	}
+	if c.PHCDevice != "" {
+		ch <- ptpPHCOffsetDesc
+	}
+}
+
+// Collect implements the prometheus.Collector interface.
+func (c ptpCollector) Collect(ch chan<- prometheus.Metric) {
+	gauge := func(desc *prometheus.Desc, value float64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, labels...)
+	}
+	if c.PHCDevice != "" {
+		offset, err := readPHC(c.PHCDevice)
+		if err != nil {
+			slog.Error("couldn't read PTP hardware clock", "device", c.PHCDevice, "err", err)
+		} else {
+			gauge(ptpPHCOffsetDesc, offset.Seconds(), c.PHCDevice)
+		}
+	}
+	if c.Client.Socket != "" {
+		gauge(ptpUpDesc, boolToFloat(c.collectManagement(gauge)))
+	}
+}
+
+func (c ptpCollector) collectManagement(gauge func(*prometheus.Desc, float64, ...string)) bool {
+	conn, err := c.Client.Dial()
+	if err != nil {
+		slog.Error("couldn't connect to ptp4l", "socket", c.Client.Socket, "err", err)
+		return false
+	}
+	defer conn.Close()
+
+	current, err := conn.CurrentDataSet()
+	if err != nil {
+		slog.Error("couldn't get CURRENT_DATA_SET from ptp4l", "socket", c.Client.Socket, "err", err)
+		return false
+	}
+	gauge(ptpOffsetDesc, current.OffsetFromMaster)
+	gauge(ptpMeanPathDelayDesc, current.MeanPathDelay)
+	gauge(ptpStepsRemovedDesc, float64(current.StepsRemoved))
+
+	status, err := conn.TimeStatus()
+	if err != nil {
+		slog.Error("couldn't get TIME_STATUS_NP from ptp4l", "socket", c.Client.Socket, "err", err)
+		return false
+	}
+	gauge(ptpFrequencyOffsetDesc, status.RateOffsetPPM)
+	gauge(ptpGrandmasterPresentDesc, boolToFloat(status.GrandmasterPresent))
+	gauge(ptpGrandmasterDesc, 1, status.GrandmasterID)
+	return true
+}
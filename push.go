@@ -0,0 +1,117 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+* Copyright 2015 The Prometheus Authors
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/expfmt"
+)
+
+// pusher pushes all metrics from the metrics path to a Pushgateway at a fixed
+// interval, for hosts that Prometheus cannot scrape.
+//
+// The push package of client_golang is not used since it treats every status
+// other than 202 as an error, while newer Pushgateways respond with 200.
+type pusher struct {
+	Collector     Collector
+	URL           string
+	Job           string
+	Instance      string
+	Interval      time.Duration
+	InstanceLabel string
+}
+
+// Run pushes the metrics every p.Interval until ctx is cancelled. A push that
+// is being sent at that time is completed, but measurements that are cut
+// short by the cancellation are not pushed.
+func (p pusher) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.Interval)
+	defer ticker.Stop()
+	for {
+		err := p.push(ctx)
+		if err != nil && ctx.Err() == nil {
+			slog.Error("cannot push metrics to Pushgateway", "url", p.URL, "err", err)
+		} else {
+			slog.Debug("pushed metrics to Pushgateway", "url", p.URL)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// push measures all servers and replaces the metrics in the group of this
+// exporter on the Pushgateway with the results. Nothing is pushed if any
+// metric could not be gathered, so that the Pushgateway keeps the last
+// complete set of metrics.
+func (p pusher) push(ctx context.Context) error {
+	//the measurement must not delay the next push
+	c := p.Collector
+	c.Deadline = time.Now().Add(p.Interval)
+	families, err := gatherMetrics(c, p.InstanceLabel)
+	if err != nil {
+		return err
+	}
+	if ctx.Err() != nil {
+		//the measurements were cut short by the shutdown
+		return ctx.Err()
+	}
+	var buf bytes.Buffer
+	err = writeMetricFamilies(&buf, families)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPut, p.groupURL(), &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", string(expfmt.FmtText))
+	client := http.Client{Timeout: p.Interval}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// groupURL returns the URL of the group of this exporter on the Pushgateway,
+// which is identified by the job and instance labels.
+func (p pusher) groupURL() string {
+	return fmt.Sprintf("%s/metrics/job/%s/instance/%s",
+		strings.TrimSuffix(p.URL, "/"), url.PathEscape(p.Job), url.PathEscape(p.Instance))
+}
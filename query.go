@@ -0,0 +1,575 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+* Copyright 2015 The Prometheus Authors
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/beevik/ntp"
+)
+
+//This file contains a minimal SNTP client. We do not use ntp.QueryWithOptions
+//because it does not give us access to the underlying socket. The result is
+//still reported as an ntp.Response, so that the rest of the exporter does not
+//need to care.
+
+const (
+	ntpPacketSize     = 48
+	ntpModeClient     = 3
+	ntpModeServer     = 4
+	ntpDefaultTimeout = 5 * time.Second
+)
+
+var (
+	ntpEpoch = time.Date(1900, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	errTruncatedResponse = errors.New("truncated response")
+)
+
+// recentTransmitTimestamps remembers the transmit timestamps of the most
+// recent queries. A response with an origin timestamp that is not in here
+// was not caused by us. A response whose origin timestamp matches an earlier
+// query (but not the current one) is just late.
+var recentTransmitTimestamps = struct {
+	sync.Mutex
+	ring [256]uint64
+	next int
+}{}
+
+func rememberTransmitTimestamp(ts uint64) {
+	recentTransmitTimestamps.Lock()
+	defer recentTransmitTimestamps.Unlock()
+	r := &recentTransmitTimestamps
+	r.ring[r.next] = ts
+	r.next = (r.next + 1) % len(r.ring)
+}
+
+func isRecentTransmitTimestamp(ts uint64) bool {
+	recentTransmitTimestamps.Lock()
+	defer recentTransmitTimestamps.Unlock()
+	for _, t := range recentTransmitTimestamps.ring {
+		if t == ts && t != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// queryOptions contains the settings for a single NTP query.
+type queryOptions struct {
+	Network         string //"udp", "udp4" or "udp6" (default: depends on SourceAddress and AddressFamily)
+	Version         int
+	Timeout         time.Duration
+	ReadBufferBytes int           //0 means system default
+	SourcePort      int           //0 means an ephemeral port
+	SourceAddress   net.IP        //nil means that the system picks the source address
+	AddressFamily   string        //key into addressFamilies (ignored if Network or SourceAddress is set)
+	DSCP            int           //0 means that packets are not marked
+	NTS             *ntsRequest   //nil if NTS is not used
+	Key             *symmetricKey //nil if symmetric-key authentication is not used
+	Interleaved     bool          //follow up with a query in interleaved mode
+	Result          *queryResult  //if not nil, receives details about the response
+	//if not nil, the query is aborted when this is cancelled
+	Context context.Context
+}
+
+// queryResult contains details about the response to a query that do not fit
+// into ntp.Response.
+type queryResult struct {
+	Version     int    //protocol version of the response
+	Interleaved bool   //whether the offset was measured in interleaved mode
+	Address     string //IP address that answered
+	//t1..t4 of the exchange that the offset was measured from, as in RFC 5905,
+	//section 8
+	Timestamps [4]time.Time
+	//kiss code if the response was a kiss-of-death packet (only set by
+	//Collector.queryWithResult)
+	KissCode string
+	//number of responses that were discarded because their origin timestamp
+	//did not match any recent query (replayed or spoofed)
+	ReplayedResponses int
+}
+
+// setTimestamps records the timestamps of the exchange that the offset was
+// measured from. It does nothing if the receiver is nil.
+func (r *queryResult) setTimestamps(p ntpPacket, xmitTime, recvTime time.Time) {
+	if r != nil {
+		r.Timestamps = [4]time.Time{xmitTime, ntpTimestampToTime(p.ReceiveTime), ntpTimestampToTime(p.TransmitTime), recvTime}
+	}
+}
+
+// ntpPacket is the NTP packet header as described in RFC 5905, section 7.3.
+type ntpPacket struct {
+	LiVnMode       uint8
+	Stratum        uint8
+	Poll           int8
+	Precision      int8
+	RootDelay      uint32
+	RootDispersion uint32
+	ReferenceID    uint32
+	ReferenceTime  uint64
+	OriginTime     uint64
+	ReceiveTime    uint64
+	TransmitTime   uint64
+}
+
+func (p ntpPacket) leap() ntp.LeapIndicator {
+	return ntp.LeapIndicator(p.LiVnMode >> 6)
+}
+
+func (p ntpPacket) mode() uint8 {
+	return p.LiVnMode & 0x07
+}
+
+// addressFamilies maps the values of -ntp.address-family to the networks that
+// the server is resolved in, in order of preference.
+var addressFamilies = map[string][]string{
+	"any":         {"udp"},
+	"ipv4":        {"udp4"},
+	"ipv6":        {"udp6"},
+	"prefer-ipv6": {"udp6", "udp4"},
+}
+
+// sourcePortMutex serializes queries with a fixed source port, since only one
+// socket can be bound to it at a time.
+var sourcePortMutex sync.Mutex
+
+// splitServerAddress splits the address of an NTP server ("host",
+// "host:port" or "[ipv6]:port") into host and port. The port defaults to 123.
+func splitServerAddress(address string) (host, port string) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		//no port given (this includes bare IPv6 addresses)
+		return strings.TrimSuffix(strings.TrimPrefix(address, "["), "]"), "123"
+	}
+	return host, port
+}
+
+// joinServerAddress is the reverse of splitServerAddress. The default port
+// 123 is omitted, so that servers on the default port keep their plain
+// hostname or IP address as address.
+func joinServerAddress(host string, port int) string {
+	if port == 0 || port == 123 {
+		return host
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+func queryServer(address string, opts queryOptions) (*ntp.Response, error) {
+	var networks []string
+	switch {
+	case opts.Network != "":
+		networks = []string{opts.Network}
+	case opts.SourceAddress != nil:
+		//resolve the server to an address of the same family as the source
+		//address
+		networks = []string{"udp6"}
+		if opts.SourceAddress.To4() != nil {
+			networks = []string{"udp4"}
+		}
+	case opts.AddressFamily != "":
+		networks = addressFamilies[opts.AddressFamily]
+	default:
+		networks = []string{"udp"}
+	}
+	host, port := splitServerAddress(address)
+	if opts.NTS != nil {
+		//the NTS-KE server may direct us to a different NTP server
+		host, port = opts.NTS.Session.Host, opts.NTS.Session.Port
+	}
+	var (
+		network string
+		raddr   *net.UDPAddr
+		err     error
+	)
+	for _, network = range networks {
+		raddr, err = net.ResolveUDPAddr(network, net.JoinHostPort(host, port))
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	var laddr *net.UDPAddr
+	if opts.SourcePort != 0 || opts.SourceAddress != nil {
+		laddr = &net.UDPAddr{IP: opts.SourceAddress, Port: opts.SourcePort}
+	}
+	if opts.SourcePort != 0 {
+		sourcePortMutex.Lock()
+		defer sourcePortMutex.Unlock()
+	}
+	conn, err := net.DialUDP(network, laddr, raddr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if opts.Result != nil {
+		opts.Result.Address = raddr.IP.String()
+	}
+
+	if opts.ReadBufferBytes > 0 {
+		//not all platforms honor this, so a failure is not fatal
+		err := conn.SetReadBuffer(opts.ReadBufferBytes)
+		if err != nil {
+			slog.Debug("cannot set read buffer size", "bytes", opts.ReadBufferBytes, "err", err)
+		}
+	}
+	if opts.DSCP != 0 {
+		err := setDSCP(conn, opts.DSCP)
+		if err != nil {
+			return nil, fmt.Errorf("cannot set DSCP: %s", err)
+		}
+	}
+
+	timeout := opts.Timeout
+	if timeout == 0 {
+		timeout = ntpDefaultTimeout
+	}
+	err = conn.SetDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return nil, err
+	}
+	if opts.Context != nil {
+		//abort by letting the pending read or write time out right away
+		stop := context.AfterFunc(opts.Context, func() {
+			conn.SetDeadline(time.Now())
+		})
+		defer stop()
+	}
+
+	version := opts.Version
+	if version == 5 {
+		if opts.NTS != nil || opts.Key != nil {
+			return nil, errors.New("NTPv5 cannot be used with NTS or symmetric keys")
+		}
+		//NTPv5 support is negotiated with an NTPv4 query (see ntpv5.go)
+		version = 4
+	}
+	req := ntpPacket{
+		LiVnMode: uint8(ntp.LeapNotInSync)<<6 | uint8(version)<<3 | ntpModeClient,
+	}
+	if opts.Version == 5 {
+		req.ReferenceTime = ntpv5NegotiationMagic
+	}
+	resp, xmitTime, recvTime, err := exchange(conn, host, req, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Version == 5 && resp.ReferenceTime == ntpv5NegotiationMagic {
+		if opts.Result != nil {
+			opts.Result.Version = 5
+		}
+		return queryNTPv5(conn, host, resp.ReferenceID, opts.Result)
+	}
+	if opts.Result != nil {
+		opts.Result.Version = int(resp.LiVnMode>>3) & 0x07
+	}
+	if opts.Interleaved && resp.Stratum != 0 {
+		return queryInterleaved(conn, host, resp, xmitTime, recvTime, opts)
+	}
+	opts.Result.setTimestamps(resp, xmitTime, recvTime)
+	return parseResponse(resp, xmitTime, recvTime), nil
+}
+
+// queryInterleaved follows up on a query in basic mode with a query in
+// interleaved mode (RFC 9769). The interleaved response contains the time when
+// the previous response actually left the server, which is more accurate than
+// the transmit timestamp in the previous response itself, especially on
+// loaded servers. If the server does not support interleaved mode, it answers
+// in basic mode, and that response is used instead.
+func queryInterleaved(conn *net.UDPConn, host string, prev ntpPacket, prevXmitTime, prevRecvTime time.Time, opts queryOptions) (*ntp.Response, error) {
+	req := ntpPacket{
+		LiVnMode:    prev.LiVnMode&0x38 | uint8(ntp.LeapNotInSync)<<6 | ntpModeClient,
+		OriginTime:  prev.ReceiveTime,
+		ReceiveTime: timeToNtpTimestamp(prevRecvTime),
+	}
+	resp, xmitTime, recvTime, err := exchange(conn, host, req, opts)
+	if err != nil {
+		return nil, err
+	}
+	if resp.OriginTime != req.ReceiveTime {
+		slog.Debug("server does not support interleaved mode", "server", host)
+		opts.Result.setTimestamps(resp, xmitTime, recvTime)
+		return parseResponse(resp, xmitTime, recvTime), nil
+	}
+
+	//measure the previous exchange, with the accurate transmit timestamp
+	if prev.ReceiveTime > resp.TransmitTime {
+		return nil, errors.New("server clock ticked backwards")
+	}
+	p := resp
+	p.ReceiveTime = prev.ReceiveTime
+	if opts.Result != nil {
+		opts.Result.Interleaved = true
+	}
+	opts.Result.setTimestamps(p, prevXmitTime, prevRecvTime)
+	return parseResponse(p, prevXmitTime, prevRecvTime), nil
+}
+
+// exchange sends the given request and waits for the matching response. Like
+// ntpd, we send a random transmit timestamp to make off-path spoofing harder,
+// and remember the actual transmit time locally. A response matches if its
+// origin timestamp is the transmit timestamp of the request or, in interleaved
+// mode, the receive timestamp of the request.
+func exchange(conn *net.UDPConn, host string, req ntpPacket, opts queryOptions) (resp ntpPacket, xmitTime, recvTime time.Time, err error) {
+	var nonce [8]byte
+	_, err = rand.Read(nonce[:])
+	if err != nil {
+		return
+	}
+	req.TransmitTime = binary.BigEndian.Uint64(nonce[:])
+	rememberTransmitTimestamp(req.TransmitTime)
+
+	var packet bytes.Buffer
+	err = binary.Write(&packet, binary.BigEndian, &req)
+	if err != nil {
+		return
+	}
+	data := packet.Bytes()
+	if opts.NTS != nil {
+		data, err = opts.NTS.appendExtensionFields(data)
+		if err != nil {
+			return
+		}
+	}
+	if opts.Key != nil {
+		data, err = opts.Key.appendMAC(data)
+		if err != nil {
+			return
+		}
+	}
+
+	xmitTime = time.Now()
+	_, err = conn.Write(data)
+	if err != nil {
+		return
+	}
+
+	buf := make([]byte, 2048)
+	for {
+		var n int
+		n, err = conn.Read(buf)
+		if err != nil {
+			return
+		}
+		recvTime = xmitTime.Add(time.Since(xmitTime))
+		if n < ntpPacketSize {
+			err = errTruncatedResponse
+			return
+		}
+
+		err = binary.Read(bytes.NewReader(buf[:ntpPacketSize]), binary.BigEndian, &resp)
+		if err != nil {
+			return
+		}
+		slog.Debug("received NTP response", "server", host,
+			"transmit_timestamp", fmt.Sprintf("%016x", req.TransmitTime), "origin_timestamp", fmt.Sprintf("%016x", resp.OriginTime))
+
+		interleaved := req.ReceiveTime != 0 && resp.OriginTime == req.ReceiveTime
+		if resp.OriginTime != req.TransmitTime && !interleaved {
+			if isRecentTransmitTimestamp(resp.OriginTime) {
+				//late response to an earlier query, keep waiting for ours
+				slog.Debug("discarding late response", "server", host)
+			} else {
+				//replayed or spoofed, but the real response may still come
+				slog.Debug("discarding response that does not belong to any recent query", "server", host)
+				if opts.Result != nil {
+					opts.Result.ReplayedResponses++
+				}
+			}
+			continue
+		}
+
+		switch {
+		case resp.mode() != ntpModeServer:
+			err = errors.New("invalid mode in response")
+		case resp.TransmitTime == 0:
+			err = errors.New("invalid transmit time in response")
+		case resp.ReceiveTime > resp.TransmitTime && !interleaved:
+			//(in interleaved mode, the transmit timestamp belongs to the
+			//previous response and is thus older than the receive timestamp)
+			err = errors.New("server clock ticked backwards")
+		}
+		if err != nil {
+			return
+		}
+		if opts.NTS != nil {
+			err = opts.NTS.verifyResponse(buf[:n])
+			if err != nil {
+				err = ntsVerificationError{err}
+				return
+			}
+		}
+		if opts.Key != nil {
+			err = opts.Key.verifyMAC(buf[:n])
+			if err != nil {
+				return
+			}
+		}
+		return
+	}
+}
+
+// queryResults contains the values of the "result" label of ntp_queries_total.
+var queryResults = []string{"success", "timeout", "network_error", "invalid_response", "kiss_of_death"}
+
+// classifyQueryError returns the "result" label of ntp_queries_total for a
+// query that failed with the given error.
+func classifyQueryError(err error) string {
+	netErr, ok := err.(net.Error)
+	switch {
+	case ok && netErr.Timeout():
+		return "timeout"
+	case ok:
+		return "network_error"
+	default:
+		//all other errors come from checking the response
+		return "invalid_response"
+	}
+}
+
+// isSuspectedDrop returns whether the given query error indicates that the
+// response was lost or mangled on its way to us.
+func isSuspectedDrop(err error) bool {
+	if err == errTruncatedResponse {
+		return true
+	}
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+func parseResponse(p ntpPacket, xmitTime, recvTime time.Time) *ntp.Response {
+	//t1..t4 as in RFC 5905, section 8
+	t1 := xmitTime
+	t2 := ntpTimestampToTime(p.ReceiveTime)
+	t3 := ntpTimestampToTime(p.TransmitTime)
+	t4 := recvTime
+
+	rtt := t4.Sub(t1) - t3.Sub(t2)
+	if rtt < 0 {
+		rtt = 0
+	}
+	rootDelay := ntpShortToDuration(p.RootDelay)
+	rootDispersion := ntpShortToDuration(p.RootDispersion)
+
+	//if the timestamps violate causality (because client and server clocks
+	//disagree), the amount of the violation is a lower bound for the error
+	var minError time.Duration
+	if d := t1.Sub(t2); d > minError {
+		minError = d
+	}
+	if d := t3.Sub(t4); d > minError {
+		minError = d
+	}
+
+	r := &ntp.Response{
+		Time:           t3,
+		ClockOffset:    (t2.Sub(t1) + t3.Sub(t4)) / 2,
+		RTT:            rtt,
+		Precision:      log2ToDuration(p.Precision),
+		Stratum:        p.Stratum,
+		ReferenceID:    p.ReferenceID,
+		ReferenceTime:  ntpTimestampToTime(p.ReferenceTime),
+		RootDelay:      rootDelay,
+		RootDispersion: rootDispersion,
+		RootDistance:   (rtt+rootDelay)/2 + rootDispersion,
+		Leap:           p.leap(),
+		MinError:       minError,
+		Poll:           log2ToDuration(p.Poll),
+	}
+	if p.Stratum == 0 {
+		r.KissCode = kissCode(p.ReferenceID)
+	}
+	return r
+}
+
+// ntpTimestampToTime converts a 64-bit NTP timestamp (32.32 fixed point
+// seconds since 1900) into a time.Time.
+func ntpTimestampToTime(t uint64) time.Time {
+	sec := time.Duration(t>>32) * time.Second
+	nsec := time.Duration(((t & 0xFFFFFFFF) * 1e9) >> 32)
+	return ntpEpoch.Add(sec + nsec)
+}
+
+// timeToNtpTimestamp converts a time.Time into a 64-bit NTP timestamp.
+func timeToNtpTimestamp(t time.Time) uint64 {
+	d := t.Sub(ntpEpoch)
+	sec := uint64(d / time.Second)
+	frac := (uint64(d%time.Second) << 32) / 1e9
+	return sec<<32 | frac
+}
+
+// ntpShortToDuration converts a 32-bit NTP short format value (16.16 fixed
+// point seconds) into a time.Duration.
+func ntpShortToDuration(t uint32) time.Duration {
+	sec := time.Duration(t>>16) * time.Second
+	nsec := time.Duration((uint64(t&0xFFFF) * 1e9) >> 16)
+	return sec + nsec
+}
+
+// log2ToDuration converts a log2 seconds value (as used for the poll and
+// precision fields) into a time.Duration.
+func log2ToDuration(exp int8) time.Duration {
+	switch {
+	case exp > 0:
+		return time.Second << uint(exp)
+	case exp < 0:
+		return time.Second >> uint(-exp)
+	default:
+		return time.Second
+	}
+}
+
+// formatReferenceID formats a reference ID for display. For stratum 0 and 1,
+// it is an ASCII string (a kiss code or the type of the reference clock, e.g.
+// "GPS"). For higher strata, it identifies the upstream server, usually by its
+// IPv4 address.
+func formatReferenceID(stratum uint8, refID uint32) string {
+	if stratum <= 1 {
+		return strings.TrimSpace(kissCode(refID))
+	}
+	return net.IPv4(byte(refID>>24), byte(refID>>16), byte(refID>>8), byte(refID)).String()
+}
+
+// kissCode returns the ASCII kiss code from the reference ID of a
+// kiss-of-death packet, or "" if it is not printable.
+func kissCode(refID uint32) string {
+	b := []byte{byte(refID >> 24), byte(refID >> 16), byte(refID >> 8), byte(refID)}
+	for _, ch := range bytes.TrimRight(b, "\x00") {
+		if ch < 32 || ch > 126 {
+			return ""
+		}
+	}
+	return string(bytes.TrimRight(b, "\x00"))
+}
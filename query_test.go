@@ -0,0 +1,83 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+* Copyright 2015 The Prometheus Authors
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestExchangeSkipsReplayedResponses(t *testing.T) {
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	//answer with a response to an unknown query first, then with the real one
+	go func() {
+		buf := make([]byte, 2048)
+		n, addr, err := server.ReadFromUDP(buf)
+		if err != nil || n < ntpPacketSize {
+			return
+		}
+		var req ntpPacket
+		err = binary.Read(bytes.NewReader(buf[:ntpPacketSize]), binary.BigEndian, &req)
+		if err != nil {
+			return
+		}
+		for _, origin := range []uint64{req.TransmitTime + 1, req.TransmitTime} {
+			resp := ntpPacket{
+				LiVnMode:     4<<3 | ntpModeServer,
+				Stratum:      1,
+				OriginTime:   origin,
+				ReceiveTime:  1 << 32,
+				TransmitTime: 2 << 32,
+			}
+			var packet bytes.Buffer
+			binary.Write(&packet, binary.BigEndian, &resp)
+			server.WriteToUDP(packet.Bytes(), addr)
+		}
+	}()
+
+	conn, err := net.DialUDP("udp", nil, server.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	result := &queryResult{}
+	req := ntpPacket{LiVnMode: 4<<3 | ntpModeClient}
+	resp, _, _, err := exchange(conn, "127.0.0.1", req, queryOptions{Result: result})
+	if err != nil {
+		t.Fatalf("expected the real response, got error: %s", err)
+	}
+	if resp.Stratum != 1 {
+		t.Errorf("expected stratum 1, got %d", resp.Stratum)
+	}
+	if result.ReplayedResponses != 1 {
+		t.Errorf("expected 1 replayed response, got %d", result.ReplayedResponses)
+	}
+}
@@ -0,0 +1,68 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+* Copyright 2015 The Prometheus Authors
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// reloadOnSIGHUP reloads the config file whenever the process receives
+// SIGHUP. It does not return.
+func reloadOnSIGHUP(c Collector) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		err := c.reloadConfig()
+		if err != nil {
+			slog.Error("config reload failed", "err", err)
+		}
+	}
+}
+
+// reloadHandler serves the /-/reload endpoint, which reloads the config file
+// on POST requests.
+type reloadHandler struct {
+	Collector Collector
+}
+
+// ServeHTTP implements the http.Handler interface.
+func (h reloadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.Collector.Config == nil {
+		http.Error(w, "no -config.file given", http.StatusBadRequest)
+		return
+	}
+	err := h.Collector.reloadConfig()
+	if err != nil {
+		slog.Error("config reload failed", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
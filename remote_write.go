@@ -0,0 +1,303 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+* Copyright 2015 The Prometheus Authors
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/version"
+)
+
+// remoteWriter sends all metrics from the metrics path to an endpoint of the
+// Prometheus remote write protocol (version 1.0) at a fixed interval, so that
+// no Prometheus is needed near the exporter.
+//
+// The WriteRequest protobuf message and its snappy compression are encoded by
+// hand, since both are small and neither of the libraries is vendored.
+type remoteWriter struct {
+	Collector     Collector
+	URL           string
+	Job           string
+	Instance      string
+	Interval      time.Duration
+	InstanceLabel string
+	//either Username and Password for basic auth, or BearerToken, or neither
+	Username    string
+	Password    string
+	BearerToken string
+}
+
+// newRemoteWriter validates the remote write flags and returns a remoteWriter
+// without Collector and InstanceLabel. The password and the bearer token are
+// read from the given files.
+func newRemoteWriter(url, job, instance string, interval time.Duration, username, passwordFile, bearerTokenFile string) (*remoteWriter, error) {
+	if interval <= 0 {
+		return nil, errors.New("-remote-write.interval must be positive")
+	}
+	if job == "" {
+		return nil, errors.New("-remote-write.job must not be empty")
+	}
+	if username != "" && bearerTokenFile != "" {
+		return nil, errors.New("-remote-write.username and -remote-write.bearer-token-file are mutually exclusive")
+	}
+	if (username == "") != (passwordFile == "") {
+		return nil, errors.New("-remote-write.username and -remote-write.password-file must be given together")
+	}
+	w := &remoteWriter{URL: url, Job: job, Instance: instance, Interval: interval, Username: username}
+	if w.Instance == "" {
+		var err error
+		w.Instance, err = os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("cannot determine hostname for -remote-write.instance: %s", err)
+		}
+	}
+	if passwordFile != "" {
+		buf, err := ioutil.ReadFile(passwordFile)
+		if err != nil {
+			return nil, err
+		}
+		w.Password = strings.TrimSpace(string(buf))
+	}
+	if bearerTokenFile != "" {
+		buf, err := ioutil.ReadFile(bearerTokenFile)
+		if err != nil {
+			return nil, err
+		}
+		w.BearerToken = strings.TrimSpace(string(buf))
+	}
+	return w, nil
+}
+
+// Run sends the metrics every w.Interval until ctx is cancelled, like
+// pusher.Run.
+func (w remoteWriter) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.Interval)
+	defer ticker.Stop()
+	for {
+		err := w.write(ctx)
+		if err != nil && ctx.Err() == nil {
+			slog.Error("cannot send metrics with remote write", "url", w.URL, "err", err)
+		} else {
+			slog.Debug("sent metrics with remote write", "url", w.URL)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// write measures all servers and sends the results. Nothing is sent if any
+// metric could not be gathered.
+func (w remoteWriter) write(ctx context.Context) error {
+	//the measurement must not delay the next write
+	c := w.Collector
+	c.Deadline = time.Now().Add(w.Interval)
+	families, err := gatherMetrics(c, w.InstanceLabel)
+	if err != nil {
+		return err
+	}
+	if ctx.Err() != nil {
+		//the measurements were cut short by the shutdown
+		return ctx.Err()
+	}
+	extraLabels := map[string]string{"job": w.Job, "instance": w.Instance}
+	body := encodeSnappy(encodeWriteRequest(families, extraLabels, time.Now()))
+
+	req, err := http.NewRequest(http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	req.Header.Set("User-Agent", "ntp_exporter/"+version.Version)
+	switch {
+	case w.BearerToken != "":
+		req.Header.Set("Authorization", "Bearer "+w.BearerToken)
+	case w.Username != "":
+		req.SetBasicAuth(w.Username, w.Password)
+	}
+	client := http.Client{Timeout: w.Interval}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// remoteWriteSample is a sample of one series in a WriteRequest.
+type remoteWriteSample struct {
+	Labels map[string]string
+	Value  float64
+}
+
+// encodeWriteRequest encodes the given metrics as a WriteRequest message,
+// with all samples at the given time. The extra labels are added to all
+// series.
+func encodeWriteRequest(families []*dto.MetricFamily, extraLabels map[string]string, now time.Time) []byte {
+	timestamp := now.UnixNano() / int64(time.Millisecond)
+	var buf []byte
+	for _, family := range families {
+		for _, m := range family.GetMetric() {
+			for _, sample := range flattenMetric(family, m) {
+				for name, value := range extraLabels {
+					sample.Labels[name] = value
+				}
+				buf = appendProtoBytes(buf, 1, encodeTimeSeries(sample, timestamp))
+			}
+		}
+	}
+	return buf
+}
+
+// flattenMetric returns the series of a metric in the way that Prometheus
+// stores them, e.g. with separate series for the buckets, sum and count of
+// a histogram.
+func flattenMetric(family *dto.MetricFamily, m *dto.Metric) []remoteWriteSample {
+	name := family.GetName()
+	newSample := func(suffix string, value float64, extraLabels ...string) remoteWriteSample {
+		labels := map[string]string{"__name__": name + suffix}
+		for _, l := range m.GetLabel() {
+			labels[l.GetName()] = l.GetValue()
+		}
+		for idx := 0; idx+1 < len(extraLabels); idx += 2 {
+			labels[extraLabels[idx]] = extraLabels[idx+1]
+		}
+		return remoteWriteSample{Labels: labels, Value: value}
+	}
+
+	switch family.GetType() {
+	case dto.MetricType_COUNTER:
+		return []remoteWriteSample{newSample("", m.GetCounter().GetValue())}
+	case dto.MetricType_GAUGE:
+		return []remoteWriteSample{newSample("", m.GetGauge().GetValue())}
+	case dto.MetricType_SUMMARY:
+		s := m.GetSummary()
+		var result []remoteWriteSample
+		for _, q := range s.GetQuantile() {
+			result = append(result, newSample("", q.GetValue(), "quantile", formatFloat(q.GetQuantile())))
+		}
+		return append(result,
+			newSample("_sum", s.GetSampleSum()),
+			newSample("_count", float64(s.GetSampleCount())),
+		)
+	case dto.MetricType_HISTOGRAM:
+		h := m.GetHistogram()
+		var result []remoteWriteSample
+		for _, b := range h.GetBucket() {
+			result = append(result, newSample("_bucket", float64(b.GetCumulativeCount()), "le", formatFloat(b.GetUpperBound())))
+		}
+		return append(result,
+			newSample("_bucket", float64(h.GetSampleCount()), "le", "+Inf"),
+			newSample("_sum", h.GetSampleSum()),
+			newSample("_count", float64(h.GetSampleCount())),
+		)
+	default:
+		return []remoteWriteSample{newSample("", m.GetUntyped().GetValue())}
+	}
+}
+
+func formatFloat(value float64) string {
+	if math.IsInf(value, +1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// encodeTimeSeries encodes a TimeSeries message with a single sample.
+func encodeTimeSeries(sample remoteWriteSample, timestamp int64) []byte {
+	//remote write requires the labels to be sorted by name
+	names := make([]string, 0, len(sample.Labels))
+	for name := range sample.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf []byte
+	for _, name := range names {
+		var label []byte
+		label = appendProtoBytes(label, 1, []byte(name))
+		label = appendProtoBytes(label, 2, []byte(sample.Labels[name]))
+		buf = appendProtoBytes(buf, 1, label)
+	}
+
+	var s []byte
+	s = binary.AppendUvarint(s, 1<<3|1) //field 1 (value), wire type I64
+	s = binary.LittleEndian.AppendUint64(s, math.Float64bits(sample.Value))
+	s = binary.AppendUvarint(s, 2<<3|0) //field 2 (timestamp), wire type VARINT
+	s = binary.AppendUvarint(s, uint64(timestamp))
+	return appendProtoBytes(buf, 2, s)
+}
+
+// appendProtoBytes appends a field with wire type LEN (i.e. a string or an
+// embedded message) to a protobuf message.
+func appendProtoBytes(buf []byte, field uint64, value []byte) []byte {
+	buf = binary.AppendUvarint(buf, field<<3|2)
+	buf = binary.AppendUvarint(buf, uint64(len(value)))
+	return append(buf, value...)
+}
+
+// encodeSnappy encodes the input in the snappy block format. The input is not
+// actually compressed, but stored in literals, which every snappy decoder
+// accepts. The payload is small enough for that not to matter.
+func encodeSnappy(input []byte) []byte {
+	buf := binary.AppendUvarint(nil, uint64(len(input)))
+	for len(input) > 0 {
+		chunk := input
+		if len(chunk) > 65536 {
+			chunk = chunk[:65536]
+		}
+		input = input[len(chunk):]
+
+		//tag of a literal: the length minus 1 in the upper 6 bits for short
+		//literals, or 61 there and the length minus 1 in the next 2 bytes
+		n := len(chunk) - 1
+		if n < 60 {
+			buf = append(buf, byte(n<<2))
+		} else {
+			buf = append(buf, 61<<2, byte(n), byte(n>>8))
+		}
+		buf = append(buf, chunk...)
+	}
+	return buf
+}
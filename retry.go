@@ -0,0 +1,67 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+* Copyright 2015 The Prometheus Authors
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// retryPolicy describes how often and how fast failed NTP queries are
+// retried. Only transient failures (see isTransientQueryError) are retried,
+// since e.g. a kiss-of-death packet or an invalid response would only come
+// back again.
+type retryPolicy struct {
+	Attempts int           //number of retries after the first query (0 disables retries)
+	Backoff  time.Duration //delay before the first retry, doubled for each further one
+	MaxDelay time.Duration //upper limit for the doubled delay (0 means no limit)
+	Jitter   float64       //fraction of the delay by which it is randomly shortened or extended
+}
+
+// Delay returns how long to wait before the given retry (starting at 1).
+func (p retryPolicy) Delay(retry int) time.Duration {
+	//double the delay step by step instead of shifting by retry-1, which would
+	//overflow for a large number of retries (the jitter can at most double
+	//the delay, so that must not overflow either)
+	delay := p.Backoff
+	for n := 1; n < retry && delay > 0 && delay <= math.MaxInt64/4; n++ {
+		if p.MaxDelay > 0 && delay >= p.MaxDelay {
+			break
+		}
+		delay *= 2
+	}
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	if p.Jitter > 0 {
+		delay += time.Duration((2*rand.Float64() - 1) * p.Jitter * float64(delay))
+	}
+	return delay
+}
+
+// isTransientQueryError returns whether a query that failed with the given
+// error (as returned by queryServer) is worth retrying, because the query or
+// its response was probably lost on the way.
+func isTransientQueryError(err error) bool {
+	result := classifyQueryError(err)
+	return result == "timeout" || result == "network_error" || err == errTruncatedResponse
+}
@@ -0,0 +1,56 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+* Copyright 2015 The Prometheus Authors
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := retryPolicy{Backoff: 200 * time.Millisecond, MaxDelay: 5 * time.Second}
+	testCases := []struct {
+		Retry    int
+		Expected time.Duration
+	}{
+		{1, 200 * time.Millisecond},
+		{2, 400 * time.Millisecond},
+		{5, 3200 * time.Millisecond},
+		{6, 5 * time.Second},
+		//would overflow when shifting the backoff by retry-1
+		{100, 5 * time.Second},
+	}
+	for _, tc := range testCases {
+		actual := p.Delay(tc.Retry)
+		if actual != tc.Expected {
+			t.Errorf("retry %d: expected delay %s, got %s", tc.Retry, tc.Expected, actual)
+		}
+	}
+
+	//without a limit, the delay saturates instead of overflowing, even with jitter
+	p = retryPolicy{Backoff: time.Second, Jitter: 1}
+	for _, retry := range []int{64, 100, 1000} {
+		delay := p.Delay(retry)
+		if delay < 0 {
+			t.Errorf("retry %d: expected a positive delay, got %s", retry, delay)
+		}
+	}
+}
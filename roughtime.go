@@ -0,0 +1,241 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+* Copyright 2015 The Prometheus Authors
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+//This implements a client for the Roughtime protocol as originally specified
+//by Google (https://roughtime.googlesource.com/roughtime/+/HEAD/PROTOCOL.md).
+
+const (
+	roughtimeRequestLength = 1024
+	roughtimeNonceLength   = 64
+
+	roughtimeDelegationContext = "RoughTime v1 delegation signature--\x00"
+	roughtimeResponseContext   = "RoughTime v1 response signature\x00"
+)
+
+// roughtimeServer is a Roughtime server together with its long-term public
+// key, which is needed to verify its responses.
+type roughtimeServer struct {
+	Address   string
+	PublicKey ed25519.PublicKey
+}
+
+// roughtimeResult is the result of a Roughtime query.
+type roughtimeResult struct {
+	//the true time was between Midpoint-Radius and Midpoint+Radius when the
+	//server answered
+	Midpoint time.Time
+	Radius   time.Duration
+	//local time halfway between sending the request and receiving the response
+	LocalMidpoint time.Time
+	RTT           time.Duration
+}
+
+// Offset returns the offset of the server's time from local time (positive
+// if the local clock is behind).
+func (r roughtimeResult) Offset() time.Duration {
+	return r.Midpoint.Sub(r.LocalMidpoint)
+}
+
+// queryRoughtime sends a request to the given Roughtime server and verifies
+// its response.
+func queryRoughtime(server roughtimeServer, timeout time.Duration) (roughtimeResult, error) {
+	nonce := make([]byte, roughtimeNonceLength)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return roughtimeResult{}, err
+	}
+	//requests are padded to prevent the protocol from being used for traffic
+	//amplification
+	padding := make([]byte, roughtimeRequestLength-roughtimeNonceLength-16)
+	req := encodeRoughtimeMessage([]roughtimeTag{
+		{"NONC", nonce},
+		{"PAD\xff", padding},
+	})
+
+	conn, err := net.DialTimeout("udp", server.Address, timeout)
+	if err != nil {
+		return roughtimeResult{}, err
+	}
+	defer conn.Close()
+	err = conn.SetDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return roughtimeResult{}, err
+	}
+
+	sent := time.Now()
+	_, err = conn.Write(req)
+	if err != nil {
+		return roughtimeResult{}, err
+	}
+	buf := make([]byte, 4096)
+	n, err := conn.Read(buf)
+	received := time.Now()
+	if err != nil {
+		return roughtimeResult{}, err
+	}
+
+	result, err := verifyRoughtimeResponse(buf[:n], nonce, server.PublicKey)
+	if err != nil {
+		return roughtimeResult{}, err
+	}
+	result.RTT = received.Sub(sent)
+	result.LocalMidpoint = sent.Add(result.RTT / 2)
+	return result, nil
+}
+
+func verifyRoughtimeResponse(response, nonce []byte, rootKey ed25519.PublicKey) (roughtimeResult, error) {
+	msg, err := parseRoughtimeMessage(response)
+	if err != nil {
+		return roughtimeResult{}, err
+	}
+	signedResponse, err := parseRoughtimeMessage(msg["SREP"])
+	if err != nil {
+		return roughtimeResult{}, fmt.Errorf("in SREP: %s", err)
+	}
+	cert, err := parseRoughtimeMessage(msg["CERT"])
+	if err != nil {
+		return roughtimeResult{}, fmt.Errorf("in CERT: %s", err)
+	}
+	delegation, err := parseRoughtimeMessage(cert["DELE"])
+	if err != nil {
+		return roughtimeResult{}, fmt.Errorf("in DELE: %s", err)
+	}
+
+	//the server signs responses with an online key that is delegated by its
+	//long-term key
+	if len(cert["SIG\x00"]) != ed25519.SignatureSize ||
+		!ed25519.Verify(rootKey, append([]byte(roughtimeDelegationContext), cert["DELE"]...), cert["SIG\x00"]) {
+		return roughtimeResult{}, errors.New("invalid delegation signature")
+	}
+	onlineKey := delegation["PUBK"]
+	if len(onlineKey) != ed25519.PublicKeySize || len(msg["SIG\x00"]) != ed25519.SignatureSize ||
+		!ed25519.Verify(onlineKey, append([]byte(roughtimeResponseContext), msg["SREP"]...), msg["SIG\x00"]) {
+		return roughtimeResult{}, errors.New("invalid response signature")
+	}
+
+	//the server signs the root of a Merkle tree over the nonces of all
+	//requests that it answers at once, so check that our nonce is in there
+	if len(msg["INDX"]) != 4 || len(msg["PATH"])%sha512.Size != 0 || len(signedResponse["ROOT"]) != sha512.Size {
+		return roughtimeResult{}, errors.New("malformed Merkle tree path")
+	}
+	index := binary.LittleEndian.Uint32(msg["INDX"])
+	hash := roughtimeHash([]byte{0}, nonce)
+	for path := msg["PATH"]; len(path) > 0; path = path[sha512.Size:] {
+		if index&1 == 0 {
+			hash = roughtimeHash([]byte{1}, hash, path[:sha512.Size])
+		} else {
+			hash = roughtimeHash([]byte{1}, path[:sha512.Size], hash)
+		}
+		index >>= 1
+	}
+	if !bytes.Equal(hash, signedResponse["ROOT"]) {
+		return roughtimeResult{}, errors.New("response is not for our request")
+	}
+
+	if len(signedResponse["MIDP"]) != 8 || len(signedResponse["RADI"]) != 4 ||
+		len(delegation["MINT"]) != 8 || len(delegation["MAXT"]) != 8 {
+		return roughtimeResult{}, errors.New("malformed timestamps")
+	}
+	midpoint := binary.LittleEndian.Uint64(signedResponse["MIDP"])
+	if midpoint < binary.LittleEndian.Uint64(delegation["MINT"]) || midpoint > binary.LittleEndian.Uint64(delegation["MAXT"]) {
+		return roughtimeResult{}, errors.New("midpoint is outside of the validity of the delegated key")
+	}
+	return roughtimeResult{
+		Midpoint: time.Unix(0, 0).Add(time.Duration(midpoint) * time.Microsecond),
+		Radius:   time.Duration(binary.LittleEndian.Uint32(signedResponse["RADI"])) * time.Microsecond,
+	}, nil
+}
+
+func roughtimeHash(parts ...[]byte) []byte {
+	h := sha512.New()
+	for _, part := range parts {
+		h.Write(part)
+	}
+	return h.Sum(nil)
+}
+
+type roughtimeTag struct {
+	Tag   string
+	Value []byte
+}
+
+// encodeRoughtimeMessage encodes the given tags, which must be in ascending
+// order (when read as little-endian uint32) and have values whose lengths are
+// multiples of 4.
+func encodeRoughtimeMessage(tags []roughtimeTag) []byte {
+	var msg []byte
+	var u32 [4]byte
+	binary.LittleEndian.PutUint32(u32[:], uint32(len(tags)))
+	msg = append(msg, u32[:]...)
+	offset := 0
+	for _, tag := range tags[:len(tags)-1] {
+		offset += len(tag.Value)
+		binary.LittleEndian.PutUint32(u32[:], uint32(offset))
+		msg = append(msg, u32[:]...)
+	}
+	for _, tag := range tags {
+		msg = append(msg, tag.Tag...)
+	}
+	for _, tag := range tags {
+		msg = append(msg, tag.Value...)
+	}
+	return msg
+}
+
+// parseRoughtimeMessage decodes a message into a map of tag to value.
+func parseRoughtimeMessage(msg []byte) (map[string][]byte, error) {
+	if len(msg) < 4 {
+		return nil, errors.New("message too short")
+	}
+	count := int(binary.LittleEndian.Uint32(msg))
+	if count == 0 || count > 1024 || len(msg) < 8*count {
+		return nil, errors.New("invalid number of tags")
+	}
+	values := msg[8*count:]
+	result := make(map[string][]byte, count)
+	start := 0
+	for idx := 0; idx < count; idx++ {
+		end := len(values)
+		if idx < count-1 {
+			end = int(binary.LittleEndian.Uint32(msg[4+4*idx:]))
+		}
+		if end < start || end > len(values) {
+			return nil, errors.New("invalid offsets")
+		}
+		tagPos := 4 + 4*(count-1) + 4*idx
+		result[string(msg[tagPos:tagPos+4])] = values[start:end]
+		start = end
+	}
+	return result, nil
+}
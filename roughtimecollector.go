@@ -0,0 +1,93 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+* Copyright 2015 The Prometheus Authors
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	roughtimeUpDesc = prometheus.NewDesc(
+		"ntp_roughtime_up",
+		"Whether the Roughtime server sent a valid response (1) or not (0).",
+		[]string{"server"}, nil,
+	)
+	roughtimeOffsetDesc = prometheus.NewDesc(
+		"ntp_roughtime_offset_seconds",
+		"Midpoint reported by the Roughtime server minus local time (positive if the local clock is behind).",
+		[]string{"server"}, nil,
+	)
+	roughtimeRadiusDesc = prometheus.NewDesc(
+		"ntp_roughtime_radius_seconds",
+		"Uncertainty of the midpoint reported by the Roughtime server.",
+		[]string{"server"}, nil,
+	)
+	roughtimeRTTDesc = prometheus.NewDesc(
+		"ntp_roughtime_rtt_seconds",
+		"Round-trip time of the Roughtime query.",
+		[]string{"server"}, nil,
+	)
+)
+
+// roughtimeCollector queries Roughtime servers during each scrape. Since
+// Roughtime responses are signed, this is an authenticated cross-check of the
+// local clock that does not depend on any NTP server.
+type roughtimeCollector struct {
+	Servers []roughtimeServer
+	Timeout time.Duration
+}
+
+// Describe implements the prometheus.Collector interface.
+func (c roughtimeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- roughtimeUpDesc
+	ch <- roughtimeOffsetDesc
+	ch <- roughtimeRadiusDesc
+	ch <- roughtimeRTTDesc
+}
+
+// Collect implements the prometheus.Collector interface.
+func (c roughtimeCollector) Collect(ch chan<- prometheus.Metric) {
+	var wg sync.WaitGroup
+	for _, s := range c.Servers {
+		wg.Add(1)
+		go func(s roughtimeServer) {
+			defer wg.Done()
+			gauge := func(desc *prometheus.Desc, value float64) {
+				ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, s.Address)
+			}
+			result, err := queryRoughtime(s, c.Timeout)
+			if err != nil {
+				slog.Error("couldn't query Roughtime server", "server", s.Address, "err", err)
+				gauge(roughtimeUpDesc, 0)
+				return
+			}
+			gauge(roughtimeUpDesc, 1)
+			gauge(roughtimeOffsetDesc, result.Offset().Seconds())
+			gauge(roughtimeRadiusDesc, result.Radius.Seconds())
+			gauge(roughtimeRTTDesc, result.RTT.Seconds())
+		}(s)
+	}
+	wg.Wait()
+}
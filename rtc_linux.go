@@ -0,0 +1,118 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+* Copyright 2015 The Prometheus Authors
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"bufio"
+	"log/slog"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// from <linux/rtc.h>
+const rtcReadTime = 0x80247009 // RTC_RD_TIME
+
+// rtcTime is struct rtc_time from <linux/rtc.h> (same layout as struct tm).
+type rtcTime struct {
+	Sec, Min, Hour, Mday, Mon, Year, Wday, Yday, Isdst int32
+}
+
+var (
+	rtcUpDesc = prometheus.NewDesc(
+		"ntp_rtc_up",
+		"Whether the last attempt to read the hardware clock succeeded (1) or not (0).",
+		nil, nil,
+	)
+	rtcOffsetDesc = prometheus.NewDesc(
+		"ntp_rtc_offset_seconds",
+		"Time of the hardware clock minus system time (with a resolution of one second).",
+		nil, nil,
+	)
+)
+
+// rtcCollector reports how far the hardware clock (RTC) has drifted from the
+// system time. The RTC keeps the time while the machine is off, so a large
+// offset means that the machine would boot with a wrong clock (e.g. because of
+// a dying CMOS battery).
+type rtcCollector struct {
+	Device string
+}
+
+// Describe implements the prometheus.Collector interface.
+func (c rtcCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- rtcUpDesc
+	ch <- rtcOffsetDesc
+}
+
+// Collect implements the prometheus.Collector interface.
+func (c rtcCollector) Collect(ch chan<- prometheus.Metric) {
+	offset, err := c.readOffset()
+	if err != nil {
+		slog.Error("couldn't read hardware clock", "device", c.Device, "err", err)
+		ch <- prometheus.MustNewConstMetric(rtcUpDesc, prometheus.GaugeValue, 0)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(rtcUpDesc, prometheus.GaugeValue, 1)
+	ch <- prometheus.MustNewConstMetric(rtcOffsetDesc, prometheus.GaugeValue, offset.Seconds())
+}
+
+func (c rtcCollector) readOffset() (time.Duration, error) {
+	f, err := os.Open(c.Device)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var tm rtcTime
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), rtcReadTime, uintptr(unsafe.Pointer(&tm)))
+	now := time.Now()
+	if errno != 0 {
+		return 0, errno
+	}
+
+	rtc := time.Date(int(tm.Year)+1900, time.Month(tm.Mon+1), int(tm.Mday),
+		int(tm.Hour), int(tm.Min), int(tm.Sec), 0, rtcLocation())
+	//the RTC only has a resolution of one second, so compare with the system
+	//time truncated to full seconds
+	return rtc.Sub(now.Truncate(time.Second)), nil
+}
+
+// rtcLocation returns the time zone of the RTC. Like hwclock, we assume UTC
+// unless the third line of /etc/adjtime says "LOCAL".
+func rtcLocation() *time.Location {
+	f, err := os.Open("/etc/adjtime")
+	if err != nil {
+		return time.UTC
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		if line == 3 && strings.TrimSpace(scanner.Text()) == "LOCAL" {
+			return time.Local
+		}
+	}
+	return time.UTC
+}
@@ -0,0 +1,166 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+* Copyright 2015 The Prometheus Authors
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"errors"
+)
+
+//This file implements AEAD_AES_SIV_CMAC_256 (RFC 5297), which is the AEAD
+//algorithm that all NTS implementations support. The key is 32 bytes long:
+//The first half is used for S2V (i.e. CMAC), the second half for AES-CTR.
+
+const sivBlockSize = aes.BlockSize
+
+var errSIVAuthentication = errors.New("AES-SIV authentication failed")
+
+// sivSeal encrypts and authenticates the plaintext, and authenticates the
+// associated data. The result is the synthetic IV followed by the ciphertext.
+func sivSeal(key []byte, associatedData [][]byte, plaintext []byte) ([]byte, error) {
+	macBlock, ctrBlock, err := sivCiphers(key)
+	if err != nil {
+		return nil, err
+	}
+	v := sivS2V(macBlock, associatedData, plaintext)
+	out := make([]byte, sivBlockSize+len(plaintext))
+	copy(out, v)
+	sivCTR(ctrBlock, v, out[sivBlockSize:], plaintext)
+	return out, nil
+}
+
+// sivOpen is the inverse of sivSeal.
+func sivOpen(key []byte, associatedData [][]byte, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < sivBlockSize {
+		return nil, errSIVAuthentication
+	}
+	macBlock, ctrBlock, err := sivCiphers(key)
+	if err != nil {
+		return nil, err
+	}
+	v := ciphertext[:sivBlockSize]
+	plaintext := make([]byte, len(ciphertext)-sivBlockSize)
+	sivCTR(ctrBlock, v, plaintext, ciphertext[sivBlockSize:])
+	if subtle.ConstantTimeCompare(v, sivS2V(macBlock, associatedData, plaintext)) != 1 {
+		return nil, errSIVAuthentication
+	}
+	return plaintext, nil
+}
+
+func sivCiphers(key []byte) (mac, ctr cipher.Block, err error) {
+	if len(key) != 2*16 {
+		return nil, nil, errors.New("AES-SIV-CMAC-256 requires a 32-byte key")
+	}
+	mac, err = aes.NewCipher(key[:16])
+	if err != nil {
+		return nil, nil, err
+	}
+	ctr, err = aes.NewCipher(key[16:])
+	return mac, ctr, err
+}
+
+// sivCTR encrypts or decrypts `src` into `dst` with AES-CTR, using the
+// synthetic IV `v` (with the two bits cleared that RFC 5297 requires) as
+// initial counter.
+func sivCTR(block cipher.Block, v, dst, src []byte) {
+	q := make([]byte, sivBlockSize)
+	copy(q, v)
+	q[8] &= 0x7f
+	q[12] &= 0x7f
+	cipher.NewCTR(block, q).XORKeyStream(dst, src)
+}
+
+// sivS2V implements the S2V operation from RFC 5297, section 2.4.
+func sivS2V(block cipher.Block, associatedData [][]byte, plaintext []byte) []byte {
+	d := cmac(block, make([]byte, sivBlockSize))
+	for _, ad := range associatedData {
+		d = sivDouble(d)
+		xorBytes(d, cmac(block, ad))
+	}
+
+	var t []byte
+	if len(plaintext) >= sivBlockSize {
+		t = append([]byte(nil), plaintext...)
+		xorBytes(t[len(t)-sivBlockSize:], d)
+	} else {
+		t = sivDouble(d)
+		padded := make([]byte, sivBlockSize)
+		copy(padded, plaintext)
+		padded[len(plaintext)] = 0x80
+		xorBytes(t, padded)
+	}
+	return cmac(block, t)
+}
+
+// cmac computes the AES-CMAC (RFC 4493) of the message.
+func cmac(block cipher.Block, msg []byte) []byte {
+	l := make([]byte, sivBlockSize)
+	block.Encrypt(l, l)
+	k1 := sivDouble(l)
+	k2 := sivDouble(k1)
+
+	//split the message into blocks; the last block is padded if necessary
+	n := (len(msg) + sivBlockSize - 1) / sivBlockSize
+	lastComplete := n > 0 && len(msg)%sivBlockSize == 0
+	if n == 0 {
+		n = 1
+	}
+	last := make([]byte, sivBlockSize)
+	copy(last, msg[(n-1)*sivBlockSize:])
+	if lastComplete {
+		xorBytes(last, k1)
+	} else {
+		last[len(msg)-(n-1)*sivBlockSize] = 0x80
+		xorBytes(last, k2)
+	}
+
+	x := make([]byte, sivBlockSize)
+	for i := 0; i < n-1; i++ {
+		xorBytes(x, msg[i*sivBlockSize:(i+1)*sivBlockSize])
+		block.Encrypt(x, x)
+	}
+	xorBytes(x, last)
+	block.Encrypt(x, x)
+	return x
+}
+
+// sivDouble multiplies a 128-bit value by x in GF(2^128) ("dbl" in RFC 5297).
+func sivDouble(in []byte) []byte {
+	out := make([]byte, sivBlockSize)
+	var carry byte
+	for i := sivBlockSize - 1; i >= 0; i-- {
+		out[i] = in[i]<<1 | carry
+		carry = in[i] >> 7
+	}
+	if carry != 0 {
+		out[sivBlockSize-1] ^= 0x87
+	}
+	return out
+}
+
+// xorBytes sets dst[i] ^= src[i] for all i < len(dst).
+func xorBytes(dst, src []byte) {
+	for i := range dst {
+		dst[i] ^= src[i]
+	}
+}
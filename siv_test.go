@@ -0,0 +1,128 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+* Copyright 2015 The Prometheus Authors
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func decodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+	buf, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+// test vectors from RFC 4493, section 4
+func TestCMAC(t *testing.T) {
+	key := "2b7e1516 28aed2a6 abf71588 09cf4f3c"
+	message := "6bc1bee2 2e409f96 e93d7e11 7393172a ae2d8a57 1e03ac9c 9eb76fac 45af8e51" +
+		"30c81c46 a35ce411 e5fbc119 1a0a52ef f69f2445 df4f9b17 ad2b417b e66c3710"
+	testCases := []struct {
+		Length   int
+		Expected string
+	}{
+		{0, "bb1d6929 e9593728 7fa37d12 9b756746"},
+		{16, "070a16b4 6b4d4144 f79bdd9d d04a287c"},
+		{40, "dfa66747 de9ae630 30ca3261 1497c827"},
+		{64, "51f0bebf 7e3b9d92 fc497417 79363cfe"},
+	}
+	block, err := aes.NewCipher(decodeHex(t, key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range testCases {
+		actual := cmac(block, decodeHex(t, message)[:tc.Length])
+		expected := decodeHex(t, tc.Expected)
+		if !bytes.Equal(actual, expected) {
+			t.Errorf("length %d: expected %x, got %x", tc.Length, expected, actual)
+		}
+	}
+}
+
+// test vectors from RFC 5297, appendix A
+func TestSIV(t *testing.T) {
+	testCases := []struct {
+		Name           string
+		Key            string
+		AssociatedData []string
+		Plaintext      string
+		Output         string
+	}{
+		{
+			Name:           "A.1 (deterministic)",
+			Key:            "fffefdfc fbfaf9f8 f7f6f5f4 f3f2f1f0 f0f1f2f3 f4f5f6f7 f8f9fafb fcfdfeff",
+			AssociatedData: []string{"10111213 14151617 18191a1b 1c1d1e1f 20212223 24252627"},
+			Plaintext:      "11223344 55667788 99aabbcc ddee",
+			Output:         "85632d07 c6e8f37f 950acd32 0a2ecc93 40c02b96 90c4dc04 daef7f6a fe5c",
+		},
+		{
+			Name: "A.2 (nonce-based)",
+			Key:  "7f7e7d7c 7b7a7978 77767574 73727170 40414243 44454647 48494a4b 4c4d4e4f",
+			AssociatedData: []string{
+				"00112233 44556677 8899aabb ccddeeff deaddada deaddada ffeeddcc bbaa9988 77665544 33221100",
+				"10203040 50607080 90a0",
+				"09f91102 9d74e35b d84156c5 635688c0", //nonce
+			},
+			Plaintext: "74686973 20697320 736f6d65 20706c61 696e7465 78742074 6f20656e 63727970" +
+				"74207573 696e6720 5349562d 414553",
+			Output: "7bdb6e3b 432667eb 06f4d14b ff2fbd0f cb900f2f ddbe4043 26601965 c889bf17" +
+				"dba77ceb 094fa663 b7a3f748 ba8af829 ea64ad54 4a272e9c 485b62a3 fd5c0d",
+		},
+	}
+	for _, tc := range testCases {
+		key := decodeHex(t, tc.Key)
+		var associatedData [][]byte
+		for _, ad := range tc.AssociatedData {
+			associatedData = append(associatedData, decodeHex(t, ad))
+		}
+		plaintext := decodeHex(t, tc.Plaintext)
+		expected := decodeHex(t, tc.Output)
+
+		actual, err := sivSeal(key, associatedData, plaintext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(actual, expected) {
+			t.Errorf("%s: expected %x, got %x", tc.Name, expected, actual)
+		}
+
+		decrypted, err := sivOpen(key, associatedData, expected)
+		if err != nil {
+			t.Errorf("%s: cannot open: %s", tc.Name, err)
+		} else if !bytes.Equal(decrypted, plaintext) {
+			t.Errorf("%s: expected plaintext %x, got %x", tc.Name, plaintext, decrypted)
+		}
+
+		//any modification must be detected
+		expected[len(expected)-1] ^= 1
+		_, err = sivOpen(key, associatedData, expected)
+		if err != errSIVAuthentication {
+			t.Errorf("%s: expected authentication error for modified ciphertext, got %v", tc.Name, err)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+* Copyright 2015 The Prometheus Authors
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// confidenceTimeScale is the amount of measurement uncertainty at which the
+// confidence score drops to 1/e (~0.37). It matches the default drift
+// threshold above which multiple measurements are taken.
+const confidenceTimeScale = 0.01
+
+// calculateConfidence combines the samples of one measurement into a score
+// between 0 (no confidence) and 1 (full confidence) for the reported offset.
+// The score is computed from the uncertainty u of the offset as
+//
+//	confidence = exp(-u / confidenceTimeScale)
+//	u          = max(RTT)/2 + stddev(offsets)/sqrt(n)
+//
+// where n is the number of samples. The first term is the worst-case error
+// of the worst sample: Since the asymmetry of the network path is unknown,
+// the offset of an NTP exchange can be off by up to half its RTT, so RTT
+// spikes between samples lower the score. The second term is the standard
+// error of the offset: It grows with the disagreement (jitter) between the
+// samples, and shrinks as more samples are taken. A single clean sample with
+// a low RTT therefore scores close to 1, while a noisy set of samples scores
+// low, and the more samples agree, the higher the score.
+func calculateConfidence(offsets, rtts []float64) float64 {
+	if len(offsets) == 0 || len(rtts) == 0 {
+		return 0
+	}
+	maxRTT := rtts[0]
+	for _, rtt := range rtts {
+		maxRTT = math.Max(maxRTT, rtt)
+	}
+	n := float64(len(offsets))
+	u := maxRTT/2 + calculateStdDev(offsets)/math.Sqrt(n)
+	return math.Exp(-u / confidenceTimeScale)
+}
+
+// calculateMinMax returns the lowest and highest of the given values, which
+// must not be empty.
+func calculateMinMax(values []float64) (min, max float64) {
+	min, max = values[0], values[0]
+	for _, v := range values[1:] {
+		if v < min {
+			min = v
+		}
+		if v > max {
+			max = v
+		}
+	}
+	return min, max
+}
+
+// calculateStdDev returns the sample standard deviation, or 0 if there are
+// less than two values.
+func calculateStdDev(values []float64) float64 {
+	if len(values) < 2 {
+		return 0
+	}
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	mean := sum / float64(len(values))
+	var sumSquares float64
+	for _, v := range values {
+		sumSquares += (v - mean) * (v - mean)
+	}
+	return math.Sqrt(sumSquares / float64(len(values)-1))
+}
+
+// emaState is the state of an exponential moving average.
+type emaState struct {
+	Value      float64
+	LastUpdate time.Time
+}
+
+// update adds a new value to the moving average:
+//
+//	ema' = alpha * value + (1 - alpha) * ema
+//
+// If the previous update is older than maxGap (or if there was none), the
+// average restarts at the new value, since the old state no longer describes
+// the current situation.
+func (s emaState) update(value, alpha float64, now time.Time, maxGap time.Duration) emaState {
+	if s.LastUpdate.IsZero() || now.Sub(s.LastUpdate) > maxGap {
+		return emaState{Value: value, LastUpdate: now}
+	}
+	return emaState{
+		Value:      alpha*value + (1-alpha)*s.Value,
+		LastUpdate: now,
+	}
+}
+
+// offsetSample is a clock offset that was measured at a certain time.
+type offsetSample struct {
+	Time   time.Time
+	Offset float64
+}
+
+// calculateSlope returns the slope of the linear regression of the offsets
+// over time (in seconds per second), or 0 if there are less than two samples
+// or if they were all taken at the same time.
+func calculateSlope(samples []offsetSample) float64 {
+	if len(samples) < 2 {
+		return 0
+	}
+	//use the time since the first sample as x, to keep the numbers small
+	n := float64(len(samples))
+	var sumX, sumY float64
+	for _, s := range samples {
+		sumX += s.Time.Sub(samples[0].Time).Seconds()
+		sumY += s.Offset
+	}
+	meanX, meanY := sumX/n, sumY/n
+	var sumXY, sumXX float64
+	for _, s := range samples {
+		dx := s.Time.Sub(samples[0].Time).Seconds() - meanX
+		sumXY += dx * (s.Offset - meanY)
+		sumXX += dx * dx
+	}
+	if sumXX == 0 {
+		return 0
+	}
+	return sumXY / sumXX
+}
+
+// calculateAllanDeviation returns the Allan deviation of the clock offsets
+// (phase data) at the mean interval between the samples, which is returned as
+// tau (in seconds). The samples are assumed to be roughly equally spaced. It
+// returns 0 if there are less than three samples.
+func calculateAllanDeviation(samples []offsetSample) (adev, tau float64) {
+	n := len(samples)
+	if n < 3 {
+		return 0, 0
+	}
+	tau = samples[n-1].Time.Sub(samples[0].Time).Seconds() / float64(n-1)
+	if tau == 0 {
+		return 0, 0
+	}
+	var sum float64
+	for i := 0; i+2 < n; i++ {
+		d := samples[i+2].Offset - 2*samples[i+1].Offset + samples[i].Offset
+		sum += d * d
+	}
+	return math.Sqrt(sum / (2 * tau * tau * float64(n-2))), tau
+}
+
+// alphaForHalfLife returns the smoothing factor for the next update, such that
+// the weight of older values halves every halfLife, regardless of how often
+// the average is updated.
+func (s emaState) alphaForHalfLife(now time.Time, halfLife time.Duration) float64 {
+	if s.LastUpdate.IsZero() {
+		return 1
+	}
+	return 1 - math.Exp2(-now.Sub(s.LastUpdate).Seconds()/halfLife.Seconds())
+}
+
+// aggregationStrategies contains the ways in which the offsets of multiple
+// samples can be combined into one value (see -ntp.aggregation). Each function
+// receives the offsets and RTTs of the samples in the same order, and must not
+// modify them.
+var aggregationStrategies = map[string]func(offsets, rtts []float64) float64{
+	"median": func(offsets, rtts []float64) float64 {
+		return calculateMedian(append([]float64(nil), offsets...))
+	},
+	"mean": func(offsets, rtts []float64) float64 {
+		return calculateMean(offsets)
+	},
+	//the interquartile mean: the mean of the samples after discarding the
+	//lowest and highest 25%
+	"trimmed-mean": func(offsets, rtts []float64) float64 {
+		sorted := append([]float64(nil), offsets...)
+		sort.Float64s(sorted)
+		trim := len(sorted) / 4
+		return calculateMean(sorted[trim : len(sorted)-trim])
+	},
+	//like the clock filter of ntpd: the sample with the lowest RTT has the
+	//least room for asymmetric network delays
+	"min-rtt": func(offsets, rtts []float64) float64 {
+		best := 0
+		for idx, rtt := range rtts {
+			if rtt < rtts[best] {
+				best = idx
+			}
+		}
+		return offsets[best]
+	},
+}
+
+func calculateMean(values []float64) float64 {
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	return sum / float64(len(values))
+}
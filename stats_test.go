@@ -0,0 +1,165 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+* Copyright 2015 The Prometheus Authors
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestCalculateConfidence(t *testing.T) {
+	testCases := []struct {
+		Name    string
+		Offsets []float64
+		RTTs    []float64
+		Min     float64
+		Max     float64
+	}{
+		{
+			Name:    "single clean sample",
+			Offsets: []float64{0.0001},
+			RTTs:    []float64{0.0002},
+			Min:     0.98,
+			Max:     1,
+		},
+		{
+			Name:    "noisy samples",
+			Offsets: []float64{-0.02, 0.01, 0.03, -0.015},
+			RTTs:    []float64{0.005, 0.04, 0.02, 0.01},
+			Min:     0,
+			Max:     0.1,
+		},
+		{
+			Name:    "empty input",
+			Offsets: nil,
+			RTTs:    nil,
+			Min:     0,
+			Max:     0,
+		},
+	}
+
+	for _, tc := range testCases {
+		confidence := calculateConfidence(tc.Offsets, tc.RTTs)
+		if confidence < tc.Min || confidence > tc.Max {
+			t.Errorf("%s: expected confidence between %g and %g, got %g", tc.Name, tc.Min, tc.Max, confidence)
+		}
+	}
+
+	//u = 0.004/2 + stddev(0.001, 0.003)/sqrt(2) = 0.002 + 0.001
+	expected := math.Exp(-0.003 / confidenceTimeScale)
+	confidence := calculateConfidence([]float64{0.001, 0.003}, []float64{0.002, 0.004})
+	if math.Abs(confidence-expected) > 1e-12 {
+		t.Errorf("expected confidence %g, got %g", expected, confidence)
+	}
+
+	//with the same jitter, more samples yield a higher confidence
+	few := calculateConfidence([]float64{0.001, 0.003}, []float64{0.002, 0.002})
+	many := calculateConfidence([]float64{0.001, 0.003, 0.001, 0.003, 0.001, 0.003}, []float64{0.002, 0.002, 0.002, 0.002, 0.002, 0.002})
+	if many <= few {
+		t.Errorf("expected more samples to yield a higher confidence, got %g for 2 samples and %g for 6 samples", few, many)
+	}
+}
+
+func TestEMAUpdate(t *testing.T) {
+	start := time.Unix(1000, 0)
+	testCases := []struct {
+		Name     string
+		State    emaState
+		Value    float64
+		Now      time.Time
+		Expected float64
+	}{
+		{
+			Name:     "first value",
+			State:    emaState{},
+			Value:    0.5,
+			Now:      start,
+			Expected: 0.5,
+		},
+		{
+			Name:     "reset after maxGap",
+			State:    emaState{Value: 0.5, LastUpdate: start},
+			Value:    0.1,
+			Now:      start.Add(2 * time.Minute),
+			Expected: 0.1,
+		},
+		{
+			Name:     "steady state",
+			State:    emaState{Value: 0.5, LastUpdate: start},
+			Value:    0.1,
+			Now:      start.Add(30 * time.Second),
+			Expected: 0.25*0.1 + 0.75*0.5,
+		},
+	}
+
+	for _, tc := range testCases {
+		state := tc.State.update(tc.Value, 0.25, tc.Now, time.Minute)
+		if math.Abs(state.Value-tc.Expected) > 1e-12 {
+			t.Errorf("%s: expected value %g, got %g", tc.Name, tc.Expected, state.Value)
+		}
+		if !state.LastUpdate.Equal(tc.Now) {
+			t.Errorf("%s: expected LastUpdate %s, got %s", tc.Name, tc.Now, state.LastUpdate)
+		}
+	}
+}
+
+func TestEMAAlphaForHalfLife(t *testing.T) {
+	start := time.Unix(1000, 0)
+	testCases := []struct {
+		Name     string
+		State    emaState
+		Now      time.Time
+		Expected float64
+	}{
+		{
+			Name:     "first value",
+			State:    emaState{},
+			Now:      start,
+			Expected: 1,
+		},
+		{
+			Name:     "one half-life",
+			State:    emaState{LastUpdate: start},
+			Now:      start.Add(time.Minute),
+			Expected: 0.5,
+		},
+		{
+			Name:     "two half-lives",
+			State:    emaState{LastUpdate: start},
+			Now:      start.Add(2 * time.Minute),
+			Expected: 0.75,
+		},
+		{
+			Name:     "no time passed",
+			State:    emaState{LastUpdate: start},
+			Now:      start,
+			Expected: 0,
+		},
+	}
+
+	for _, tc := range testCases {
+		alpha := tc.State.alphaForHalfLife(tc.Now, time.Minute)
+		if math.Abs(alpha-tc.Expected) > 1e-12 {
+			t.Errorf("%s: expected alpha %g, got %g", tc.Name, tc.Expected, alpha)
+		}
+	}
+}
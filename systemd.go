@@ -0,0 +1,148 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+* Copyright 2015 The Prometheus Authors
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// This file implements the parts of the systemd integration that the exporter
+// needs, without linking against libsystemd: socket activation (see
+// sd_listen_fds(3)) and the notification protocol (see sd_notify(3)).
+
+// sdListenFDsStart is the first file descriptor passed by systemd.
+const sdListenFDsStart = 3
+
+// systemdListener returns the socket that systemd passed to the exporter with
+// socket activation, or nil if it was not socket-activated.
+func systemdListener() (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count == 0 {
+		return nil, nil
+	}
+	//like sd_listen_fds(), do not pass the sockets on to child processes
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if count != 1 {
+		return nil, fmt.Errorf("expected one socket from systemd, but got %d", count)
+	}
+
+	file := os.NewFile(sdListenFDsStart, "systemd socket")
+	defer file.Close()
+	return net.FileListener(file)
+}
+
+// sdNotify sends the given state (e.g. "READY=1") to systemd. It does nothing
+// if the exporter does not run under systemd with Type=notify.
+func sdNotify(state string) error {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+	//a leading "@" denotes a socket in the abstract namespace
+	if path[0] == '@' {
+		path = "\x00" + path[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// sdWatchdogInterval returns the interval in which systemd expects watchdog
+// keepalives, or 0 if the watchdog is disabled.
+func sdWatchdogInterval() (time.Duration, error) {
+	value := os.Getenv("WATCHDOG_USEC")
+	if value == "" {
+		return 0, nil
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0, nil
+	}
+	usec, err := strconv.ParseUint(value, 10, 64)
+	if err != nil || usec == 0 {
+		return 0, errors.New("invalid value for $WATCHDOG_USEC: " + strconv.Quote(value))
+	}
+	return time.Duration(usec) * time.Microsecond, nil
+}
+
+// notifySystemd tells systemd that the exporter is ready once the first
+// measurement was attempted, and sends watchdog keepalives until ctx is
+// cancelled. It does nothing if the exporter does not run under systemd with
+// Type=notify.
+func notifySystemd(ctx context.Context, c Collector) {
+	if os.Getenv("NOTIFY_SOCKET") == "" {
+		return
+	}
+	watchdogInterval, err := sdWatchdogInterval()
+	if err != nil {
+		slog.Error("cannot enable systemd watchdog", "err", err)
+	} else if watchdogInterval > 0 {
+		//the watchdog is already running while we wait for readiness
+		go sdWatchdog(ctx, watchdogInterval)
+	}
+
+	for !c.isReady() {
+		select {
+		case <-time.After(100 * time.Millisecond):
+		case <-ctx.Done():
+			return
+		}
+	}
+	err = sdNotify("READY=1")
+	if err != nil {
+		slog.Error("cannot notify systemd", "err", err)
+	}
+}
+
+// sdWatchdog sends watchdog keepalives to systemd until ctx is cancelled.
+func sdWatchdog(ctx context.Context, interval time.Duration) {
+	//send keepalives at half the interval, as recommended by
+	//sd_watchdog_enabled(3)
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			err := sdNotify("WATCHDOG=1")
+			if err != nil {
+				slog.Error("cannot send watchdog keepalive to systemd", "err", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,133 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+* Copyright 2015 The Prometheus Authors
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var targetsPageTemplate = template.Must(template.New("targets").Parse(`<html>
+<head><title>NTP Exporter - Targets</title></head>
+<body>
+<h1>Targets</h1>
+{{if .}}<table>
+<tr><th>Server</th><th>State</th><th>Last measurement</th><th>Last success</th><th>Backoff</th><th>Error</th></tr>
+{{range .}}<tr>
+<td>{{.Server}}</td>
+<td>{{.State}}</td>
+<td>{{with .LastMeasurement}}{{.Format "2006-01-02 15:04:05 MST"}}{{else}}never{{end}}</td>
+<td>{{with .LastSuccess}}{{.Format "2006-01-02 15:04:05 MST"}}{{else}}never{{end}}</td>
+<td>{{if .KissCode}}kiss-of-death {{.KissCode}}{{else if eq .CircuitState "open" "half_open"}}circuit {{.CircuitState}}{{else}}none{{end}}{{with .BackoffUntil}} until {{.Format "2006-01-02 15:04:05 MST"}}{{end}}</td>
+<td>{{.Error}}</td>
+</tr>
+{{end}}</table>
+{{else}}<p>No servers are measured on the metrics path.</p>
+{{end}}<p><a href="/targets?format=json">JSON</a></p>
+</body>
+</html>
+`))
+
+// targetsHandler serves /targets, which lists all servers that are measured
+// on the metrics path (including discovered ones) with the result of their
+// last measurement and whether queries to them are currently suspended, like
+// the targets page of Prometheus. It responds with JSON instead of HTML for
+// "format=json" or if the client accepts JSON.
+type targetsHandler struct {
+	Collector Collector
+}
+
+// targetStatus is an entry on /targets. The JSON field names are part of the
+// API and must not be changed.
+type targetStatus struct {
+	apiServerStatus
+	//"up", "down" or "unknown" (not measured yet)
+	State string `json:"state"`
+	//"closed", "open" or "half_open"; empty if the circuit breaker is disabled
+	CircuitState string `json:"circuit_state,omitempty"`
+	//the code of the kiss-of-death packet that the server is backed off for
+	KissCode string `json:"kiss_of_death_code,omitempty"`
+	//until when queries to the server are suspended
+	BackoffUntil *time.Time `json:"backoff_until"`
+}
+
+// ServeHTTP implements the http.Handler interface.
+func (h targetsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	targets := []targetStatus{}
+	for _, s := range h.Collector.serverStatuses() {
+		targets = append(targets, h.newTargetStatus(s))
+	}
+
+	if r.URL.Query().Get("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.SetEscapeHTML(false)
+		err := enc.Encode(struct {
+			Targets []targetStatus `json:"targets"`
+		}{targets})
+		if err != nil {
+			slog.Error("cannot write targets", "err", err)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := targetsPageTemplate.Execute(w, targets)
+	if err != nil {
+		slog.Error("cannot render targets page", "err", err)
+	}
+}
+
+func (h targetsHandler) newTargetStatus(s addressedServerStatus) targetStatus {
+	result := targetStatus{apiServerStatus: newAPIServerStatus(s)}
+	switch {
+	case result.Up:
+		result.State = "up"
+	case result.LastMeasurement != nil:
+		result.State = "down"
+	default:
+		result.State = "unknown"
+	}
+
+	var until time.Time
+	if b := h.Collector.CircuitBreaker; b != nil {
+		result.CircuitState, until = b.State(s.Address)
+	}
+	if b := h.Collector.KissOfDeath; b != nil {
+		code, kissUntil := b.State(s.Address)
+		if code != "" {
+			result.KissCode = code
+			if kissUntil.After(until) {
+				until = kissUntil
+			}
+		}
+	}
+	if !until.IsZero() {
+		until = until.UTC()
+		result.BackoffUntil = &until
+	}
+	return result
+}
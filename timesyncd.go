@@ -0,0 +1,261 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+* Copyright 2015 The Prometheus Authors
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"log/slog"
+	"math"
+	"net"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	timesyncdUpDesc = prometheus.NewDesc(
+		"ntp_timesyncd_up",
+		"Whether the last query to systemd-timesyncd succeeded (1) or not (0).",
+		nil, nil,
+	)
+	timesyncdServerDesc = prometheus.NewDesc(
+		"ntp_timesyncd_server_info",
+		"Name and address of the NTP server that systemd-timesyncd currently uses (always 1).",
+		[]string{"server", "address"}, nil,
+	)
+	timesyncdSynchronizedDesc = prometheus.NewDesc(
+		"ntp_timesyncd_synchronized",
+		"Whether the kernel considers the system clock synchronized (1) or not (0), as reported by systemd-timedated.",
+		nil, nil,
+	)
+	timesyncdPollIntervalDesc = prometheus.NewDesc(
+		"ntp_timesyncd_poll_interval_seconds",
+		"Interval at which systemd-timesyncd currently polls its NTP server.",
+		nil, nil,
+	)
+	timesyncdFrequencyDesc = prometheus.NewDesc(
+		"ntp_timesyncd_frequency_ppm",
+		"Frequency correction of the system clock set by systemd-timesyncd, in parts per million.",
+		nil, nil,
+	)
+	timesyncdLeapIndicatorDesc = prometheus.NewDesc(
+		"ntp_timesyncd_leap_indicator",
+		"Leap indicator in the last NTP response received by systemd-timesyncd.",
+		nil, nil,
+	)
+	timesyncdStratumDesc = prometheus.NewDesc(
+		"ntp_timesyncd_stratum",
+		"Stratum in the last NTP response received by systemd-timesyncd.",
+		nil, nil,
+	)
+	timesyncdPrecisionDesc = prometheus.NewDesc(
+		"ntp_timesyncd_precision_seconds",
+		"Precision in the last NTP response received by systemd-timesyncd.",
+		nil, nil,
+	)
+	timesyncdRootDelayDesc = prometheus.NewDesc(
+		"ntp_timesyncd_root_delay_seconds",
+		"Root delay in the last NTP response received by systemd-timesyncd.",
+		nil, nil,
+	)
+	timesyncdRootDispersionDesc = prometheus.NewDesc(
+		"ntp_timesyncd_root_dispersion_seconds",
+		"Root dispersion in the last NTP response received by systemd-timesyncd.",
+		nil, nil,
+	)
+	timesyncdOffsetDesc = prometheus.NewDesc(
+		"ntp_timesyncd_offset_seconds",
+		"Clock offset measured by the last NTP query of systemd-timesyncd (positive if the local clock was behind).",
+		nil, nil,
+	)
+	timesyncdDelayDesc = prometheus.NewDesc(
+		"ntp_timesyncd_delay_seconds",
+		"Round-trip delay of the last NTP query of systemd-timesyncd.",
+		nil, nil,
+	)
+	timesyncdJitterDesc = prometheus.NewDesc(
+		"ntp_timesyncd_jitter_seconds",
+		"Jitter of the offsets measured by systemd-timesyncd.",
+		nil, nil,
+	)
+	timesyncdPacketsDesc = prometheus.NewDesc(
+		"ntp_timesyncd_packets",
+		"Number of NTP responses that systemd-timesyncd received from its current server.",
+		nil, nil,
+	)
+	timesyncdSpikeDesc = prometheus.NewDesc(
+		"ntp_timesyncd_spike",
+		"Whether systemd-timesyncd considered the last NTP response a spike and ignored it (1) or not (0).",
+		nil, nil,
+	)
+)
+
+// timesyncdCollector reports the state of systemd-timesyncd, which it reads
+// over D-Bus during each scrape (like "timedatectl timesync-status").
+type timesyncdCollector struct {
+	Timeout time.Duration
+}
+
+// Describe implements the prometheus.Collector interface.
+func (c timesyncdCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- timesyncdUpDesc
+	ch <- timesyncdServerDesc
+	ch <- timesyncdSynchronizedDesc
+	ch <- timesyncdPollIntervalDesc
+	ch <- timesyncdFrequencyDesc
+	ch <- timesyncdLeapIndicatorDesc
+	ch <- timesyncdStratumDesc
+	ch <- timesyncdPrecisionDesc
+	ch <- timesyncdRootDelayDesc
+	ch <- timesyncdRootDispersionDesc
+	ch <- timesyncdOffsetDesc
+	ch <- timesyncdDelayDesc
+	ch <- timesyncdJitterDesc
+	ch <- timesyncdPacketsDesc
+	ch <- timesyncdSpikeDesc
+}
+
+// Collect implements the prometheus.Collector interface.
+func (c timesyncdCollector) Collect(ch chan<- prometheus.Metric) {
+	up := 0.0
+	defer func() {
+		ch <- prometheus.MustNewConstMetric(timesyncdUpDesc, prometheus.GaugeValue, up)
+	}()
+	gauge := func(desc *prometheus.Desc, value float64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, labels...)
+	}
+
+	conn, err := dialSystemBus(c.Timeout)
+	if err != nil {
+		slog.Error("couldn't connect to D-Bus system bus", "err", err)
+		return
+	}
+	defer conn.Close()
+
+	props, err := conn.GetAllProperties("org.freedesktop.timesync1", "/org/freedesktop/timesync1", "org.freedesktop.timesync1.Manager")
+	if err != nil {
+		slog.Error("couldn't get properties of systemd-timesyncd", "err", err)
+		return
+	}
+	up = 1
+
+	serverName, _ := props["ServerName"].(string)
+	serverAddress := ""
+	if addr, ok := props["ServerAddress"].([]interface{}); ok && len(addr) == 2 {
+		if ip, ok := addr[1].([]byte); ok && (len(ip) == net.IPv4len || len(ip) == net.IPv6len) {
+			serverAddress = net.IP(ip).String()
+		}
+	}
+	if serverName != "" || serverAddress != "" {
+		gauge(timesyncdServerDesc, 1, serverName, serverAddress)
+	}
+	if interval, ok := props["PollIntervalUSec"].(uint64); ok {
+		gauge(timesyncdPollIntervalDesc, float64(interval)/1e6)
+	}
+	if freq, ok := props["Frequency"].(int64); ok {
+		//same unit as in struct timex (ppm with 16-bit fractional part)
+		gauge(timesyncdFrequencyDesc, float64(freq)/65536)
+	}
+	if msg, ok := parseTimesyncdNTPMessage(props["NTPMessage"]); ok {
+		gauge(timesyncdLeapIndicatorDesc, float64(msg.Leap))
+		gauge(timesyncdStratumDesc, float64(msg.Stratum))
+		gauge(timesyncdPrecisionDesc, math.Pow(2, float64(msg.Precision)))
+		gauge(timesyncdRootDelayDesc, usecToSeconds(msg.RootDelay))
+		gauge(timesyncdRootDispersionDesc, usecToSeconds(msg.RootDispersion))
+		//the timestamps are in microseconds, so these do not overflow
+		offset := (int64(msg.Receive-msg.Origin) + int64(msg.Transmit-msg.Destination)) / 2
+		delay := int64(msg.Destination-msg.Origin) - int64(msg.Transmit-msg.Receive)
+		gauge(timesyncdOffsetDesc, float64(offset)/1e6)
+		gauge(timesyncdDelayDesc, float64(delay)/1e6)
+		gauge(timesyncdJitterDesc, usecToSeconds(msg.Jitter))
+		gauge(timesyncdPacketsDesc, float64(msg.PacketCount))
+		gauge(timesyncdSpikeDesc, boolToFloat(msg.Spike))
+	}
+
+	//the sync state is not a property of timesyncd itself, so ask timedated
+	//(like timedatectl does)
+	props, err = conn.GetAllProperties("org.freedesktop.timedate1", "/org/freedesktop/timedate1", "org.freedesktop.timedate1")
+	if err != nil {
+		slog.Debug("couldn't get properties of systemd-timedated", "err", err)
+		return
+	}
+	if synced, ok := props["NTPSynchronized"].(bool); ok {
+		gauge(timesyncdSynchronizedDesc, boolToFloat(synced))
+	}
+}
+
+// timesyncdNTPMessage is the NTPMessage property of systemd-timesyncd, which
+// contains the last NTP response that it received. Timestamps and durations
+// are in microseconds.
+type timesyncdNTPMessage struct {
+	Leap           uint32
+	Stratum        uint32
+	Precision      int32
+	RootDelay      uint64
+	RootDispersion uint64
+	Origin         uint64
+	Receive        uint64
+	Transmit       uint64
+	Destination    uint64
+	Spike          bool
+	PacketCount    uint64
+	Jitter         uint64
+}
+
+func parseTimesyncdNTPMessage(value interface{}) (msg timesyncdNTPMessage, ok bool) {
+	//signature is (uuuuittayttttbtt)
+	fields, isStruct := value.([]interface{})
+	if !isStruct || len(fields) != 15 {
+		return msg, false
+	}
+	ok = true
+	u32 := func(idx int) uint32 {
+		v, isType := fields[idx].(uint32)
+		ok = ok && isType
+		return v
+	}
+	u64 := func(idx int) uint64 {
+		v, isType := fields[idx].(uint64)
+		ok = ok && isType
+		return v
+	}
+	msg.Leap = u32(0)
+	msg.Stratum = u32(3)
+	precision, isType := fields[4].(int32)
+	ok = ok && isType
+	msg.Precision = precision
+	msg.RootDelay = u64(5)
+	msg.RootDispersion = u64(6)
+	msg.Origin = u64(8)
+	msg.Receive = u64(9)
+	msg.Transmit = u64(10)
+	msg.Destination = u64(11)
+	spike, isType := fields[12].(bool)
+	ok = ok && isType
+	msg.Spike = spike
+	msg.PacketCount = u64(13)
+	msg.Jitter = u64(14)
+	//timesyncd reports an empty message before the first response arrives
+	return msg, ok && msg.Destination != 0
+}
+
+func usecToSeconds(usec uint64) float64 {
+	return float64(usec) / 1e6
+}
@@ -0,0 +1,242 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+* Copyright 2015 The Prometheus Authors
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"log/slog"
+	"math"
+	"syscall"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// from <sys/timex.h>
+const (
+	timexStatusUnsync = 0x0040
+	timexStatusNano   = 0x2000
+	timexStateError   = 5
+)
+
+var timexStatusFlags = []struct {
+	Bit  int32
+	Name string
+}{
+	{0x0001, "PLL"},
+	{0x0002, "PPSFREQ"},
+	{0x0004, "PPSTIME"},
+	{0x0008, "FLL"},
+	{0x0010, "INS"},
+	{0x0020, "DEL"},
+	{timexStatusUnsync, "UNSYNC"},
+	{0x0080, "FREQHOLD"},
+	{0x0100, "PPSSIGNAL"},
+	{0x0200, "PPSJITTER"},
+	{0x0400, "PPSWANDER"},
+	{0x0800, "PPSERROR"},
+	{0x1000, "CLOCKERR"},
+	{timexStatusNano, "NANO"},
+	{0x4000, "MODE"},
+	{0x8000, "CLK"},
+}
+
+var (
+	timexSynchronizedDesc = prometheus.NewDesc(
+		"ntp_timex_synchronized",
+		"Whether the kernel considers the system clock synchronized (1) or not (0).",
+		nil, nil,
+	)
+	timexStateDesc = prometheus.NewDesc(
+		"ntp_timex_state",
+		"Clock state returned by adjtimex (0 = OK, 1 = leap second insertion pending, 2 = deletion pending, 3 = insertion in progress, 4 = leap second occurred, 5 = clock not synchronized).",
+		nil, nil,
+	)
+	timexStatusDesc = prometheus.NewDesc(
+		"ntp_timex_status_flag",
+		"Whether the status flag of the kernel clock discipline is set (1) or not (0).",
+		[]string{"flag"}, nil,
+	)
+	timexOffsetDesc = prometheus.NewDesc(
+		"ntp_timex_offset_seconds",
+		"Remaining time offset that the kernel clock discipline is correcting.",
+		nil, nil,
+	)
+	timexFrequencyDesc = prometheus.NewDesc(
+		"ntp_timex_frequency_ppm",
+		"Frequency offset of the system clock, in parts per million.",
+		nil, nil,
+	)
+	timexMaxErrorDesc = prometheus.NewDesc(
+		"ntp_timex_max_error_seconds",
+		"Maximum error of the system clock as set by the time synchronization daemon and grown by the kernel.",
+		nil, nil,
+	)
+	timexEstimatedErrorDesc = prometheus.NewDesc(
+		"ntp_timex_estimated_error_seconds",
+		"Estimated error of the system clock as set by the time synchronization daemon.",
+		nil, nil,
+	)
+	timexTimeConstantDesc = prometheus.NewDesc(
+		"ntp_timex_time_constant",
+		"Time constant of the kernel PLL.",
+		nil, nil,
+	)
+	timexTickDesc = prometheus.NewDesc(
+		"ntp_timex_tick_seconds",
+		"Length of a clock tick.",
+		nil, nil,
+	)
+	timexTAIOffsetDesc = prometheus.NewDesc(
+		"ntp_timex_tai_offset_seconds",
+		"Offset between TAI and UTC as known to the kernel.",
+		nil, nil,
+	)
+
+	timexPPSFrequencyDesc = prometheus.NewDesc(
+		"ntp_timex_pps_frequency_ppm",
+		"Frequency offset of the system clock measured from the PPS signal, in parts per million.",
+		nil, nil,
+	)
+	timexPPSJitterDesc = prometheus.NewDesc(
+		"ntp_timex_pps_jitter_seconds",
+		"Jitter of the PPS signal.",
+		nil, nil,
+	)
+	timexPPSCalibrationIntervalDesc = prometheus.NewDesc(
+		"ntp_timex_pps_calibration_interval_seconds",
+		"Duration of the PPS calibration interval.",
+		nil, nil,
+	)
+	timexPPSStabilityDesc = prometheus.NewDesc(
+		"ntp_timex_pps_stability_ppm",
+		"Stability of the PPS frequency (average of the frequency changes between calibration intervals), in parts per million.",
+		nil, nil,
+	)
+	timexPPSJitterCountDesc = prometheus.NewDesc(
+		"ntp_timex_pps_jitter_limit_exceeded_total",
+		"Number of PPS pulses that were discarded because their jitter exceeded the limit.",
+		nil, nil,
+	)
+	timexPPSCalibrationCountDesc = prometheus.NewDesc(
+		"ntp_timex_pps_calibrations_total",
+		"Number of PPS calibration intervals.",
+		nil, nil,
+	)
+	timexPPSErrorCountDesc = prometheus.NewDesc(
+		"ntp_timex_pps_calibration_errors_total",
+		"Number of PPS calibration errors (e.g. because of missing or extra pulses).",
+		nil, nil,
+	)
+	timexPPSStabilityCountDesc = prometheus.NewDesc(
+		"ntp_timex_pps_stability_limit_exceeded_total",
+		"Number of PPS calibration intervals where the stability exceeded the limit.",
+		nil, nil,
+	)
+)
+
+// timexCollector reports the state of the clock discipline in the kernel,
+// which is read with the adjtimex syscall during each scrape. This is how the
+// kernel sees the local clock, as steered by whatever time synchronization
+// daemon runs on the host. If PPS is set, the statistics of the kernel PPS
+// discipline (hardpps) are reported as well.
+type timexCollector struct {
+	PPS bool
+}
+
+// Describe implements the prometheus.Collector interface.
+func (c timexCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- timexSynchronizedDesc
+	ch <- timexStateDesc
+	ch <- timexStatusDesc
+	ch <- timexOffsetDesc
+	ch <- timexFrequencyDesc
+	ch <- timexMaxErrorDesc
+	ch <- timexEstimatedErrorDesc
+	ch <- timexTimeConstantDesc
+	ch <- timexTickDesc
+	ch <- timexTAIOffsetDesc
+	if c.PPS {
+		ch <- timexPPSFrequencyDesc
+		ch <- timexPPSJitterDesc
+		ch <- timexPPSCalibrationIntervalDesc
+		ch <- timexPPSStabilityDesc
+		ch <- timexPPSJitterCountDesc
+		ch <- timexPPSCalibrationCountDesc
+		ch <- timexPPSErrorCountDesc
+		ch <- timexPPSStabilityCountDesc
+	}
+}
+
+// Collect implements the prometheus.Collector interface.
+func (c timexCollector) Collect(ch chan<- prometheus.Metric) {
+	var tx syscall.Timex //Modes = 0 means read-only
+	state, err := syscall.Adjtimex(&tx)
+	if err != nil {
+		slog.Error("adjtimex failed", "err", err)
+		return
+	}
+	gauge := func(desc *prometheus.Desc, value float64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, labels...)
+	}
+
+	//TIME_ERROR is also returned when STA_UNSYNC is set
+	gauge(timexSynchronizedDesc, boolToFloat(state != timexStateError))
+	gauge(timexStateDesc, float64(state))
+	for _, flag := range timexStatusFlags {
+		gauge(timexStatusDesc, boolToFloat(int32(tx.Status)&flag.Bit != 0), flag.Name)
+	}
+
+	//the offset and PPS jitter are in nanoseconds if STA_NANO is set,
+	//microseconds otherwise
+	offsetUnit := 1e-6
+	if int32(tx.Status)&timexStatusNano != 0 {
+		offsetUnit = 1e-9
+	}
+	gauge(timexOffsetDesc, float64(tx.Offset)*offsetUnit)
+	//frequencies are given in ppm with a 16-bit fractional part
+	gauge(timexFrequencyDesc, float64(tx.Freq)/65536)
+	gauge(timexMaxErrorDesc, float64(tx.Maxerror)/1e6)
+	gauge(timexEstimatedErrorDesc, float64(tx.Esterror)/1e6)
+	gauge(timexTimeConstantDesc, float64(tx.Constant))
+	gauge(timexTickDesc, float64(tx.Tick)/1e6)
+	gauge(timexTAIOffsetDesc, float64(tx.Tai))
+
+	if c.PPS {
+		counter := func(desc *prometheus.Desc, value float64) {
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, value)
+		}
+		gauge(timexPPSFrequencyDesc, float64(tx.Ppsfreq)/65536)
+		gauge(timexPPSJitterDesc, float64(tx.Jitter)*offsetUnit)
+		gauge(timexPPSCalibrationIntervalDesc, math.Pow(2, float64(tx.Shift)))
+		gauge(timexPPSStabilityDesc, float64(tx.Stabil)/65536)
+		counter(timexPPSJitterCountDesc, float64(tx.Jitcnt))
+		counter(timexPPSCalibrationCountDesc, float64(tx.Calcnt))
+		counter(timexPPSErrorCountDesc, float64(tx.Errcnt))
+		counter(timexPPSStabilityCountDesc, float64(tx.Stbcnt))
+	}
+}
+
+// readKernelTAIOffset returns the offset between TAI and UTC as known to the
+// kernel (0 if it was never set).
+func readKernelTAIOffset() (int, error) {
+	var tx syscall.Timex
+	_, err := syscall.Adjtimex(&tx)
+	return int(tx.Tai), err
+}
@@ -0,0 +1,47 @@
+//go:build !linux
+// +build !linux
+
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+* Copyright 2015 The Prometheus Authors
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"errors"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// timexCollector is only supported on Linux (main() refuses to enable it on
+// other platforms).
+type timexCollector struct {
+	PPS bool
+}
+
+// Describe implements the prometheus.Collector interface.
+func (c timexCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+// Collect implements the prometheus.Collector interface.
+func (c timexCollector) Collect(ch chan<- prometheus.Metric) {}
+
+// readKernelTAIOffset is only supported on Linux.
+func readKernelTAIOffset() (int, error) {
+	return 0, errors.New("reading the TAI offset of the kernel is only supported on Linux")
+}
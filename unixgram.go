@@ -0,0 +1,72 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+* Copyright 2015 The Prometheus Authors
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// unixgramConn is a datagram connection to a Unix socket, bound to a socket of
+// its own in a temporary directory. Daemons like chronyd and ptp4l send their
+// replies to the address of the requesting socket, so an unbound socket would
+// not receive any replies.
+type unixgramConn struct {
+	*net.UnixConn
+	dir string
+}
+
+func dialUnixgram(path string) (*unixgramConn, error) {
+	dir, err := ioutil.TempDir("", "ntp_exporter")
+	if err != nil {
+		return nil, err
+	}
+	localPath := filepath.Join(dir, "client.sock")
+	conn, err := net.DialUnix("unixgram",
+		&net.UnixAddr{Name: localPath, Net: "unixgram"},
+		&net.UnixAddr{Name: path, Net: "unixgram"},
+	)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	//the daemon may run as an unprivileged user, so it needs to be able to
+	//write to our socket
+	err = os.Chmod(dir, 0755)
+	if err == nil {
+		err = os.Chmod(localPath, 0666)
+	}
+	if err != nil {
+		conn.Close()
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return &unixgramConn{conn, dir}, nil
+}
+
+// Close closes the connection and removes our socket.
+func (c *unixgramConn) Close() error {
+	err := c.UnixConn.Close()
+	os.RemoveAll(c.dir)
+	return err
+}
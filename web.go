@@ -0,0 +1,360 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+* Copyright 2015 The Prometheus Authors
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// webConfig contains the contents of the file given with -web.config.file.
+// It uses the format of the exporter-toolkit that is used by the official
+// Prometheus exporters. The exporter-toolkit itself cannot be vendored because
+// it requires much newer versions of client_golang and common than the ones
+// vendored here, so only a subset of its settings is implemented. Unknown
+// settings are rejected instead of being ignored, since ignoring a security
+// setting would be worse than failing to start.
+type webConfig struct {
+	TLSServerConfig  *webTLSConfig     `yaml:"tls_server_config"`
+	HTTPServerConfig webHTTPConfig     `yaml:"http_server_config"`
+	BasicAuthUsers   map[string]string `yaml:"basic_auth_users"`
+}
+
+// webTLSConfig contains the "tls_server_config" section of the web config.
+type webTLSConfig struct {
+	CertFile                 string   `yaml:"cert_file"`
+	KeyFile                  string   `yaml:"key_file"`
+	ClientAuth               string   `yaml:"client_auth_type"`
+	ClientCAFile             string   `yaml:"client_ca_file"`
+	ClientAllowedSANs        []string `yaml:"client_allowed_sans"`
+	MinVersion               string   `yaml:"min_version"`
+	MaxVersion               string   `yaml:"max_version"`
+	CipherSuites             []string `yaml:"cipher_suites"`
+	CurvePreferences         []string `yaml:"curve_preferences"`
+	PreferServerCipherSuites *bool    `yaml:"prefer_server_cipher_suites"` //ignored by Go since 1.18
+}
+
+// webHTTPConfig contains the "http_server_config" section of the web config.
+type webHTTPConfig struct {
+	HTTP2   *bool             `yaml:"http2"` //nil means true
+	Headers map[string]string `yaml:"headers"`
+}
+
+var (
+	tlsClientAuthTypes = map[string]tls.ClientAuthType{
+		"":                           tls.NoClientCert,
+		"NoClientCert":               tls.NoClientCert,
+		"RequestClientCert":          tls.RequestClientCert,
+		"RequireAnyClientCert":       tls.RequireAnyClientCert,
+		"VerifyClientCertIfGiven":    tls.VerifyClientCertIfGiven,
+		"RequireAndVerifyClientCert": tls.RequireAndVerifyClientCert,
+	}
+	tlsVersions = map[string]uint16{
+		"TLS10": tls.VersionTLS10,
+		"TLS11": tls.VersionTLS11,
+		"TLS12": tls.VersionTLS12,
+		"TLS13": tls.VersionTLS13,
+	}
+	tlsCurves = []tls.CurveID{tls.CurveP256, tls.CurveP384, tls.CurveP521, tls.X25519, tls.X25519MLKEM768}
+	//same as in the exporter-toolkit
+	webAllowedHeaders = []string{
+		"Strict-Transport-Security",
+		"X-Content-Type-Options",
+		"X-Frame-Options",
+		"X-XSS-Protection",
+		"Content-Security-Policy",
+	}
+)
+
+// loadWebConfig reads the web config file at the given path.
+func loadWebConfig(path string) (*webConfig, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg webConfig
+	err = yaml.UnmarshalStrict(buf, &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse %s: %s", path, err)
+	}
+	for name := range cfg.HTTPServerConfig.Headers {
+		if !containsString(webAllowedHeaders, name) {
+			return nil, fmt.Errorf("%s: header %q cannot be set in http_server_config (allowed headers: %s)", path, name, strings.Join(webAllowedHeaders, ", "))
+		}
+	}
+	//fail early on passwords that are not bcrypt hashes, instead of rejecting
+	//every request for these users
+	for user, hash := range cfg.BasicAuthUsers {
+		_, err := bcrypt.Cost([]byte(hash))
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid bcrypt hash for basic_auth_users.%s: %s", path, user, err)
+		}
+	}
+	return &cfg, nil
+}
+
+func (c webTLSConfig) build() (*tls.Config, error) {
+	if c.CertFile == "" || c.KeyFile == "" {
+		return nil, errors.New("cert_file and key_file are required")
+	}
+	//fail early if the certificate cannot be loaded, but load it again for
+	//each connection, so that renewed certificates are picked up without a
+	//restart
+	_, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+			return &cert, err
+		},
+	}
+
+	var exists bool
+	cfg.ClientAuth, exists = tlsClientAuthTypes[c.ClientAuth]
+	if !exists {
+		return nil, fmt.Errorf("invalid client_auth_type %q", c.ClientAuth)
+	}
+	if c.ClientCAFile != "" {
+		buf, err := ioutil.ReadFile(c.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ClientCAs = x509.NewCertPool()
+		if !cfg.ClientCAs.AppendCertsFromPEM(buf) {
+			return nil, fmt.Errorf("no certificates found in %s", c.ClientCAFile)
+		}
+	}
+	if cfg.ClientCAs == nil && (cfg.ClientAuth == tls.VerifyClientCertIfGiven || cfg.ClientAuth == tls.RequireAndVerifyClientCert) {
+		return nil, fmt.Errorf("client_auth_type %s requires client_ca_file", c.ClientAuth)
+	}
+	if len(c.ClientAllowedSANs) > 0 {
+		if cfg.ClientAuth != tls.RequireAndVerifyClientCert {
+			return nil, errors.New("client_allowed_sans requires client_auth_type RequireAndVerifyClientCert")
+		}
+		cfg.VerifyPeerCertificate = c.verifyClientSAN
+	}
+
+	if c.MinVersion != "" {
+		cfg.MinVersion, exists = tlsVersions[c.MinVersion]
+		if !exists {
+			return nil, fmt.Errorf("invalid min_version %q", c.MinVersion)
+		}
+	}
+	if c.MaxVersion != "" {
+		cfg.MaxVersion, exists = tlsVersions[c.MaxVersion]
+		if !exists {
+			return nil, fmt.Errorf("invalid max_version %q", c.MaxVersion)
+		}
+		if cfg.MaxVersion < cfg.MinVersion {
+			return nil, errors.New("max_version must not be lower than min_version")
+		}
+	}
+	for _, name := range c.CipherSuites {
+		id, exists := tlsCipherSuiteByName(name)
+		if !exists {
+			return nil, fmt.Errorf("invalid cipher_suites entry %q", name)
+		}
+		cfg.CipherSuites = append(cfg.CipherSuites, id)
+	}
+	for _, name := range c.CurvePreferences {
+		id, exists := tlsCurveByName(name)
+		if !exists {
+			return nil, fmt.Errorf("invalid curve_preferences entry %q", name)
+		}
+		cfg.CurvePreferences = append(cfg.CurvePreferences, id)
+	}
+	return cfg, nil
+}
+
+// verifyClientSAN implements tls.Config.VerifyPeerCertificate for
+// client_allowed_sans. It is only called after the client certificate was
+// verified against the client CA, so only the SANs need to be checked.
+func (c webTLSConfig) verifyClientSAN(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return errors.New("no client certificate")
+	}
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return err
+	}
+	sans := append(append([]string(nil), cert.DNSNames...), cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		sans = append(sans, uri.String())
+	}
+	for _, san := range sans {
+		if containsString(c.ClientAllowedSANs, san) {
+			return nil
+		}
+	}
+	return fmt.Errorf("client certificate SANs %v are not in client_allowed_sans", sans)
+}
+
+func tlsCipherSuiteByName(name string) (uint16, bool) {
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		if suite.Name == name {
+			return suite.ID, true
+		}
+	}
+	return 0, false
+}
+
+func tlsCurveByName(name string) (tls.CurveID, bool) {
+	for _, curve := range tlsCurves {
+		if curve.String() == name {
+			return curve, true
+		}
+	}
+	return 0, false
+}
+
+// basicAuthHandler only lets requests through to the next handler if they
+// carry the credentials of one of the users from basic_auth_users.
+type basicAuthHandler struct {
+	//maps usernames to bcrypt hashes of their passwords
+	Users map[string]string
+	Next  http.Handler
+
+	//verified contains the credentials that were verified successfully
+	//before, since checking a bcrypt hash takes a long time on purpose
+	verified struct {
+		sync.Mutex
+		Set map[[sha256.Size]byte]bool
+	}
+}
+
+// dummyBcryptHash is checked for unknown users, so that the response time
+// does not tell whether a user exists.
+const dummyBcryptHash = "$2y$10$0123456789abcdefghijkeK/tjEUNJ5lSs36b.olkaeJt32CR3gx2"
+
+func (h *basicAuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, password, ok := r.BasicAuth()
+	if ok && h.isAuthorized(user, password) {
+		h.Next.ServeHTTP(w, r)
+		return
+	}
+	w.Header().Set("WWW-Authenticate", "Basic")
+	http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+}
+
+func (h *basicAuthHandler) isAuthorized(user, password string) bool {
+	hash, exists := h.Users[user]
+	if !exists {
+		hash = dummyBcryptHash
+	}
+	key := sha256.Sum256([]byte(user + "\x00" + hash + "\x00" + password))
+
+	h.verified.Lock()
+	verified := h.verified.Set[key]
+	h.verified.Unlock()
+	if !verified {
+		verified = bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+		if verified {
+			h.verified.Lock()
+			if h.verified.Set == nil {
+				h.verified.Set = make(map[[sha256.Size]byte]bool)
+			}
+			h.verified.Set[key] = true
+			h.verified.Unlock()
+		}
+	}
+	return verified && exists
+}
+
+// newHTTPServer returns a server for the handlers registered with the http
+// package on the given address, with TLS and basic authentication if enabled
+// in the web config file.
+func newHTTPServer(address, webConfigPath string) (*http.Server, error) {
+	server := &http.Server{Addr: address}
+	if webConfigPath == "" {
+		return server, nil
+	}
+	cfg, err := loadWebConfig(webConfigPath)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.TLSServerConfig != nil {
+		server.TLSConfig, err = cfg.TLSServerConfig.build()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", webConfigPath, err)
+		}
+	}
+	if cfg.HTTPServerConfig.HTTP2 != nil && !*cfg.HTTPServerConfig.HTTP2 {
+		//a non-nil empty map disables HTTP/2
+		server.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	}
+	if len(cfg.BasicAuthUsers) > 0 {
+		server.Handler = &basicAuthHandler{Users: cfg.BasicAuthUsers, Next: http.DefaultServeMux}
+	}
+	if len(cfg.HTTPServerConfig.Headers) > 0 {
+		next := server.Handler
+		if next == nil {
+			next = http.DefaultServeMux
+		}
+		server.Handler = headersHandler{Headers: cfg.HTTPServerConfig.Headers, Next: next}
+	}
+	return server, nil
+}
+
+// headersHandler adds the headers from http_server_config to all responses.
+type headersHandler struct {
+	Headers map[string]string
+	Next    http.Handler
+}
+
+func (h headersHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	for name, value := range h.Headers {
+		w.Header().Set(name, value)
+	}
+	h.Next.ServeHTTP(w, r)
+}
+
+// serveHTTP runs the given server from newHTTPServer until it is shut down,
+// in which case http.ErrServerClosed is returned. If `listener` is nil, the
+// server listens on its own address.
+func serveHTTP(server *http.Server, listener net.Listener) error {
+	switch {
+	case listener == nil && server.TLSConfig != nil:
+		return server.ListenAndServeTLS("", "")
+	case listener == nil:
+		return server.ListenAndServe()
+	case server.TLSConfig != nil:
+		return server.ServeTLS(listener, "", "")
+	default:
+		return server.Serve(listener)
+	}
+}
@@ -0,0 +1,219 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+* Copyright 2015 The Prometheus Authors
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBasicAuth(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "web.yaml")
+	//the password is "secret"
+	err := os.WriteFile(path, []byte("basic_auth_users:\n  alice: $2y$04$abcdefghijklmnopqrstuu2r9OfJnfCsdneAXAGHnS4UpFFP8WIrW\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := newHTTPServer("", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.TLSConfig != nil {
+		t.Error("expected TLS to be disabled")
+	}
+	h, ok := server.Handler.(*basicAuthHandler)
+	if !ok {
+		t.Fatalf("expected a basicAuthHandler, got %T", server.Handler)
+	}
+	h.Next = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	testCases := []struct {
+		User     string
+		Password string
+		Expected int
+	}{
+		{"alice", "secret", http.StatusNoContent},
+		//again, to check the cache of verified credentials
+		{"alice", "secret", http.StatusNoContent},
+		{"alice", "wrong", http.StatusUnauthorized},
+		{"bob", "secret", http.StatusUnauthorized},
+		{"", "", http.StatusUnauthorized},
+	}
+	for _, tc := range testCases {
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		if tc.User != "" {
+			req.SetBasicAuth(tc.User, tc.Password)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tc.Expected {
+			t.Errorf("%s:%s: expected status %d, got %d", tc.User, tc.Password, tc.Expected, rec.Code)
+		}
+		if rec.Code == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") != "Basic" {
+			t.Errorf("%s:%s: expected WWW-Authenticate header, got %q", tc.User, tc.Password, rec.Header().Get("WWW-Authenticate"))
+		}
+	}
+}
+
+func TestBasicAuthRejectsInvalidHash(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "web.yaml")
+	err := os.WriteFile(path, []byte("basic_auth_users:\n  alice: secret\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = newHTTPServer("", path)
+	if err == nil {
+		t.Error("expected an error for a password that is not a bcrypt hash")
+	}
+}
+
+func TestWebConfigToolkitSettings(t *testing.T) {
+	dir := t.TempDir()
+	writeTestCertificate(t, filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"))
+	path := filepath.Join(dir, "web.yaml")
+	err := os.WriteFile(path, []byte(`
+tls_server_config:
+  cert_file: `+filepath.Join(dir, "tls.crt")+`
+  key_file: `+filepath.Join(dir, "tls.key")+`
+  cipher_suites: [ TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 ]
+  curve_preferences: [ X25519, CurveP256 ]
+  prefer_server_cipher_suites: true
+http_server_config:
+  http2: false
+  headers:
+    X-Frame-Options: deny
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := newHTTPServer("", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := server.TLSConfig
+	if len(cfg.CipherSuites) != 1 || cfg.CipherSuites[0] != tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 {
+		t.Errorf("unexpected cipher suites: %v", cfg.CipherSuites)
+	}
+	if len(cfg.CurvePreferences) != 2 || cfg.CurvePreferences[0] != tls.X25519 || cfg.CurvePreferences[1] != tls.CurveP256 {
+		t.Errorf("unexpected curve preferences: %v", cfg.CurvePreferences)
+	}
+	if server.TLSNextProto == nil {
+		t.Error("expected HTTP/2 to be disabled")
+	}
+	rec := httptest.NewRecorder()
+	server.Handler.ServeHTTP(rec, httptest.NewRequest("GET", "/-/healthy", nil))
+	if rec.Header().Get("X-Frame-Options") != "deny" {
+		t.Errorf("expected X-Frame-Options header, got %q", rec.Header().Get("X-Frame-Options"))
+	}
+}
+
+func TestWebConfigErrors(t *testing.T) {
+	testCases := []struct {
+		Content  string
+		Expected string
+	}{
+		{
+			Content:  "http_server_config:\n  headers:\n    Server: foo\n",
+			Expected: `header "Server" cannot be set in http_server_config`,
+		},
+		{
+			Content:  "tls_server_config:\n  rate_limit: 1\n",
+			Expected: "field rate_limit not found",
+		},
+	}
+	for _, tc := range testCases {
+		path := filepath.Join(t.TempDir(), "web.yaml")
+		err := os.WriteFile(path, []byte(tc.Content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = newHTTPServer("", path)
+		if err == nil || !strings.Contains(err.Error(), tc.Expected) {
+			t.Errorf("expected error containing %q, got %v", tc.Expected, err)
+		}
+	}
+}
+
+// writeTestCertificate writes a self-signed certificate and its key to the
+// given paths.
+func writeTestCertificate(t *testing.T, certPath, keyPath string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientAllowedSANs(t *testing.T) {
+	dir := t.TempDir()
+	writeTestCertificate(t, filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"))
+	buf, err := os.ReadFile(filepath.Join(dir, "tls.crt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(buf)
+	rawCerts := [][]byte{block.Bytes}
+
+	err = webTLSConfig{ClientAllowedSANs: []string{"prometheus", "localhost"}}.verifyClientSAN(rawCerts, nil)
+	if err != nil {
+		t.Errorf("expected allowed SAN to be accepted, got %s", err)
+	}
+	err = webTLSConfig{ClientAllowedSANs: []string{"prometheus"}}.verifyClientSAN(rawCerts, nil)
+	if err == nil {
+		t.Error("expected other SAN to be rejected")
+	}
+}